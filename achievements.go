@@ -0,0 +1,291 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type achievementOperation interface {
+	achievements(context.Context, io.Writer, string) ([]achievementProgress, error)
+	updateAchievements(context.Context, io.Writer, string) ([]achievementProgress, error)
+}
+
+const (
+	criteriaItemsOwned    = "items_owned"
+	criteriaCurrencySpent = "currency_spent"
+	criteriaLoginDays     = "login_days"
+)
+
+// progress is updated when these events are published for the user
+var achievementEvents = []string{
+	"items.granted",
+	"items.traded",
+	"gacha.drawn",
+	"login_bonus.claimed",
+	"mail.claimed",
+	"offer.purchased",
+	"guild.items_withdrawn",
+	// rewards are items, they can complete items_owned
+	"achievement.completed",
+}
+
+type achievement struct {
+	id            string
+	name          string
+	criteria      string
+	currency      string
+	target        int64
+	rewardItemIDs []string
+}
+
+type achievementProgress struct {
+	AchievementID string     `json:"achievement_id"`
+	Name          string     `json:"name"`
+	Criteria      string     `json:"criteria"`
+	Currency      string     `json:"currency,omitempty"`
+	Progress      int64      `json:"progress"`
+	Target        int64      `json:"target"`
+	RewardItemIDs []string   `json:"reward_item_ids"`
+	Completed     bool       `json:"completed"`
+	CompletedAt   *time.Time `json:"completed_at,omitempty"`
+}
+
+func readAchievements(ctx context.Context, txn spannerReader) ([]achievement, error) {
+	stmt := spanner.Statement{SQL: `SELECT achievement_id, name, criteria, currency, target, reward_item_ids FROM achievements ORDER BY achievement_id`}
+	results := []achievement{}
+	err := txn.Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		var a achievement
+		var currency spanner.NullString
+		if err := row.Columns(&a.id, &a.name, &a.criteria, &currency, &a.target, &a.rewardItemIDs); err != nil {
+			return err
+		}
+		a.currency = currency.StringVal
+		results = append(results, a)
+		return nil
+	})
+	return results, err
+}
+
+// readUserAchievements returns the progress stored for the user by achievement_id
+func readUserAchievements(ctx context.Context, txn spannerReader, userID string) (map[string]achievementProgress, error) {
+	results := map[string]achievementProgress{}
+	iter := txn.Read(ctx, "user_achievements", spanner.Key{userID}.AsPrefix(), []string{"achievement_id", "progress", "completed_at"})
+	err := iter.Do(func(row *spanner.Row) error {
+		var p achievementProgress
+		var completedAt spanner.NullTime
+		if err := row.Columns(&p.AchievementID, &p.Progress, &completedAt); err != nil {
+			return err
+		}
+		if completedAt.Valid {
+			p.Completed = true
+			p.CompletedAt = &completedAt.Time
+		}
+		results[p.AchievementID] = p
+		return nil
+	})
+	return results, err
+}
+
+func (a achievement) progress(stored achievementProgress) achievementProgress {
+	stored.AchievementID = a.id
+	stored.Name = a.name
+	stored.Criteria = a.criteria
+	stored.Currency = a.currency
+	stored.Target = a.target
+	stored.RewardItemIDs = a.rewardItemIDs
+	return stored
+}
+
+// criteriaValueInTxn is the current value of the criteria, counted from the tables
+func criteriaValueInTxn(ctx context.Context, txn *spanner.ReadWriteTransaction, userID string, a achievement) (int64, error) {
+	var sql string
+	switch a.criteria {
+	case criteriaItemsOwned:
+		sql = "SELECT COUNT(*) FROM user_items WHERE user_id = @userID AND deleted_at IS NULL AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP())"
+	case criteriaLoginDays:
+		sql = "SELECT IFNULL(SUM(total_days), 0) FROM login_claims WHERE user_id = @userID"
+	case criteriaCurrencySpent:
+		return statInTxn(ctx, txn, userID, spentStat(a.currency))
+	default:
+		log.Printf("achievement %s has unknown criteria %q", a.id, a.criteria)
+		return 0, nil
+	}
+
+	var value int64
+	stmt := spanner.Statement{SQL: sql, Params: map[string]interface{}{"userID": userID}}
+	err := txn.Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		return row.Columns(&value)
+	})
+	return value, err
+}
+
+// get the progress of every achievement
+func (d dbClient) achievements(ctx context.Context, w io.Writer, userID string) ([]achievementProgress, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "achievements")
+	defer span.End()
+
+	txn := d.sc.ReadOnlyTransaction()
+	defer txn.Close()
+
+	if err := userExistsInTxn(ctx, txn, userID); err != nil {
+		return nil, err
+	}
+	definitions, err := readAchievements(ctx, txn)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := readUserAchievements(ctx, txn, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]achievementProgress, 0, len(definitions))
+	for _, a := range definitions {
+		results = append(results, a.progress(stored[a.id]))
+	}
+	return results, nil
+}
+
+// update the progress of the user, and grant the rewards of the achievements completed by this.
+// It counts from the tables every time, so that it can be called any number of times.
+func (d dbClient) updateAchievements(ctx context.Context, w io.Writer, userID string) ([]achievementProgress, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "updateAchievements")
+	defer span.End()
+
+	var completed []achievementProgress
+	_, err := d.sc.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		completed = []achievementProgress{}
+		now := time.Now()
+
+		if err := userExistsInTxn(ctx, txn, userID); err != nil {
+			return err
+		}
+		definitions, err := readAchievements(ctx, txn)
+		if err != nil {
+			return err
+		}
+		stored, err := readUserAchievements(ctx, txn, userID)
+		if err != nil {
+			return err
+		}
+
+		mutations := []*spanner.Mutation{}
+		grants := []grantParams{}
+		for _, a := range definitions {
+			p := a.progress(stored[a.id])
+			if p.Completed {
+				continue
+			}
+			value, err := criteriaValueInTxn(ctx, txn, userID, a)
+			if err != nil {
+				return err
+			}
+			if value > a.target {
+				value = a.target
+			}
+			if value == p.Progress {
+				continue
+			}
+
+			p.Progress = value
+			var completedAt spanner.NullTime
+			if value >= a.target {
+				p.Completed = true
+				p.CompletedAt = &now
+				completedAt = spanner.NullTime{Time: now, Valid: true}
+				completed = append(completed, p)
+				for _, itemID := range a.rewardItemIDs {
+					grants = append(grants, grantParams{userID: userID, itemID: itemID})
+				}
+			}
+			mutations = append(mutations, spanner.InsertOrUpdate("user_achievements",
+				[]string{"user_id", "achievement_id", "progress", "completed_at", "updated_at"},
+				[]interface{}{userID, a.id, p.Progress, completedAt, now},
+			))
+		}
+
+		if len(grants) > 0 {
+			if _, err := grantItemsInTxn(ctx, txn, grants); err != nil {
+				return err
+			}
+		}
+		return txn.BufferWrite(mutations)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(completed) > 0 {
+		d.invalidateUserItems(userID)
+	}
+	return completed, nil
+}
+
+// trackAchievements updates the progress of the users in the events
+func trackAchievements(client GameUserOperation) {
+	update := func(data map[string]interface{}) {
+		for _, field := range []string{"id", "partner_id"} {
+			userID, ok := data[field].(string)
+			if !ok || userID == "" {
+				continue
+			}
+			completed, err := client.updateAchievements(context.Background(), io.Discard, userID)
+			if err != nil {
+				log.Printf("failed to update achievements of %s: %v", userID, err)
+				continue
+			}
+			for _, p := range completed {
+				publishEvent("achievement.completed", map[string]interface{}{
+					"id":             userID,
+					"achievement_id": p.AchievementID,
+					"items":          p.RewardItemIDs,
+				})
+			}
+		}
+	}
+	for _, event := range achievementEvents {
+		handleEvent(event, update)
+	}
+}
+
+func (s Serving) getAchievements(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "getAchievements.root")
+	span.SetAttributes(attribute.String("server", "getAchievements"))
+	defer span.End()
+
+	results, err := s.Client.achievements(ctx, w, userID)
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+	render.JSON(w, r, map[string]interface{}{"achievements": results})
+}
@@ -0,0 +1,46 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+)
+
+// admin APIs are disabled unless ADMIN_TOKEN is set
+var adminToken = os.Getenv("ADMIN_TOKEN")
+
+const adminTokenHeader = "X-Admin-Token"
+
+// adminAuth allows the requests that have ADMIN_TOKEN in X-Admin-Token header
+func adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			errorRender(w, r, http.StatusForbidden, fmt.Errorf("admin API is disabled"))
+			return
+		}
+		token := r.Header.Get(adminTokenHeader)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			log.Printf("Forbidden admin request from %s", r.RemoteAddr)
+			errorRender(w, r, http.StatusForbidden, fmt.Errorf("admin token is invalid"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
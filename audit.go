@@ -0,0 +1,225 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+)
+
+type auditOperation interface {
+	auditLog(context.Context, io.Writer, auditQuery) ([]auditEntry, error)
+}
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+	// who changes when no one is in the context, like the item reaper
+	systemActor = "system"
+	// the operator's name can be passed to admin APIs by this header
+	actorHeader = "X-Actor"
+)
+
+type auditActorKey struct{}
+
+type auditQuery struct {
+	userID string
+	action string
+	since  time.Time
+	until  time.Time
+	limit  int
+}
+
+type auditEntry struct {
+	AuditID      string          `json:"audit_id"`
+	Actor        string          `json:"actor"`
+	Action       string          `json:"action"`
+	TargetUserID string          `json:"target_user_id,omitempty"`
+	Target       string          `json:"target,omitempty"`
+	Before       json.RawMessage `json:"before,omitempty"`
+	After        json.RawMessage `json:"after,omitempty"`
+	RequestID    string          `json:"request_id,omitempty"`
+	TraceID      string          `json:"trace_id,omitempty"`
+	CreatedAt    time.Time       `json:"created_at"`
+}
+
+func withAuditActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, auditActorKey{}, actor)
+}
+
+func auditActor(ctx context.Context) string {
+	if actor, ok := ctx.Value(auditActorKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	return systemActor
+}
+
+// auditActorMiddleware sets who sends the request, it's an admin or the user in the path
+func auditActorMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actor := "api"
+		if strings.HasPrefix(r.URL.Path, "/admin/") {
+			actor = "admin"
+			if name := r.Header.Get(actorHeader); name != "" {
+				actor += ":" + name
+			}
+		} else if m := userPathPattern.FindStringSubmatch(r.URL.Path); m != nil {
+			actor = "user:" + m[1]
+		}
+		next.ServeHTTP(w, r.WithContext(withAuditActor(r.Context(), actor)))
+	})
+}
+
+// grpcAuditActor is the same as auditActorMiddleware for gRPC
+func grpcAuditActor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	return handler(withAuditActor(ctx, "grpc"), req)
+}
+
+func auditJSON(v interface{}) spanner.NullJSON {
+	return spanner.NullJSON{Value: v, Valid: v != nil}
+}
+
+// auditMutation records the change with who made it, the request id and the trace id in ctx.
+// before and after are the values changed, nil if there's nothing.
+func auditMutation(ctx context.Context, action, targetUserID, target string, before, after interface{}) *spanner.Mutation {
+	var traceID spanner.NullString
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		traceID = spanner.NullString{StringVal: sc.TraceID().String(), Valid: true}
+	}
+	return spanner.Insert("audit_log",
+		[]string{"audit_id", "actor", "action", "target_user_id", "target", "before", "after", "request_id", "trace_id", "created_at"},
+		[]interface{}{uuid.NewString(), auditActor(ctx), action, nullString(targetUserID), nullString(target),
+			auditJSON(before), auditJSON(after), nullString(middleware.GetReqID(ctx)), traceID, time.Now()},
+	)
+}
+
+// auditInTxn writes the audit log in the transaction of the change, the log is only inserted
+func auditInTxn(ctx context.Context, txn *spanner.ReadWriteTransaction, action, targetUserID, target string, before, after interface{}) error {
+	return txn.BufferWrite([]*spanner.Mutation{auditMutation(ctx, action, targetUserID, target, before, after)})
+}
+
+// get the audit log newest first, filtered by the target user and the time range
+func (d dbClient) auditLog(ctx context.Context, w io.Writer, q auditQuery) ([]auditEntry, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "auditLog")
+	defer span.End()
+
+	table := "audit_log"
+	conditions := []string{"created_at >= @since", "created_at < @until"}
+	if q.userID != "" {
+		table += "@{FORCE_INDEX=audit_log_by_target_user_id}"
+		conditions = append(conditions, "target_user_id = @userID")
+	}
+	if q.action != "" {
+		conditions = append(conditions, "action = @action")
+	}
+	stmt := spanner.Statement{
+		SQL: fmt.Sprintf(`SELECT audit_id, actor, action, target_user_id, target, before, after, request_id, trace_id, created_at
+		  FROM %s WHERE %s ORDER BY created_at DESC LIMIT @limit`, table, strings.Join(conditions, " AND ")),
+		Params: map[string]interface{}{
+			"userID": q.userID,
+			"action": q.action,
+			"since":  q.since,
+			"until":  q.until,
+			"limit":  int64(q.limit),
+		},
+	}
+
+	results := []auditEntry{}
+	err := d.sc.Single().Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		var e auditEntry
+		var targetUserID, target, requestID, traceID spanner.NullString
+		var before, after spanner.NullJSON
+		if err := row.Columns(&e.AuditID, &e.Actor, &e.Action, &targetUserID, &target, &before, &after, &requestID, &traceID, &e.CreatedAt); err != nil {
+			return err
+		}
+		e.TargetUserID = targetUserID.StringVal
+		e.Target = target.StringVal
+		e.RequestID = requestID.StringVal
+		e.TraceID = traceID.StringVal
+		if before.Valid {
+			e.Before, _ = json.Marshal(before.Value)
+		}
+		if after.Valid {
+			e.After, _ = json.Marshal(after.Value)
+		}
+		results = append(results, e)
+		return nil
+	})
+	return results, err
+}
+
+func (s Serving) getAuditLog(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "getAuditLog.root")
+	span.SetAttributes(attribute.String("server", "getAuditLog"))
+	defer span.End()
+
+	query := r.URL.Query()
+	q := auditQuery{
+		userID: query.Get("user_id"),
+		action: query.Get("action"),
+		// the last 24 hours by default
+		since: time.Now().Add(-24 * time.Hour),
+		until: time.Now().Add(time.Minute),
+		limit: defaultAuditLimit,
+	}
+	invalid := validationError{}
+	for name, t := range map[string]*time.Time{"since": &q.since, "until": &q.until} {
+		if v := query.Get(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				invalid[name] = "must be RFC 3339 like 2023-01-02T15:04:05Z"
+				continue
+			}
+			*t = parsed
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAuditLimit {
+			invalid["limit"] = fmt.Sprintf("must be between 1 and %d", maxAuditLimit)
+		}
+		q.limit = n
+	}
+	if len(invalid) > 0 {
+		errorRender(w, r, http.StatusBadRequest, invalid)
+		return
+	}
+
+	results, err := s.Client.auditLog(ctx, w, q)
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+	render.JSON(w, r, map[string]interface{}{"entries": results})
+}
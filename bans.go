@@ -0,0 +1,401 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+	"unicode/utf8"
+
+	"cloud.google.com/go/spanner"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/go-redis/redis"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/api/iterator"
+)
+
+type banOperation interface {
+	banUser(context.Context, io.Writer, banParams) (ban, error)
+	liftBans(context.Context, io.Writer, string, string) (int, error)
+	bans(context.Context, io.Writer, string) ([]ban, error)
+	activeBan(context.Context, io.Writer, string) (*ban, error)
+}
+
+var errUserBanned = errors.New("the user is banned")
+
+var (
+	// the ban status is cached up to this, it's deleted when a ban is applied or lifted
+	banCacheTTL = 5 * time.Minute
+	// cached when the user is not banned
+	noBan = "none"
+	// the user of the requests to check, like /api/user_id/{user_id}/...
+	userPathPattern = regexp.MustCompile(`^/api/user_id/([a-z0-9-.]+)`)
+)
+
+var banColumns = []string{"ban_id", "reason", "issued_by", "expires_at", "lifted_at", "lifted_by", "created_at"}
+
+type banParams struct {
+	userID    string
+	reason    string
+	issuedBy  string
+	expiresAt time.Time
+}
+
+type ban struct {
+	BanID    string `json:"ban_id"`
+	UserID   string `json:"user_id"`
+	Reason   string `json:"reason"`
+	IssuedBy string `json:"issued_by"`
+	// a suspension has expires_at, a ban doesn't
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	LiftedAt  *time.Time `json:"lifted_at,omitempty"`
+	LiftedBy  string     `json:"lifted_by,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func (b ban) active(now time.Time) bool {
+	return b.LiftedAt == nil && (b.ExpiresAt == nil || b.ExpiresAt.After(now))
+}
+
+func banKey(userID string) string {
+	return fmt.Sprintf("ban_%s", userID)
+}
+
+func banFromRow(userID string, row *spanner.Row) (ban, error) {
+	b := ban{UserID: userID}
+	var expiresAt, liftedAt spanner.NullTime
+	var liftedBy spanner.NullString
+	if err := row.Columns(&b.BanID, &b.Reason, &b.IssuedBy, &expiresAt, &liftedAt, &liftedBy, &b.CreatedAt); err != nil {
+		return ban{}, err
+	}
+	if expiresAt.Valid {
+		b.ExpiresAt = &expiresAt.Time
+	}
+	if liftedAt.Valid {
+		b.LiftedAt = &liftedAt.Time
+	}
+	b.LiftedBy = liftedBy.StringVal
+	return b, nil
+}
+
+// bannedUsersSQL selects the users with a ban in effect, for markExisting
+const bannedUsersSQL = `SELECT DISTINCT user_id FROM user_bans WHERE user_id IN UNNEST(@ids)
+  AND lifted_at IS NULL AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP())`
+
+// notBannedInTxn returns errUserBanned if one of the users is banned.
+// The endpoints which take the users from the body, not from the path, check this in the transaction.
+func notBannedInTxn(ctx context.Context, txn *spanner.ReadWriteTransaction, userIDs ...string) error {
+	banned := map[string]bool{}
+	for _, id := range userIDs {
+		banned[id] = false
+	}
+	if err := markExisting(ctx, txn, bannedUsersSQL, banned); err != nil {
+		return err
+	}
+	for _, id := range userIDs {
+		if banned[id] {
+			return fmt.Errorf("%w: %s", errUserBanned, id)
+		}
+	}
+	return nil
+}
+
+func readBans(ctx context.Context, txn spannerReader, userID string) ([]ban, error) {
+	results := []ban{}
+	err := txn.Read(ctx, "user_bans", spanner.Key{userID}.AsPrefix(), banColumns).Do(func(row *spanner.Row) error {
+		b, err := banFromRow(userID, row)
+		if err != nil {
+			return err
+		}
+		results = append(results, b)
+		return nil
+	})
+	return results, err
+}
+
+func (d dbClient) invalidateBan(userID string) {
+	if err := d.cache.Del(banKey(userID)).Err(); err != nil {
+		log.Println(err)
+	}
+}
+
+// ban the user, until expiresAt if it's set
+func (d dbClient) banUser(ctx context.Context, w io.Writer, p banParams) (ban, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "banUser")
+	defer span.End()
+
+	b := ban{BanID: uuid.NewString(), UserID: p.userID, Reason: p.reason, IssuedBy: p.issuedBy, CreatedAt: time.Now()}
+	var expiresAt spanner.NullTime
+	if !p.expiresAt.IsZero() {
+		b.ExpiresAt = &p.expiresAt
+		expiresAt = spanner.NullTime{Time: p.expiresAt, Valid: true}
+	}
+
+	_, err := d.sc.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		if err := userExistsInTxn(ctx, txn, p.userID); err != nil {
+			return err
+		}
+		return txn.BufferWrite([]*spanner.Mutation{
+			spanner.Insert("user_bans",
+				[]string{"user_id", "ban_id", "reason", "issued_by", "expires_at", "created_at"},
+				[]interface{}{p.userID, b.BanID, p.reason, p.issuedBy, expiresAt, b.CreatedAt},
+			),
+			auditMutation(ctx, "user.banned", p.userID, b.BanID, nil, b),
+		})
+	})
+	if err != nil {
+		return ban{}, err
+	}
+
+	d.invalidateBan(p.userID)
+	return b, nil
+}
+
+// lift all active bans of the user, and return how many were lifted
+func (d dbClient) liftBans(ctx context.Context, w io.Writer, userID, liftedBy string) (int, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "liftBans")
+	defer span.End()
+
+	var lifted int
+	_, err := d.sc.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		if err := userExistsInTxn(ctx, txn, userID); err != nil {
+			return err
+		}
+		bans, err := readBans(ctx, txn, userID)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		mutations := []*spanner.Mutation{}
+		for _, b := range bans {
+			if !b.active(now) {
+				continue
+			}
+			mutations = append(mutations, spanner.Update("user_bans",
+				[]string{"user_id", "ban_id", "lifted_at", "lifted_by"},
+				[]interface{}{userID, b.BanID, now, liftedBy},
+			))
+		}
+		lifted = len(mutations)
+		if lifted == 0 {
+			return nil
+		}
+		mutations = append(mutations, auditMutation(ctx, "user.bans_lifted", userID, "", nil, map[string]interface{}{"lifted_by": liftedBy, "lifted": lifted}))
+		return txn.BufferWrite(mutations)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	d.invalidateBan(userID)
+	return lifted, nil
+}
+
+// get all bans of the user including lifted and expired ones
+func (d dbClient) bans(ctx context.Context, w io.Writer, userID string) ([]ban, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "bans")
+	defer span.End()
+
+	return readBans(ctx, d.sc.Single(), userID)
+}
+
+// get the ban in effect, the one lasts longest if there are some, or nil.
+// The result is cached, so that it can be checked for every request.
+func (d dbClient) activeBan(ctx context.Context, w io.Writer, userID string) (*ban, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "activeBan")
+	defer span.End()
+
+	now := time.Now()
+	key := banKey(userID)
+	data, err := d.cache.Get(key).Result()
+	if err == nil {
+		if data == noBan {
+			return nil, nil
+		}
+		var b ban
+		if err := json.Unmarshal([]byte(data), &b); err == nil && b.active(now) {
+			return &b, nil
+		}
+	} else if err != redis.Nil {
+		log.Println(key, "Error", err)
+	}
+
+	stmt := spanner.Statement{
+		SQL: `SELECT ban_id, reason, issued_by, expires_at, lifted_at, lifted_by, created_at FROM user_bans
+		  WHERE user_id = @userID AND lifted_at IS NULL AND (expires_at IS NULL OR expires_at > @now)
+		  ORDER BY expires_at IS NULL DESC, expires_at DESC LIMIT 1`,
+		Params: map[string]interface{}{"userID": userID, "now": now},
+	}
+	iter := d.sc.Single().Query(ctx, stmt)
+	defer iter.Stop()
+
+	var result *ban
+	row, err := iter.Next()
+	if err != nil && err != iterator.Done {
+		return nil, err
+	}
+	if err == nil {
+		b, err := banFromRow(userID, row)
+		if err != nil {
+			return nil, err
+		}
+		result = &b
+	}
+
+	value, ttl := noBan, banCacheTTL
+	if result != nil {
+		jsoned, _ := json.Marshal(result)
+		value = string(jsoned)
+		// expires with the suspension
+		if result.ExpiresAt != nil && result.ExpiresAt.Sub(now) < ttl {
+			ttl = result.ExpiresAt.Sub(now)
+		}
+	}
+	if err := d.cache.Set(key, value, ttl).Err(); err != nil {
+		log.Println(err)
+	}
+	return result, nil
+}
+
+// banCheck rejects the requests for banned users with 403
+func (s Serving) banCheck(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := userPathPattern.FindStringSubmatch(r.URL.Path)
+		if m == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		b, err := s.Client.activeBan(r.Context(), w, m[1])
+		if err != nil {
+			errorRender(w, r, errorStatus(err), err)
+			return
+		}
+		if b != nil {
+			until := "permanently"
+			if b.ExpiresAt != nil {
+				until = "until " + b.ExpiresAt.Format(time.RFC3339)
+			}
+			errorRender(w, r, http.StatusForbidden, fmt.Errorf("%w %s: %s", errUserBanned, until, b.Reason))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s Serving) banUser(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "banUser.root")
+	span.SetAttributes(attribute.String("server", "banUser"))
+	defer span.End()
+
+	var body struct {
+		Reason    string    `json:"reason"`
+		IssuedBy  string    `json:"issued_by"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := render.DecodeJSON(r.Body, &body); err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	invalid := validationError{}
+	if n := utf8.RuneCountInString(body.Reason); n == 0 || n > 256 {
+		invalid["reason"] = "must be 1 to 256 characters"
+	}
+	if n := utf8.RuneCountInString(body.IssuedBy); n == 0 || n > 64 {
+		invalid["issued_by"] = "must be 1 to 64 characters"
+	}
+	if !body.ExpiresAt.IsZero() && !body.ExpiresAt.After(time.Now()) {
+		invalid["expires_at"] = "must be in the future"
+	}
+	if len(invalid) > 0 {
+		errorRender(w, r, http.StatusBadRequest, invalid)
+		return
+	}
+
+	b, err := s.Client.banUser(ctx, w, banParams{userID: userID, reason: body.Reason, issuedBy: body.IssuedBy, expiresAt: body.ExpiresAt})
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+
+	publishEvent("user.banned", map[string]interface{}{"id": userID, "ban_id": b.BanID, "issued_by": b.IssuedBy})
+
+	render.JSON(w, r, b)
+}
+
+func (s Serving) liftBans(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "liftBans.root")
+	span.SetAttributes(attribute.String("server", "liftBans"))
+	defer span.End()
+
+	var body struct {
+		LiftedBy string `json:"lifted_by"`
+	}
+	if err := render.DecodeJSON(r.Body, &body); err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if n := utf8.RuneCountInString(body.LiftedBy); n == 0 || n > 64 {
+		errorRender(w, r, http.StatusBadRequest, validationError{"lifted_by": "must be 1 to 64 characters"})
+		return
+	}
+
+	lifted, err := s.Client.liftBans(ctx, w, userID, body.LiftedBy)
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+
+	publishEvent("user.unbanned", map[string]interface{}{"id": userID, "lifted_by": body.LiftedBy, "lifted": lifted})
+
+	render.JSON(w, r, map[string]interface{}{"user_id": userID, "lifted": lifted})
+}
+
+func (s Serving) getBans(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "getBans.root")
+	span.SetAttributes(attribute.String("server", "getBans"))
+	defer span.End()
+
+	results, err := s.Client.bans(ctx, w, userID)
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+	render.JSON(w, r, map[string]interface{}{"bans": results})
+}
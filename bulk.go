@@ -0,0 +1,719 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"go.opentelemetry.io/otel"
+	"google.golang.org/grpc/codes"
+)
+
+var (
+	defaultBulkBatchSize = 500
+	maxBulkBatchSize     = 2000
+	defaultBulkParallel  = 4
+	maxBulkParallel      = 64
+)
+
+var bulkIDPattern = regexp.MustCompile(`^[a-z0-9-.]{1,36}$`)
+
+// bulkTable describes how the rows of a table are imported and exported
+type bulkTable struct {
+	columns []string
+	// exportSQL selects columns in the order, soft deleted rows are not exported
+	exportSQL string
+	// values converts a record to the values of columns, an error rejects the record
+	values func(rec map[string]string, now time.Time) ([]interface{}, error)
+}
+
+var bulkTables = map[string]bulkTable{
+	"users": {
+		columns:   []string{"user_id", "name", "locale", "country", "platform", "timezone", "created_at", "updated_at"},
+		exportSQL: "SELECT user_id, name, locale, country, platform, timezone, created_at, updated_at FROM users WHERE deleted_at IS NULL",
+		values:    userValues,
+	},
+	"user_items": {
+		columns: []string{"user_id", "item_id", "expires_at", "created_at", "updated_at"},
+		exportSQL: `SELECT i.user_id, i.item_id, i.expires_at, i.created_at, i.updated_at FROM user_items i
+		  JOIN users u ON u.user_id = i.user_id WHERE i.deleted_at IS NULL AND u.deleted_at IS NULL`,
+		values: userItemValues,
+	},
+}
+
+// bulkTime parses RFC 3339 time for the commit timestamp columns, empty string is def.
+// Spanner rejects the time in the future for them.
+func bulkTime(s string, def interface{}, now time.Time) (interface{}, error) {
+	if s == "" {
+		return def, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return nil, errors.New("must be RFC 3339 time")
+	}
+	if t.After(now) {
+		return nil, errors.New("must not be in the future")
+	}
+	return t, nil
+}
+
+func userValues(rec map[string]string, now time.Time) ([]interface{}, error) {
+	invalid := validationError{}
+	u := createUserRequest{Name: rec["name"], Locale: rec["locale"], Country: rec["country"], Platform: rec["platform"], Timezone: rec["timezone"]}
+	if err := u.validate(); err != nil {
+		if !errors.As(err, &invalid) {
+			return nil, err
+		}
+	}
+	if !bulkIDPattern.MatchString(rec["user_id"]) {
+		invalid["user_id"] = "must be 1 to 36 characters of a-z, 0-9, - and ."
+	}
+	createdAt, err := bulkTime(rec["created_at"], spanner.CommitTimestamp, now)
+	if err != nil {
+		invalid["created_at"] = err.Error()
+	}
+	updatedAt, err := bulkTime(rec["updated_at"], createdAt, now)
+	if err != nil {
+		invalid["updated_at"] = err.Error()
+	}
+	if len(invalid) > 0 {
+		return nil, invalid
+	}
+	return []interface{}{rec["user_id"], u.Name, nullString(u.Locale), nullString(u.Country), nullString(u.Platform), nullString(u.Timezone), createdAt, updatedAt}, nil
+}
+
+func userItemValues(rec map[string]string, now time.Time) ([]interface{}, error) {
+	invalid := validationError{}
+	for _, field := range []string{"user_id", "item_id"} {
+		if !bulkIDPattern.MatchString(rec[field]) {
+			invalid[field] = "must be 1 to 36 characters of a-z, 0-9, - and ."
+		}
+	}
+	var expiresAt spanner.NullTime
+	if rec["expires_at"] != "" {
+		t, err := time.Parse(time.RFC3339Nano, rec["expires_at"])
+		if err != nil {
+			invalid["expires_at"] = "must be RFC 3339 time"
+		}
+		expiresAt = spanner.NullTime{Time: t, Valid: true}
+	}
+	createdAt, err := bulkTime(rec["created_at"], spanner.CommitTimestamp, now)
+	if err != nil {
+		invalid["created_at"] = err.Error()
+	}
+	updatedAt, err := bulkTime(rec["updated_at"], createdAt, now)
+	if err != nil {
+		invalid["updated_at"] = err.Error()
+	}
+	if len(invalid) > 0 {
+		return nil, invalid
+	}
+	return []interface{}{rec["user_id"], rec["item_id"], expiresAt, createdAt, updatedAt}, nil
+}
+
+// brokenRecord is a row that can't be parsed, it's rejected and the rest are read
+type brokenRecord struct {
+	err error
+}
+
+func (b brokenRecord) Error() string {
+	return "broken record: " + b.err.Error()
+}
+
+type recordReader interface {
+	// read returns the next record and its line, io.EOF at the end
+	read() (map[string]string, int, error)
+}
+
+type jsonlReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func (r *jsonlReader) read() (map[string]string, int, error) {
+	for r.scanner.Scan() {
+		r.line++
+		b := r.scanner.Bytes()
+		if len(strings.TrimSpace(string(b))) == 0 {
+			continue
+		}
+		var v map[string]interface{}
+		if err := json.Unmarshal(b, &v); err != nil {
+			return nil, r.line, brokenRecord{err}
+		}
+		rec := map[string]string{}
+		for k, value := range v {
+			rec[k] = bulkString(value)
+		}
+		return rec, r.line, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return nil, r.line, err
+	}
+	return nil, r.line, io.EOF
+}
+
+type csvReader struct {
+	reader *csv.Reader
+	header []string
+}
+
+func (r *csvReader) read() (map[string]string, int, error) {
+	if r.header == nil {
+		header, err := r.reader.Read()
+		if err != nil {
+			return nil, 1, err
+		}
+		r.header = header
+	}
+	fields, err := r.reader.Read()
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return nil, parseErr.Line, brokenRecord{err}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	line, _ := r.reader.FieldPos(0)
+	rec := map[string]string{}
+	for i, name := range r.header {
+		rec[name] = fields[i]
+	}
+	return rec, line, nil
+}
+
+func newRecordReader(r io.Reader, format string) (recordReader, error) {
+	switch format {
+	case "jsonl":
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		return &jsonlReader{scanner: scanner}, nil
+	case "csv":
+		return &csvReader{reader: csv.NewReader(r)}, nil
+	}
+	return nil, fmt.Errorf("unknown format: %s", format)
+}
+
+// bulkString is the value in a record, null is an empty string
+func bulkString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+type bulkParams struct {
+	table     string
+	format    string
+	file      string
+	batchSize int
+	parallel  int
+	// the progress is saved in this file, and the import resumes from it if it exists
+	checkpoint string
+	// rejected records are appended to this file as JSONL
+	rejects string
+}
+
+// parseBulkFlags reads the flags of bulk-import and bulk-export, the format is guessed from the file name
+func parseBulkFlags(name string, args []string) (bulkParams, error) {
+	var p bulkParams
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&p.table, "table", "", "users or user_items")
+	fs.StringVar(&p.format, "format", "", "jsonl or csv, guessed from the file name if it's omitted")
+	fs.StringVar(&p.file, "file", "", "the file to read or write, - is stdout for bulk-export")
+	fs.IntVar(&p.batchSize, "batch", defaultBulkBatchSize, "rows in a batch of mutations")
+	fs.IntVar(&p.parallel, "parallel", defaultBulkParallel, "batches written at once")
+	fs.StringVar(&p.checkpoint, "checkpoint", "", "the checkpoint file, <file>.checkpoint by default")
+	fs.StringVar(&p.rejects, "rejects", "", "the report of rejected records, <file>.rejects.jsonl by default")
+	if err := fs.Parse(args); err != nil {
+		return p, err
+	}
+
+	if _, ok := bulkTables[p.table]; !ok {
+		return p, fmt.Errorf("-table must be users or user_items")
+	}
+	if p.file == "" {
+		return p, fmt.Errorf("-file is required")
+	}
+	if p.format == "" {
+		p.format = "jsonl"
+		if strings.EqualFold(filepath.Ext(p.file), ".csv") {
+			p.format = "csv"
+		}
+	}
+	if p.format != "jsonl" && p.format != "csv" {
+		return p, fmt.Errorf("-format must be jsonl or csv")
+	}
+	if p.batchSize < 1 || p.batchSize > maxBulkBatchSize {
+		return p, fmt.Errorf("-batch must be between 1 and %d", maxBulkBatchSize)
+	}
+	if p.parallel < 1 || p.parallel > maxBulkParallel {
+		return p, fmt.Errorf("-parallel must be between 1 and %d", maxBulkParallel)
+	}
+	if p.checkpoint == "" {
+		p.checkpoint = p.file + ".checkpoint"
+	}
+	if p.rejects == "" {
+		p.rejects = p.file + ".rejects.jsonl"
+	}
+	return p, nil
+}
+
+type bulkCheckpoint struct {
+	Table string `json:"table"`
+	File  string `json:"file"`
+	// records before this are done
+	Records int `json:"records"`
+	// records before this may have been written, some batches after Records were done
+	Written int `json:"written"`
+	// records after Records written by the batches that failed midway, by the number of the record
+	WrittenRows []int `json:"written_rows,omitempty"`
+}
+
+// readCheckpoint returns false if there's no checkpoint, the import starts from the beginning then
+func readCheckpoint(p bulkParams) (bulkCheckpoint, bool, error) {
+	b, err := os.ReadFile(p.checkpoint)
+	if errors.Is(err, os.ErrNotExist) {
+		return bulkCheckpoint{}, false, nil
+	}
+	if err != nil {
+		return bulkCheckpoint{}, false, err
+	}
+	var c bulkCheckpoint
+	if err := json.Unmarshal(b, &c); err != nil {
+		return bulkCheckpoint{}, false, fmt.Errorf("broken checkpoint %s: %w", p.checkpoint, err)
+	}
+	if c.Table != p.table || c.File != p.file {
+		return bulkCheckpoint{}, false, fmt.Errorf("checkpoint %s is for %s of %s", p.checkpoint, c.Table, c.File)
+	}
+	return c, true, nil
+}
+
+// readRejectedLines returns the lines in the rejects report, so that they are not reported again
+func readRejectedLines(p bulkParams) (map[int]bool, error) {
+	lines := map[int]bool{}
+	f, err := os.Open(p.rejects)
+	if errors.Is(err, os.ErrNotExist) {
+		return lines, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var r struct {
+			Line int `json:"line"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &r); err == nil {
+			lines[r.Line] = true
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// writeCheckpoint replaces the file at once, so that it's never half written
+func writeCheckpoint(p bulkParams, c bulkCheckpoint) error {
+	c.Table, c.File = p.table, p.file
+	b, _ := json.Marshal(c)
+	tmp := p.checkpoint + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.checkpoint)
+}
+
+type bulkRow struct {
+	// the number of the record in the file, from 1
+	index    int
+	line     int
+	record   map[string]string
+	mutation *spanner.Mutation
+}
+
+type bulkBatch struct {
+	seq  int
+	rows []bulkRow
+	// records read until the end of this batch, including rejected ones
+	records int
+}
+
+type bulkResult struct {
+	Skipped  int `json:"skipped"`
+	Read     int `json:"read"`
+	Imported int `json:"imported"`
+	Rejected int `json:"rejected"`
+}
+
+// rejectable errors are caused by the row, the others stop the import so that it can be resumed later
+func rejectable(err error) bool {
+	switch spanner.ErrCode(err) {
+	case codes.AlreadyExists, codes.NotFound, codes.FailedPrecondition, codes.InvalidArgument, codes.OutOfRange:
+		return true
+	}
+	return false
+}
+
+// importRecords streams the records of the file into the table with Insert in batches,
+// existing rows including soft deleted ones are rejected and never changed.
+// The batches are written in parallel, and the checkpoint moves forward when all batches before it are written.
+// A failed import is resumed from the checkpoint, and the rows found existing there are the ones written
+// before the failure if they are not in the rejects report already.
+// The rejects report is started again when there's no checkpoint.
+func (d dbClient) importRecords(ctx context.Context, w io.Writer, p bulkParams) (bulkResult, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "importRecords")
+	defer span.End()
+
+	var result bulkResult
+	table := bulkTables[p.table]
+	in, err := os.Open(p.file)
+	if err != nil {
+		return result, err
+	}
+	defer in.Close()
+	reader, err := newRecordReader(in, p.format)
+	if err != nil {
+		return result, err
+	}
+	checkpoint, resuming, err := readCheckpoint(p)
+	if err != nil {
+		return result, err
+	}
+	result.Skipped = checkpoint.Records
+	reported := map[int]bool{}
+	flags := os.O_CREATE | os.O_TRUNC | os.O_WRONLY
+	if resuming {
+		if reported, err = readRejectedLines(p); err != nil {
+			return result, err
+		}
+		flags = os.O_CREATE | os.O_APPEND | os.O_WRONLY
+	}
+	rejectsFile, err := os.OpenFile(p.rejects, flags, 0644)
+	if err != nil {
+		return result, err
+	}
+	defer rejectsFile.Close()
+	rejects := json.NewEncoder(rejectsFile)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	var failed error
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failed == nil {
+			failed = err
+		}
+		cancel()
+	}
+	// the rows written by the batches that failed midway, they are not rejected when it's resumed
+	writtenRows := map[int]bool{}
+	for _, i := range checkpoint.WrittenRows {
+		writtenRows[i] = true
+	}
+	reject := func(r bulkRow, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		// written by the import before it was resumed
+		if spanner.ErrCode(err) == codes.AlreadyExists && (r.index <= checkpoint.Written || writtenRows[r.index]) && !reported[r.line] {
+			result.Skipped++
+			return
+		}
+		result.Rejected++
+		if reported[r.line] {
+			return
+		}
+		reported[r.line] = true
+		if err := rejects.Encode(map[string]interface{}{"line": r.line, "error": err.Error(), "record": r.record}); err != nil && failed == nil {
+			failed = err
+			cancel()
+		}
+	}
+	// the batches written but not checkpointed yet, by seq
+	written := map[int]int{}
+	nextSeq := 0
+	records, writtenUntil := checkpoint.Records, checkpoint.Written
+	// save is called with mu locked
+	save := func() {
+		c := bulkCheckpoint{Records: records, Written: writtenUntil}
+		for i := range writtenRows {
+			if i > records {
+				c.WrittenRows = append(c.WrittenRows, i)
+			}
+		}
+		sort.Ints(c.WrittenRows)
+		if err := writeCheckpoint(p, c); err != nil && failed == nil {
+			failed = err
+			cancel()
+		}
+	}
+	partial := func(rows []bulkRow) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(rows) == 0 {
+			return
+		}
+		result.Imported += len(rows)
+		for _, r := range rows {
+			writtenRows[r.index] = true
+		}
+		save()
+	}
+	done := func(b bulkBatch, imported int) {
+		mu.Lock()
+		defer mu.Unlock()
+		result.Imported += imported
+		written[b.seq] = b.records
+		for {
+			r, ok := written[nextSeq]
+			if !ok {
+				break
+			}
+			delete(written, nextSeq)
+			nextSeq++
+			records = r
+		}
+		if b.records > writtenUntil {
+			writtenUntil = b.records
+		}
+		save()
+	}
+
+	batches := make(chan bulkBatch)
+	var wg sync.WaitGroup
+	for i := 0; i < p.parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range batches {
+				imported, err := d.applyBulkBatch(ctx, p.table, b, reject)
+				if err != nil {
+					partial(imported)
+					fail(err)
+					continue
+				}
+				done(b, len(imported))
+			}
+		}()
+	}
+
+	now := time.Now()
+	skip := result.Skipped
+	read := 0
+	batch := bulkBatch{}
+	send := func() bool {
+		batch.records = read
+		select {
+		case batches <- batch:
+		case <-ctx.Done():
+			return false
+		}
+		batch = bulkBatch{seq: batch.seq + 1}
+		return true
+	}
+	for ctx.Err() == nil {
+		rec, line, err := reader.read()
+		if err == io.EOF {
+			send()
+			break
+		}
+		var broken brokenRecord
+		if err != nil && !errors.As(err, &broken) {
+			fail(err)
+			break
+		}
+		read++
+		if read <= skip {
+			continue
+		}
+		mu.Lock()
+		result.Read++
+		mu.Unlock()
+
+		row := bulkRow{index: read, line: line, record: rec}
+		if err != nil {
+			reject(row, err)
+		} else if values, err := table.values(rec, now); err != nil {
+			reject(row, err)
+		} else {
+			row.mutation = spanner.Insert(p.table, table.columns, values)
+			batch.rows = append(batch.rows, row)
+		}
+		if len(batch.rows) == p.batchSize && !send() {
+			break
+		}
+	}
+	close(batches)
+	wg.Wait()
+
+	if failed != nil {
+		return result, failed
+	}
+	if err := os.Remove(p.checkpoint); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return result, err
+	}
+	fmt.Fprintf(w, "imported %d of %d records into %s, %d rejected\n", result.Imported, result.Read, p.table, result.Rejected)
+	return result, nil
+}
+
+// applyBulkBatch writes the rows at once, and one by one to find the rejected rows if it fails because of some of them.
+// It returns the rows written, some of them may be written even if it fails.
+func (d dbClient) applyBulkBatch(ctx context.Context, table string, b bulkBatch, reject func(bulkRow, error)) ([]bulkRow, error) {
+	if len(b.rows) == 0 {
+		return nil, nil
+	}
+	audit := func(rows int) *spanner.Mutation {
+		return auditMutation(ctx, "bulk.imported", "", table, nil, map[string]interface{}{"rows": rows, "first_line": b.rows[0].line})
+	}
+
+	mutations := make([]*spanner.Mutation, 0, len(b.rows)+1)
+	for _, r := range b.rows {
+		mutations = append(mutations, r.mutation)
+	}
+	_, err := d.sc.Apply(ctx, append(mutations, audit(len(b.rows))))
+	if err == nil {
+		d.invalidateBulkRows(b.rows)
+		return b.rows, nil
+	}
+	if !rejectable(err) {
+		return nil, err
+	}
+
+	imported := []bulkRow{}
+	for _, r := range b.rows {
+		if _, err := d.sc.Apply(ctx, []*spanner.Mutation{r.mutation}); err != nil {
+			if !rejectable(err) {
+				d.invalidateBulkRows(imported)
+				return imported, err
+			}
+			reject(r, err)
+			continue
+		}
+		imported = append(imported, r)
+	}
+	d.invalidateBulkRows(imported)
+	if len(imported) > 0 {
+		if _, err := d.sc.Apply(ctx, []*spanner.Mutation{audit(len(imported))}); err != nil {
+			return imported, err
+		}
+	}
+	return imported, nil
+}
+
+// invalidateBulkRows clears the cache of the users in the rows, a user may be cached as not found before
+func (d dbClient) invalidateBulkRows(rows []bulkRow) {
+	users := map[string]bool{}
+	for _, r := range rows {
+		if !users[r.record["user_id"]] {
+			users[r.record["user_id"]] = true
+			d.invalidateUser(r.record["user_id"])
+		}
+	}
+}
+
+// exportRecords writes the rows of the table to w in the format, in the same columns as the import
+func (d dbClient) exportRecords(ctx context.Context, w io.Writer, tableName, format string) (int, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "exportRecords")
+	defer span.End()
+
+	table, ok := bulkTables[tableName]
+	if !ok {
+		return 0, fmt.Errorf("unknown table: %s", tableName)
+	}
+
+	var write func(map[string]string) error
+	flush := func() error { return nil }
+	switch format {
+	case "jsonl":
+		e := json.NewEncoder(w)
+		write = func(rec map[string]string) error {
+			// null is omitted
+			for k, v := range rec {
+				if v == "" {
+					delete(rec, k)
+				}
+			}
+			return e.Encode(rec)
+		}
+	case "csv":
+		cw := csv.NewWriter(w)
+		if err := cw.Write(table.columns); err != nil {
+			return 0, err
+		}
+		write = func(rec map[string]string) error {
+			fields := make([]string, len(table.columns))
+			for i, c := range table.columns {
+				fields[i] = rec[c]
+			}
+			return cw.Write(fields)
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	default:
+		return 0, fmt.Errorf("unknown format: %s", format)
+	}
+
+	n := 0
+	err := d.sc.Single().Query(ctx, spanner.Statement{SQL: table.exportSQL}).Do(func(row *spanner.Row) error {
+		m, err := rowToMap(row)
+		if err != nil {
+			return err
+		}
+		rec := map[string]string{}
+		for _, c := range table.columns {
+			rec[c] = bulkString(m[c])
+		}
+		n++
+		return write(rec)
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, flush()
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// runCommand runs a maintenance command instead of the server, like `game-api reconcile`
+func runCommand(ctx context.Context, args []string) error {
+	// redis doesn't connect until it's used
+	rdb := newRedisClient()
+	defer rdb.Close()
+
+	client, err := newClient(ctx, spannerString, rdb)
+	if err != nil {
+		return err
+	}
+	defer client.sc.Close()
+
+	switch args[0] {
+	case "reconcile":
+		mismatches, err := client.reconcileBalances(ctx, os.Stdout)
+		if err != nil {
+			return err
+		}
+		if len(mismatches) > 0 {
+			return fmt.Errorf("%d balances don't match the ledger", len(mismatches))
+		}
+		return nil
+	case "purge":
+		_, err := client.purgeDeleted(ctx, os.Stdout, time.Now())
+		return err
+	case "export":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: export <user id>")
+		}
+		archive, err := client.exportUser(ctx, os.Stdout, args[1])
+		if err != nil {
+			return err
+		}
+		return printJSON(archive)
+	case "erase":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: erase <user id> <requested by>")
+		}
+		receipt, err := client.eraseUser(ctx, os.Stdout, args[1], args[2])
+		if err != nil {
+			return err
+		}
+		return printJSON(receipt)
+	case "bulk-import":
+		p, err := parseBulkFlags(args[0], args[1:])
+		if err != nil {
+			return err
+		}
+		if userNamePolicy, err = loadNamePolicy(); err != nil {
+			return err
+		}
+		result, importErr := client.importRecords(ctx, os.Stderr, p)
+		if err := printJSON(result); err != nil {
+			return err
+		}
+		return importErr
+	case "bulk-export":
+		p, err := parseBulkFlags(args[0], args[1:])
+		if err != nil {
+			return err
+		}
+		out := os.Stdout
+		if p.file != "-" {
+			if out, err = os.Create(p.file); err != nil {
+				return err
+			}
+			defer out.Close()
+		}
+		n, err := client.exportRecords(ctx, out, p.table, p.format)
+		fmt.Fprintf(os.Stderr, "exported %d rows of %s\n", n, p.table)
+		return err
+	}
+	return fmt.Errorf("unknown command: %s", args[0])
+}
+
+func printJSON(v interface{}) error {
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "  ")
+	return e.Encode(v)
+}
@@ -17,6 +17,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -28,30 +29,79 @@ import (
 	"github.com/go-redis/redis"
 	"go.opentelemetry.io/otel"
 	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
 )
 
 type GameUserOperation interface {
 	createUser(context.Context, io.Writer, userParams) error
 	addItemToUser(context.Context, io.Writer, userParams, itemParams) error
-	userItems(context.Context, io.Writer, string) ([]map[string]interface{}, error)
+	userItems(context.Context, io.Writer, string, pageParams) (itemPage, error)
+	userProfile(context.Context, io.Writer, string) (userProfile, error)
+	renameUser(context.Context, io.Writer, userParams) error
+	deleteUser(context.Context, io.Writer, string) error
+	userNameTaken(context.Context, io.Writer, string) (bool, error)
+	grantItems(context.Context, io.Writer, []grantParams) ([]grantResult, error)
+	tradeItems(context.Context, io.Writer, tradeParams) (trade, error)
+	changeTrade(context.Context, io.Writer, tradeChange) (trade, error)
+	trades(context.Context, io.Writer, string, string) ([]trade, error)
+	walletOperation
+	gachaOperation
+	loginBonusOperation
+	mailOperation
+	leaderboardOperation
+	achievementOperation
+	shopOperation
+	friendOperation
+	guildOperation
+	banOperation
+	auditOperation
+	softDeleteOperation
+	privacyOperation
 }
 
+var (
+	errUserNotFound = errors.New("user not found")
+	errNameTaken    = errors.New("name is already taken")
+	errItemNotFound = errors.New("item not found")
+	errAlreadyOwned = errors.New("the user has the item already")
+)
+
 type userParams struct {
 	userID   string
 	userName string
+	locale   string
+	country  string
+	platform string
+	timezone string
 }
 
 type itemParams struct {
 	itemID string
 }
 
+type userProfile struct {
+	Id        string    `json:"id"`
+	Name      string    `json:"name"`
+	Locale    string    `json:"locale,omitempty"`
+	Country   string    `json:"country,omitempty"`
+	Platform  string    `json:"platform,omitempty"`
+	Timezone  string    `json:"timezone,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// not cached with the profile, it's filled by the handler
+	FriendCount *int64 `json:"friend_count,omitempty"`
+}
+
+// empty string is stored as NULL
+func nullString(s string) spanner.NullString {
+	return spanner.NullString{StringVal: s, Valid: s != ""}
+}
+
 type dbClient struct {
 	sc    *spanner.Client
 	cache *redis.Client
 }
 
-var baseItemSliceCap = 100
-
 func newClient(ctx context.Context, dbString string, redisClient *redis.Client) (dbClient, error) {
 
 	client, err := spanner.NewClient(ctx, dbString)
@@ -72,13 +122,16 @@ func (d dbClient) createUser(ctx context.Context, w io.Writer, u userParams) err
 	defer span.End()
 
 	_, err := d.sc.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
-		sqlToUsers := `INSERT users (user_id, name, created_at, updated_at)
-		  VALUES (@userID, @userName, @timestamp, @timestamp)`
-		t := time.Now().Format("2006-01-02 15:04:05")
+		// the timestamps are the commit timestamp, not the clock of this instance
+		sqlToUsers := `INSERT users (user_id, name, locale, country, platform, timezone, created_at, updated_at)
+		  VALUES (@userID, @userName, @locale, @country, @platform, @timezone, PENDING_COMMIT_TIMESTAMP(), PENDING_COMMIT_TIMESTAMP())`
 		params := map[string]interface{}{
-			"userID":    u.userID,
-			"userName":  u.userName,
-			"timestamp": t,
+			"userID":   u.userID,
+			"userName": u.userName,
+			"locale":   nullString(u.locale),
+			"country":  nullString(u.country),
+			"platform": nullString(u.platform),
+			"timezone": nullString(u.timezone),
 		}
 		stmtToUsers := spanner.Statement{
 			SQL:    sqlToUsers,
@@ -90,8 +143,18 @@ func (d dbClient) createUser(ctx context.Context, w io.Writer, u userParams) err
 			return err
 		}
 
-		return nil
+		return auditInTxn(ctx, txn, "user.created", u.userID, "", nil, map[string]interface{}{
+			"name":     u.userName,
+			"locale":   u.locale,
+			"country":  u.country,
+			"platform": u.platform,
+			"timezone": u.timezone,
+		})
 	})
+	// names are unique by users_by_name_key index
+	if spanner.ErrCode(err) == codes.AlreadyExists {
+		return errNameTaken
+	}
 	return err
 }
 
@@ -102,42 +165,41 @@ func (d dbClient) addItemToUser(ctx context.Context, w io.Writer, u userParams,
 	defer span.End()
 
 	_, err := d.sc.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
-
-		sqlToUsers := `INSERT user_items (user_id, item_id, created_at, updated_at)
-		  VALUES (@userID, @itemID, @timestamp, @timestamp)`
-		t := time.Now().Format("2006-01-02 15:04:05")
-		params := map[string]interface{}{
-			"userID":    u.userID,
-			"itemId":    i.itemID,
-			"timestamp": t,
-		}
-		stmtToUsers := spanner.Statement{
-			SQL:    sqlToUsers,
-			Params: params,
-		}
-		rowCountToUsers, err := txn.Update(ctx, stmtToUsers)
-		_ = rowCountToUsers
+		results, err := grantItemsInTxn(ctx, txn, []grantParams{{userID: u.userID, itemID: i.itemID}})
 		if err != nil {
 			return err
 		}
+		switch results[0].Status {
+		case grantUnknownUser:
+			return errUserNotFound
+		case grantBannedUser:
+			return fmt.Errorf("%w: %s", errUserBanned, u.userID)
+		case grantUnknownItem:
+			return errItemNotFound
+		case grantAlreadyOwned:
+			return errAlreadyOwned
+		}
 		return nil
 	})
+	if err == nil {
+		d.invalidateUserItems(u.userID)
+	}
 	return err
 }
 
-// get items the user has
-func (d dbClient) userItems(ctx context.Context, w io.Writer, userID string) ([]map[string]interface{}, error) {
+// get a page of items the user has
+func (d dbClient) userItems(ctx context.Context, w io.Writer, userID string, p pageParams) (itemPage, error) {
 
 	ctx, span := otel.Tracer("main").Start(ctx, "userItems")
 	defer span.End()
 
-	key := fmt.Sprintf("userItems_%s", userID)
+	key := p.cacheKey(userID)
 	data, err := d.cache.Get(key).Result()
 
 	if err != nil {
 		log.Println(key, "Error", err)
 	} else {
-		results := []map[string]interface{}{}
+		results := itemPage{}
 		err := json.Unmarshal([]byte(data), &results)
 		if err != nil {
 			log.Println(err)
@@ -146,22 +208,66 @@ func (d dbClient) userItems(ctx context.Context, w io.Writer, userID string) ([]
 		return results, nil
 	}
 
-	txn := d.sc.ReadOnlyTransaction()
-	defer txn.Close()
-	sql := `select users.name,items.item_name,user_items.item_id
+	sortColumn := itemSortColumns[p.sort]
+	direction, compare := "asc", ">"
+	if p.desc {
+		direction, compare = "desc", "<"
+	}
+
+	params := map[string]interface{}{
+		"user_id": userID,
+		"limit":   int64(p.limit + 1),
+	}
+
+	sql := `select users.name,items.item_name,user_items.item_id,user_items.created_at,user_items.updated_at,user_items.expires_at,user_items.deleted_at
 		from user_items join items on items.item_id = user_items.item_id join users on users.user_id = user_items.user_id
 		where user_items.user_id = @user_id`
+	if !p.includeDeleted {
+		sql += " and user_items.deleted_at is null and users.deleted_at is null"
+	}
+	if !p.includeExpired {
+		sql += " and (user_items.expires_at is null or user_items.expires_at > current_timestamp())"
+	}
+
+	if c := p.cursor; c != nil {
+		params["cursor_id"] = c.ItemID
+		switch p.sort {
+		case "item_id":
+			sql += fmt.Sprintf(" and user_items.item_id %s @cursor_id", compare)
+		default:
+			var cursorKey interface{} = c.Key
+			if p.sort == "acquired_at" {
+				t, err := time.Parse(time.RFC3339Nano, c.Key)
+				if err != nil {
+					return itemPage{}, err
+				}
+				cursorKey = t
+			}
+			params["cursor_key"] = cursorKey
+			sql += fmt.Sprintf(" and (%[1]s %[2]s @cursor_key or (%[1]s = @cursor_key and user_items.item_id %[2]s @cursor_id))", sortColumn, compare)
+		}
+	}
+
+	if p.sort == "item_id" {
+		sql += fmt.Sprintf(" order by user_items.item_id %s", direction)
+	} else {
+		sql += fmt.Sprintf(" order by %[1]s %[2]s, user_items.item_id %[2]s", sortColumn, direction)
+	}
+	sql += " limit @limit"
+
 	stmt := spanner.Statement{
-		SQL: sql,
-		Params: map[string]interface{}{
-			"user_id": userID,
-		},
+		SQL:    sql,
+		Params: params,
 	}
 
+	txn := d.sc.ReadOnlyTransaction()
+	defer txn.Close()
+
 	iter := txn.Query(ctx, stmt)
 	defer iter.Stop()
 
-	results := make([]map[string]interface{}, 0, baseItemSliceCap)
+	results := itemPage{Items: make([]map[string]interface{}, 0, p.limit)}
+	var last pageCursor
 	for {
 		row, err := iter.Next()
 		if err == iterator.Done {
@@ -173,17 +279,43 @@ func (d dbClient) userItems(ctx context.Context, w io.Writer, userID string) ([]
 		var userName string
 		var itemNames string
 		var itemIds string
-		if err := row.Columns(&userName, &itemNames, &itemIds); err != nil {
+		var createdAt, updatedAt time.Time
+		var expiresAt, deletedAt spanner.NullTime
+		if err := row.Columns(&userName, &itemNames, &itemIds, &createdAt, &updatedAt, &expiresAt, &deletedAt); err != nil {
 			return results, err
 		}
 
-		results = append(results,
-			map[string]interface{}{
-				"user_name": userName,
-				"item_name": itemNames,
-				"item_id":   itemIds,
-			})
+		// one extra row was requested to know whether a next page exists
+		if len(results.Items) == p.limit {
+			results.NextCursor = encodeCursor(last)
+			break
+		}
 
+		item := map[string]interface{}{
+			"user_name":  userName,
+			"item_name":  itemNames,
+			"item_id":    itemIds,
+			"created_at": createdAt,
+			"updated_at": updatedAt,
+		}
+		if expiresAt.Valid {
+			item["expires_at"] = expiresAt.Time
+			if p.includeExpired {
+				item["expired"] = !expiresAt.Time.After(time.Now())
+			}
+		}
+		if deletedAt.Valid {
+			item["deleted_at"] = deletedAt.Time
+		}
+		results.Items = append(results.Items, item)
+
+		last = pageCursor{Sort: p.sort, Desc: p.desc, ItemID: itemIds}
+		switch p.sort {
+		case "acquired_at":
+			last.Key = createdAt.Format(time.RFC3339Nano)
+		case "item_name":
+			last.Key = itemNames
+		}
 	}
 
 	jsonedResults, _ := json.Marshal(results)
@@ -191,6 +323,228 @@ func (d dbClient) userItems(ctx context.Context, w io.Writer, userID string) ([]
 	if err != nil {
 		log.Println(err)
 	}
+	// remember the key so that every cached page of the user can be cleared at once
+	indexKey := fmt.Sprintf("userItemsKeys_%s", userID)
+	if err := d.cache.SAdd(indexKey, key).Err(); err != nil {
+		log.Println(err)
+	}
+	d.cache.Expire(indexKey, 10*time.Second)
 
 	return results, nil
 }
+
+// get the user's profile
+func (d dbClient) userProfile(ctx context.Context, w io.Writer, userID string) (userProfile, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "userProfile")
+	defer span.End()
+
+	key := fmt.Sprintf("user_%s", userID)
+	data, err := d.cache.Get(key).Result()
+
+	if err != nil {
+		log.Println(key, "Error", err)
+	} else {
+		result := userProfile{}
+		if err := json.Unmarshal([]byte(data), &result); err == nil {
+			log.Println(key, "from cache")
+			return result, nil
+		}
+	}
+
+	columns := []string{"user_id", "name", "locale", "country", "platform", "timezone", "created_at", "updated_at", "deleted_at"}
+	row, err := d.sc.Single().ReadRow(ctx, "users", spanner.Key{userID}, columns)
+	if spanner.ErrCode(err) == codes.NotFound {
+		return userProfile{}, errUserNotFound
+	}
+	if err != nil {
+		return userProfile{}, err
+	}
+
+	var result userProfile
+	var locale, country, platform, timezone spanner.NullString
+	var deletedAt spanner.NullTime
+	if err := row.Columns(&result.Id, &result.Name, &locale, &country, &platform, &timezone, &result.CreatedAt, &result.UpdatedAt, &deletedAt); err != nil {
+		return userProfile{}, err
+	}
+	if deletedAt.Valid {
+		return userProfile{}, errUserNotFound
+	}
+	result.Locale = locale.StringVal
+	result.Country = country.StringVal
+	result.Platform = platform.StringVal
+	result.Timezone = timezone.StringVal
+
+	jsonedResult, _ := json.Marshal(result)
+	if err := d.cache.Set(key, string(jsonedResult), 10*time.Second).Err(); err != nil {
+		log.Println(err)
+	}
+
+	return result, nil
+}
+
+// change the user's name
+func (d dbClient) renameUser(ctx context.Context, w io.Writer, u userParams) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "renameUser")
+	defer span.End()
+
+	_, err := d.sc.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		before, err := userNameInTxn(ctx, txn, u.userID)
+		if err != nil {
+			return err
+		}
+		stmt := spanner.Statement{
+			SQL: `UPDATE users SET name = @userName, updated_at = PENDING_COMMIT_TIMESTAMP() WHERE user_id = @userID`,
+			Params: map[string]interface{}{
+				"userID":   u.userID,
+				"userName": u.userName,
+			},
+		}
+		rowCount, err := txn.Update(ctx, stmt)
+		if err != nil {
+			return err
+		}
+		if rowCount == 0 {
+			return errUserNotFound
+		}
+		return auditInTxn(ctx, txn, "user.renamed", u.userID, "", map[string]interface{}{"name": before}, map[string]interface{}{"name": u.userName})
+	})
+	if spanner.ErrCode(err) == codes.AlreadyExists {
+		return errNameTaken
+	}
+	if err == nil {
+		d.invalidateUser(u.userID)
+	}
+	return err
+}
+
+// userNameInTxn returns errUserNotFound if the user doesn't exist or is soft deleted
+func userNameInTxn(ctx context.Context, txn *spanner.ReadWriteTransaction, userID string) (string, error) {
+	row, err := txn.ReadRow(ctx, "users", spanner.Key{userID}, []string{"name", "deleted_at"})
+	if spanner.ErrCode(err) == codes.NotFound {
+		return "", errUserNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	var name string
+	var deletedAt spanner.NullTime
+	if err := row.Columns(&name, &deletedAt); err != nil {
+		return "", err
+	}
+	if deletedAt.Valid {
+		return "", errUserNotFound
+	}
+	return name, nil
+}
+
+// userExistsInTxn returns errUserNotFound if the user doesn't exist or is soft deleted
+func userExistsInTxn(ctx context.Context, txn spannerReader, userID string) error {
+	row, err := txn.ReadRow(ctx, "users", spanner.Key{userID}, []string{"deleted_at"})
+	if spanner.ErrCode(err) == codes.NotFound {
+		return fmt.Errorf("%w: %s", errUserNotFound, userID)
+	}
+	if err != nil {
+		return err
+	}
+	var deletedAt spanner.NullTime
+	if err := row.Columns(&deletedAt); err != nil {
+		return err
+	}
+	if deletedAt.Valid {
+		return fmt.Errorf("%w: %s", errUserNotFound, userID)
+	}
+	return nil
+}
+
+// check if the name is used by someone, case-insensitively
+func (d dbClient) userNameTaken(ctx context.Context, w io.Writer, name string) (bool, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "userNameTaken")
+	defer span.End()
+
+	stmt := spanner.Statement{
+		SQL: `SELECT user_id FROM users@{FORCE_INDEX=users_by_name_key} WHERE name_key = LOWER(@name) LIMIT 1`,
+		Params: map[string]interface{}{
+			"name": name,
+		},
+	}
+	iter := d.sc.Single().Query(ctx, stmt)
+	defer iter.Stop()
+
+	_, err := iter.Next()
+	if err == iterator.Done {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// soft delete the user, the row and the items are kept until purgeDeleted removes them after the retention
+func (d dbClient) deleteUser(ctx context.Context, w io.Writer, userID string) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "deleteUser")
+	defer span.End()
+
+	var friendIDs []string
+	_, err := d.sc.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		name, err := userNameInTxn(ctx, txn, userID)
+		if err != nil {
+			return err
+		}
+		if friendIDs, err = deleteFriendshipsInTxn(ctx, txn, userID); err != nil {
+			return err
+		}
+		if err := leaveGuildsInTxn(ctx, txn, userID, false); err != nil {
+			return err
+		}
+		stmt := spanner.Statement{
+			SQL: `UPDATE users SET deleted_at = @timestamp, updated_at = PENDING_COMMIT_TIMESTAMP() WHERE user_id = @userID AND deleted_at IS NULL`,
+			Params: map[string]interface{}{
+				"userID":    userID,
+				"timestamp": time.Now(),
+			},
+		}
+		rowCount, err := txn.Update(ctx, stmt)
+		if err != nil {
+			return err
+		}
+		if rowCount == 0 {
+			return errUserNotFound
+		}
+		return auditInTxn(ctx, txn, "user.deleted", userID, "", map[string]interface{}{"name": name}, nil)
+	})
+	if err == nil {
+		d.invalidateUser(userID)
+		for _, friendID := range friendIDs {
+			if err := d.cache.Del(friendCountKey(friendID)).Err(); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	return err
+}
+
+// clear every cache entry of the user
+func (d dbClient) invalidateUser(userID string) {
+	if err := d.cache.Del(fmt.Sprintf("user_%s", userID), friendCountKey(userID), banKey(userID)).Err(); err != nil {
+		log.Println(err)
+	}
+	d.invalidateUserItems(userID)
+}
+
+// clear all cached pages of the user's items
+func (d dbClient) invalidateUserItems(userID string) {
+	indexKey := fmt.Sprintf("userItemsKeys_%s", userID)
+	keys, err := d.cache.SMembers(indexKey).Result()
+	if err != nil {
+		log.Println(indexKey, "Error", err)
+		return
+	}
+	if err := d.cache.Del(append(keys, indexKey)...).Err(); err != nil {
+		log.Println(err)
+	}
+}
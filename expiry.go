@@ -0,0 +1,133 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"go.opentelemetry.io/otel"
+)
+
+var (
+	// expired items are deleted by this number in a transaction
+	reapBatchSize = 500
+	// how often the reaper runs, 0 disables it
+	reapInterval = func() time.Duration {
+		d, err := time.ParseDuration(os.Getenv("ITEM_REAPER_INTERVAL"))
+		if err != nil {
+			return time.Minute
+		}
+		return d
+	}()
+)
+
+// reapExpiredItems deletes the items expired before now in batches, and returns how many were deleted.
+// Partitioned DML or a row deletion policy would be simpler, but they can't tell which items were deleted,
+// and an event has to be published for each user.
+func (d dbClient) reapExpiredItems(ctx context.Context, now time.Time) (int, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "reapExpiredItems")
+	defer span.End()
+
+	total := 0
+	for {
+		stmt := spanner.Statement{
+			SQL: `SELECT user_id, item_id FROM user_items@{FORCE_INDEX=user_items_by_expires_at}
+			  WHERE expires_at <= @now AND deleted_at IS NULL LIMIT @limit`,
+			Params: map[string]interface{}{"now": now, "limit": int64(reapBatchSize)},
+		}
+		keys := []spanner.KeySet{}
+		err := d.sc.Single().Query(ctx, stmt).Do(func(row *spanner.Row) error {
+			var k userItemKey
+			if err := row.Columns(&k.userID, &k.itemID); err != nil {
+				return err
+			}
+			keys = append(keys, spanner.Key{k.userID, k.itemID})
+			return nil
+		})
+		if err != nil || len(keys) == 0 {
+			return total, err
+		}
+
+		var expired map[string][]string
+		_, err = d.sc.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+			expired = map[string][]string{}
+			mutations := []*spanner.Mutation{}
+			// read again, the items may have been deleted, or replaced by another grant
+			// soft deleted ones are left to purgeDeleted so that they can be restored
+			err := txn.Read(ctx, "user_items", spanner.KeySets(keys...), []string{"user_id", "item_id", "expires_at", "deleted_at"}).Do(func(row *spanner.Row) error {
+				var k userItemKey
+				var expiresAt, deletedAt spanner.NullTime
+				if err := row.Columns(&k.userID, &k.itemID, &expiresAt, &deletedAt); err != nil {
+					return err
+				}
+				if expiresAt.Valid && !expiresAt.Time.After(now) && !deletedAt.Valid {
+					expired[k.userID] = append(expired[k.userID], k.itemID)
+					mutations = append(mutations, spanner.Delete("user_items", spanner.Key{k.userID, k.itemID}))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for userID, itemIDs := range expired {
+				mutations = append(mutations, auditMutation(ctx, "items.expired", userID, "", map[string]interface{}{"item_ids": itemIDs}, nil))
+			}
+			return txn.BufferWrite(mutations)
+		})
+		if err != nil {
+			return total, err
+		}
+
+		for userID, itemIDs := range expired {
+			total += len(itemIDs)
+			d.invalidateUserItems(userID)
+			publishEvent("items.expired", map[string]interface{}{"id": userID, "items": itemIDs})
+		}
+		if len(keys) < reapBatchSize {
+			return total, nil
+		}
+	}
+}
+
+// startItemReaper deletes expired items periodically until ctx is done
+func startItemReaper(ctx context.Context, d dbClient) {
+	if reapInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(reapInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				n, err := d.reapExpiredItems(ctx, time.Now())
+				if err != nil {
+					log.Println("failed to delete expired items:", err)
+				}
+				if n > 0 {
+					log.Printf("deleted %d expired items", n)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,390 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+)
+
+type friendOperation interface {
+	friendships(context.Context, io.Writer, string, string) ([]friendship, error)
+	changeFriendship(context.Context, io.Writer, friendParams) (friendship, error)
+	friendCount(context.Context, io.Writer, string) (int64, error)
+}
+
+// status of the row, seen from user_id
+const (
+	friendStatusFriend    = "friend"
+	friendStatusRequested = "requested"
+	friendStatusPending   = "pending"
+	friendStatusBlocked   = "blocked"
+	// returned when the row is deleted
+	friendStatusNone = "none"
+)
+
+const (
+	friendActionRequest = "request"
+	friendActionAccept  = "accept"
+	friendActionDecline = "decline"
+	friendActionCancel  = "cancel"
+	friendActionRemove  = "remove"
+	friendActionBlock   = "block"
+	friendActionUnblock = "unblock"
+)
+
+var (
+	errSelfFriend            = errors.New("the user can't be a friend of themselves")
+	errAlreadyFriends        = errors.New("the users are friends already")
+	errAlreadyRequested      = errors.New("the friend request has been sent already")
+	errFriendRequestNotFound = errors.New("friend request not found")
+	errNotFriends            = errors.New("the users are not friends")
+	errNotBlocked            = errors.New("the user is not blocked")
+	errBlocked               = errors.New("the user is blocked")
+	errFriendLimit           = errors.New("too many friends")
+)
+
+var (
+	// how many friends a user can have
+	friendLimit = func() int64 {
+		n, err := strconv.ParseInt(os.Getenv("FRIEND_LIMIT"), 10, 64)
+		if err != nil || n <= 0 {
+			return 100
+		}
+		return n
+	}()
+	// friend counts are deleted when they change, this is only for safety
+	friendCountTTL = time.Hour
+)
+
+type friendParams struct {
+	userID   string
+	friendID string
+	action   string
+}
+
+type friendship struct {
+	FriendID  string    `json:"friend_id"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func friendCountKey(userID string) string {
+	return fmt.Sprintf("friend_count_%s", userID)
+}
+
+// friendStatusInTxn returns empty string if there's no row
+func friendStatusInTxn(ctx context.Context, txn *spanner.ReadWriteTransaction, userID, friendID string) (string, time.Time, error) {
+	row, err := txn.ReadRow(ctx, "friendships", spanner.Key{userID, friendID}, []string{"status", "created_at"})
+	if spanner.ErrCode(err) == codes.NotFound {
+		return "", time.Time{}, nil
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	var status string
+	var createdAt time.Time
+	err = row.Columns(&status, &createdAt)
+	return status, createdAt, err
+}
+
+func countFriendsInTxn(ctx context.Context, txn spannerReader, userID string) (int64, error) {
+	var count int64
+	stmt := spanner.Statement{
+		SQL:    "SELECT COUNT(*) FROM friendships WHERE user_id = @userID AND status = @status",
+		Params: map[string]interface{}{"userID": userID, "status": friendStatusFriend},
+	}
+	err := txn.Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		return row.Columns(&count)
+	})
+	return count, err
+}
+
+// deleteFriendshipsInTxn deletes the rows of the user and the rows of the other users pointing to the user.
+// The user is soft deleted, so the rows of the user are not deleted by cascade either.
+// It returns the users who were friends of the user.
+func deleteFriendshipsInTxn(ctx context.Context, txn *spanner.ReadWriteTransaction, userID string) ([]string, error) {
+	friendIDs := []string{}
+	stmt := spanner.Statement{
+		SQL:    "SELECT user_id FROM friendships@{FORCE_INDEX=friendships_by_friend_id} WHERE friend_id = @userID AND status = @status",
+		Params: map[string]interface{}{"userID": userID, "status": friendStatusFriend},
+	}
+	err := txn.Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		var friendID string
+		if err := row.Columns(&friendID); err != nil {
+			return err
+		}
+		friendIDs = append(friendIDs, friendID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = txn.Update(ctx, spanner.Statement{
+		SQL:    "DELETE FROM friendships WHERE user_id = @userID OR friend_id = @userID",
+		Params: map[string]interface{}{"userID": userID},
+	})
+	return friendIDs, err
+}
+
+// list the friendships of the user, all statuses if status is empty
+func (d dbClient) friendships(ctx context.Context, w io.Writer, userID, status string) ([]friendship, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "friendships")
+	defer span.End()
+
+	txn := d.sc.ReadOnlyTransaction()
+	defer txn.Close()
+
+	if err := userExistsInTxn(ctx, txn, userID); err != nil {
+		return nil, err
+	}
+
+	results := []friendship{}
+	iter := txn.Read(ctx, "friendships", spanner.Key{userID}.AsPrefix(), []string{"friend_id", "status", "created_at", "updated_at"})
+	err := iter.Do(func(row *spanner.Row) error {
+		var f friendship
+		if err := row.Columns(&f.FriendID, &f.Status, &f.CreatedAt, &f.UpdatedAt); err != nil {
+			return err
+		}
+		if status == "" || f.Status == status {
+			results = append(results, f)
+		}
+		return nil
+	})
+	return results, err
+}
+
+// change the friendship between the users by the action.
+// Both rows are written in a transaction, so that they are always consistent,
+// except for blocking, which is only seen from the user who blocks.
+func (d dbClient) changeFriendship(ctx context.Context, w io.Writer, p friendParams) (friendship, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "changeFriendship")
+	defer span.End()
+
+	if p.userID == p.friendID {
+		return friendship{}, errSelfFriend
+	}
+
+	var result friendship
+	_, err := d.sc.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		now := time.Now()
+		result = friendship{FriendID: p.friendID, CreatedAt: now, UpdatedAt: now}
+
+		for _, userID := range []string{p.userID, p.friendID} {
+			if err := userExistsInTxn(ctx, txn, userID); err != nil {
+				return err
+			}
+		}
+		mine, createdAt, err := friendStatusInTxn(ctx, txn, p.userID, p.friendID)
+		if err != nil {
+			return err
+		}
+		if mine != "" {
+			result.CreatedAt = createdAt
+		}
+		theirs, _, err := friendStatusInTxn(ctx, txn, p.friendID, p.userID)
+		if err != nil {
+			return err
+		}
+
+		columns := []string{"user_id", "friend_id", "status", "created_at", "updated_at"}
+		both := func(status, reverse string) []*spanner.Mutation {
+			result.Status = status
+			return []*spanner.Mutation{
+				spanner.InsertOrUpdate("friendships", columns, []interface{}{p.userID, p.friendID, status, result.CreatedAt, now}),
+				spanner.InsertOrUpdate("friendships", columns, []interface{}{p.friendID, p.userID, reverse, result.CreatedAt, now}),
+			}
+		}
+		deleteBoth := []*spanner.Mutation{
+			spanner.Delete("friendships", spanner.Key{p.userID, p.friendID}),
+			spanner.Delete("friendships", spanner.Key{p.friendID, p.userID}),
+		}
+		checkLimit := func(userIDs ...string) error {
+			for _, userID := range userIDs {
+				count, err := countFriendsInTxn(ctx, txn, userID)
+				if err != nil {
+					return err
+				}
+				if count >= friendLimit {
+					return fmt.Errorf("%w: %s has %d friends", errFriendLimit, userID, count)
+				}
+			}
+			return nil
+		}
+
+		action := p.action
+		// requesting to the user who has requested is accepting it
+		if action == friendActionRequest && mine == friendStatusPending {
+			action = friendActionAccept
+		}
+
+		switch action {
+		case friendActionRequest:
+			switch {
+			case mine == friendStatusBlocked || theirs == friendStatusBlocked:
+				return errBlocked
+			case mine == friendStatusFriend:
+				return errAlreadyFriends
+			case mine == friendStatusRequested:
+				return errAlreadyRequested
+			}
+			if err := checkLimit(p.userID); err != nil {
+				return err
+			}
+			return txn.BufferWrite(both(friendStatusRequested, friendStatusPending))
+		case friendActionAccept:
+			if mine != friendStatusPending {
+				return errFriendRequestNotFound
+			}
+			if err := checkLimit(p.userID, p.friendID); err != nil {
+				return err
+			}
+			return txn.BufferWrite(both(friendStatusFriend, friendStatusFriend))
+		case friendActionDecline, friendActionCancel:
+			expected := friendStatusPending
+			if action == friendActionCancel {
+				expected = friendStatusRequested
+			}
+			if mine != expected {
+				return errFriendRequestNotFound
+			}
+			result.Status = friendStatusNone
+			return txn.BufferWrite(deleteBoth)
+		case friendActionRemove:
+			if mine != friendStatusFriend {
+				return errNotFriends
+			}
+			result.Status = friendStatusNone
+			return txn.BufferWrite(deleteBoth)
+		case friendActionBlock:
+			result.Status = friendStatusBlocked
+			if mine == friendStatusBlocked {
+				return nil
+			}
+			if mine == "" {
+				result.CreatedAt = now
+			}
+			mutations := []*spanner.Mutation{
+				spanner.InsertOrUpdate("friendships", columns, []interface{}{p.userID, p.friendID, friendStatusBlocked, result.CreatedAt, now}),
+			}
+			// the other user keeps blocking if they do
+			if theirs != friendStatusBlocked {
+				mutations = append(mutations, spanner.Delete("friendships", spanner.Key{p.friendID, p.userID}))
+			}
+			return txn.BufferWrite(mutations)
+		case friendActionUnblock:
+			if mine != friendStatusBlocked {
+				return errNotBlocked
+			}
+			result.Status = friendStatusNone
+			return txn.BufferWrite([]*spanner.Mutation{spanner.Delete("friendships", spanner.Key{p.userID, p.friendID})})
+		}
+		return validationError{"action": "unknown action " + p.action}
+	})
+	if err != nil {
+		return friendship{}, err
+	}
+
+	if err := d.cache.Del(friendCountKey(p.userID), friendCountKey(p.friendID)).Err(); err != nil {
+		log.Println(err)
+	}
+	return result, nil
+}
+
+// get the number of the user's friends, it's cached until the friends change
+func (d dbClient) friendCount(ctx context.Context, w io.Writer, userID string) (int64, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "friendCount")
+	defer span.End()
+
+	key := friendCountKey(userID)
+	count, err := d.cache.Get(key).Int64()
+	if err == nil {
+		return count, nil
+	}
+	log.Println(key, "Error", err)
+
+	count, err = countFriendsInTxn(ctx, d.sc.Single(), userID)
+	if err != nil {
+		return 0, err
+	}
+	if err := d.cache.Set(key, count, friendCountTTL).Err(); err != nil {
+		log.Println(err)
+	}
+	return count, nil
+}
+
+func (s Serving) getFriends(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "getFriends.root")
+	span.SetAttributes(attribute.String("server", "getFriends"))
+	defer span.End()
+
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", friendStatusFriend, friendStatusRequested, friendStatusPending, friendStatusBlocked:
+	default:
+		errorRender(w, r, http.StatusBadRequest, fmt.Errorf("unknown status %q", status))
+		return
+	}
+
+	results, err := s.Client.friendships(ctx, w, userID, status)
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+	render.JSON(w, r, map[string]interface{}{"friends": results, "limit": friendLimit})
+}
+
+func (s Serving) changeFriendship(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	friendID := chi.URLParam(r, "friend_id")
+	action := chi.URLParam(r, "action")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "changeFriendship.root")
+	span.SetAttributes(attribute.String("server", "changeFriendship"))
+	defer span.End()
+
+	result, err := s.Client.changeFriendship(ctx, w, friendParams{userID: userID, friendID: friendID, action: action})
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+
+	publishEvent("friend."+action, map[string]interface{}{"id": userID, "friend_id": friendID, "status": result.Status})
+
+	render.JSON(w, r, result)
+}
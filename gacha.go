@@ -0,0 +1,441 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+)
+
+type gachaOperation interface {
+	dropTableOdds(context.Context, io.Writer, string) (dropTableOdds, error)
+	drawGacha(context.Context, io.Writer, drawParams) (drawResult, error)
+	gachaDraw(context.Context, io.Writer, string, string) (drawResult, error)
+}
+
+var (
+	errDropTableNotFound = errors.New("drop table not found")
+	errDrawNotFound      = errors.New("draw not found")
+)
+
+var maxDrawCount = 10
+
+type dropTableEntry struct {
+	ItemID string `json:"item_id"`
+	Weight int64  `json:"weight"`
+	Rarity string `json:"rarity"`
+}
+
+type dropTable struct {
+	id            string
+	name          string
+	currency      string
+	cost          int64
+	pityThreshold int64
+	pityRarity    string
+	// sorted by item_id, the order decides which item a random number points to
+	entries []dropTableEntry
+}
+
+// hash identifies the configuration, it is recorded in every draw
+// so that a draw can be verified against the odds published with the same hash
+func (t dropTable) hash() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s|%s|%d|%d|%s\n", t.id, t.currency, t.cost, t.pityThreshold, t.pityRarity)
+	for _, e := range t.entries {
+		fmt.Fprintf(h, "%s|%d|%s\n", e.ItemID, e.Weight, e.Rarity)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type drawOutcome struct {
+	ItemID string `json:"item_id"`
+	Rarity string `json:"rarity"`
+	// drawn only from pity rarity because of pity counter
+	Pity   bool   `json:"pity"`
+	Status string `json:"status,omitempty"`
+}
+
+// drawItems is deterministic for the seed, the same table, seed and pity always give the same results.
+// pity is the number of draws in a row without pity rarity, the updated one is returned.
+func drawItems(t dropTable, seed int64, count int, pity int64) ([]drawOutcome, int64) {
+	rng := rand.New(rand.NewSource(seed))
+	outcomes := make([]drawOutcome, 0, count)
+
+	for i := 0; i < count; i++ {
+		candidates := t.entries
+		pityApplied := false
+		if t.pityThreshold > 0 && pity+1 >= t.pityThreshold {
+			pityEntries := make([]dropTableEntry, 0, len(t.entries))
+			for _, e := range t.entries {
+				if e.Rarity == t.pityRarity {
+					pityEntries = append(pityEntries, e)
+				}
+			}
+			if len(pityEntries) > 0 {
+				candidates = pityEntries
+				pityApplied = true
+			}
+		}
+
+		var total int64
+		for _, e := range candidates {
+			total += e.Weight
+		}
+		n := rng.Int63n(total)
+		picked := candidates[len(candidates)-1]
+		for _, e := range candidates {
+			if n < e.Weight {
+				picked = e
+				break
+			}
+			n -= e.Weight
+		}
+
+		if picked.Rarity == t.pityRarity {
+			pity = 0
+		} else {
+			pity++
+		}
+		outcomes = append(outcomes, drawOutcome{ItemID: picked.ItemID, Rarity: picked.Rarity, Pity: pityApplied})
+	}
+	return outcomes, pity
+}
+
+// spannerReader is implemented by both read-only and read-write transactions
+type spannerReader interface {
+	ReadRow(ctx context.Context, table string, key spanner.Key, columns []string) (*spanner.Row, error)
+	Read(ctx context.Context, table string, keys spanner.KeySet, columns []string) *spanner.RowIterator
+	Query(ctx context.Context, statement spanner.Statement) *spanner.RowIterator
+}
+
+func readDropTable(ctx context.Context, txn spannerReader, dropTableID string) (dropTable, error) {
+	row, err := txn.ReadRow(ctx, "drop_tables", spanner.Key{dropTableID}, []string{"name", "currency", "cost", "pity_threshold", "pity_rarity"})
+	if spanner.ErrCode(err) == codes.NotFound {
+		return dropTable{}, errDropTableNotFound
+	}
+	if err != nil {
+		return dropTable{}, err
+	}
+
+	t := dropTable{id: dropTableID}
+	var pityThreshold spanner.NullInt64
+	var pityRarity spanner.NullString
+	if err := row.Columns(&t.name, &t.currency, &t.cost, &pityThreshold, &pityRarity); err != nil {
+		return dropTable{}, err
+	}
+	t.pityThreshold = pityThreshold.Int64
+	t.pityRarity = pityRarity.StringVal
+
+	iter := txn.Read(ctx, "drop_table_entries", spanner.Key{dropTableID}.AsPrefix(), []string{"item_id", "weight", "rarity"})
+	err = iter.Do(func(row *spanner.Row) error {
+		var e dropTableEntry
+		if err := row.Columns(&e.ItemID, &e.Weight, &e.Rarity); err != nil {
+			return err
+		}
+		if e.Weight > 0 {
+			t.entries = append(t.entries, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return dropTable{}, err
+	}
+	if len(t.entries) == 0 {
+		return dropTable{}, fmt.Errorf("drop table %s has no entries", dropTableID)
+	}
+	sort.Slice(t.entries, func(i, j int) bool { return t.entries[i].ItemID < t.entries[j].ItemID })
+	return t, nil
+}
+
+type dropTableOdds struct {
+	DropTableID   string             `json:"drop_table_id"`
+	Name          string             `json:"name"`
+	Currency      string             `json:"currency"`
+	Cost          int64              `json:"cost"`
+	PityThreshold int64              `json:"pity_threshold,omitempty"`
+	PityRarity    string             `json:"pity_rarity,omitempty"`
+	TableHash     string             `json:"table_hash"`
+	Entries       []dropTableOdd     `json:"entries"`
+	Rarities      map[string]float64 `json:"rarities"`
+}
+
+type dropTableOdd struct {
+	dropTableEntry
+	Probability float64 `json:"probability"`
+}
+
+// odds are computed from the weights, nothing else is configured
+func (t dropTable) odds() dropTableOdds {
+	var total int64
+	for _, e := range t.entries {
+		total += e.Weight
+	}
+
+	odds := dropTableOdds{
+		DropTableID:   t.id,
+		Name:          t.name,
+		Currency:      t.currency,
+		Cost:          t.cost,
+		PityThreshold: t.pityThreshold,
+		PityRarity:    t.pityRarity,
+		TableHash:     t.hash(),
+		Entries:       make([]dropTableOdd, 0, len(t.entries)),
+		Rarities:      map[string]float64{},
+	}
+	for _, e := range t.entries {
+		p := float64(e.Weight) / float64(total)
+		odds.Entries = append(odds.Entries, dropTableOdd{dropTableEntry: e, Probability: p})
+		odds.Rarities[e.Rarity] += p
+	}
+	return odds
+}
+
+type drawParams struct {
+	userID      string
+	dropTableID string
+	count       int
+}
+
+type drawResult struct {
+	DrawID      string        `json:"draw_id"`
+	DropTableID string        `json:"drop_table_id"`
+	TableHash   string        `json:"table_hash"`
+	Seed        int64         `json:"seed,string"`
+	PityBefore  int64         `json:"pity_before"`
+	Cost        int64         `json:"cost"`
+	Balance     *int64        `json:"balance,omitempty"`
+	Results     []drawOutcome `json:"results"`
+	CreatedAt   time.Time     `json:"created_at"`
+}
+
+// get the odds of the drop table
+func (d dbClient) dropTableOdds(ctx context.Context, w io.Writer, dropTableID string) (dropTableOdds, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "dropTableOdds")
+	defer span.End()
+
+	txn := d.sc.ReadOnlyTransaction()
+	defer txn.Close()
+
+	t, err := readDropTable(ctx, txn, dropTableID)
+	if err != nil {
+		return dropTableOdds{}, err
+	}
+	return t.odds(), nil
+}
+
+// draw from the drop table, the items are granted and paid for in a transaction.
+// Items the user has already are not granted, but the draws are paid for.
+func (d dbClient) drawGacha(ctx context.Context, w io.Writer, p drawParams) (drawResult, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "drawGacha")
+	defer span.End()
+
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return drawResult{}, err
+	}
+	result := drawResult{
+		DrawID:      uuid.NewString(),
+		DropTableID: p.dropTableID,
+		Seed:        int64(binary.BigEndian.Uint64(b[:]) >> 1),
+	}
+
+	_, err := d.sc.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		if err := userExistsInTxn(ctx, txn, p.userID); err != nil {
+			return err
+		}
+
+		t, err := readDropTable(ctx, txn, p.dropTableID)
+		if err != nil {
+			return err
+		}
+		result.TableHash = t.hash()
+
+		result.PityBefore = 0
+		row, err := txn.ReadRow(ctx, "user_gacha_pity", spanner.Key{p.userID, p.dropTableID}, []string{"counter"})
+		if err == nil {
+			err = row.Columns(&result.PityBefore)
+		}
+		if err != nil && spanner.ErrCode(err) != codes.NotFound {
+			return err
+		}
+
+		// every draw is paid, also the ones that give an item the user has already
+		result.Cost = t.cost * int64(p.count)
+		balance, err := changeBalanceInTxn(ctx, txn, p.userID, t.currency, -result.Cost, reasonGachaDraw, result.DrawID)
+		if err != nil {
+			return err
+		}
+
+		outcomes, pity := drawItems(t, result.Seed, p.count, result.PityBefore)
+		grants := make([]grantParams, 0, len(outcomes))
+		for _, o := range outcomes {
+			grants = append(grants, grantParams{userID: p.userID, itemID: o.ItemID})
+		}
+		granted, err := grantItemsInTxn(ctx, txn, grants)
+		if err != nil {
+			return err
+		}
+		for i := range outcomes {
+			outcomes[i].Status = granted[i].Status
+		}
+		result.Balance = &balance
+		result.Results = outcomes
+		result.CreatedAt = time.Now()
+
+		return txn.BufferWrite([]*spanner.Mutation{
+			spanner.InsertOrUpdate("user_gacha_pity",
+				[]string{"user_id", "drop_table_id", "counter", "updated_at"},
+				[]interface{}{p.userID, p.dropTableID, pity, result.CreatedAt},
+			),
+			spanner.Insert("gacha_draws",
+				[]string{"user_id", "draw_id", "drop_table_id", "table_hash", "seed", "pity_before", "cost", "results", "created_at"},
+				[]interface{}{p.userID, result.DrawID, p.dropTableID, result.TableHash, result.Seed, result.PityBefore, result.Cost,
+					spanner.NullJSON{Value: outcomes, Valid: true}, result.CreatedAt},
+			),
+		})
+	})
+	if err != nil {
+		return drawResult{}, err
+	}
+
+	d.invalidateUserItems(p.userID)
+	return result, nil
+}
+
+// get the record of a draw
+func (d dbClient) gachaDraw(ctx context.Context, w io.Writer, userID, drawID string) (drawResult, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "gachaDraw")
+	defer span.End()
+
+	columns := []string{"draw_id", "drop_table_id", "table_hash", "seed", "pity_before", "cost", "results", "created_at"}
+	row, err := d.sc.Single().ReadRow(ctx, "gacha_draws", spanner.Key{userID, drawID}, columns)
+	if spanner.ErrCode(err) == codes.NotFound {
+		return drawResult{}, errDrawNotFound
+	}
+	if err != nil {
+		return drawResult{}, err
+	}
+
+	var result drawResult
+	var results spanner.NullJSON
+	if err := row.Columns(&result.DrawID, &result.DropTableID, &result.TableHash, &result.Seed, &result.PityBefore, &result.Cost, &results, &result.CreatedAt); err != nil {
+		return drawResult{}, err
+	}
+	b, err := json.Marshal(results.Value)
+	if err != nil {
+		return drawResult{}, err
+	}
+	if err := json.Unmarshal(b, &result.Results); err != nil {
+		return drawResult{}, err
+	}
+	return result, nil
+}
+
+func (s Serving) getDropTableOdds(w http.ResponseWriter, r *http.Request) {
+	dropTableID := chi.URLParam(r, "drop_table_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "getDropTableOdds.root")
+	span.SetAttributes(attribute.String("server", "getDropTableOdds"))
+	defer span.End()
+
+	odds, err := s.Client.dropTableOdds(ctx, w, dropTableID)
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+	render.JSON(w, r, odds)
+}
+
+func (s Serving) drawGacha(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "drawGacha.root")
+	span.SetAttributes(attribute.String("server", "drawGacha"))
+	defer span.End()
+
+	var body struct {
+		DropTableID string `json:"drop_table_id"`
+		Count       int    `json:"count"`
+	}
+	if err := render.DecodeJSON(r.Body, &body); err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if body.Count == 0 {
+		body.Count = 1
+	}
+	if body.Count < 1 || body.Count > maxDrawCount {
+		errorRender(w, r, http.StatusBadRequest, fmt.Errorf("count must be between 1 and %d", maxDrawCount))
+		return
+	}
+
+	result, err := s.Client.drawGacha(ctx, w, drawParams{userID: userID, dropTableID: body.DropTableID, count: body.Count})
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+
+	publishEvent("gacha.drawn", map[string]interface{}{
+		"id":            userID,
+		"draw_id":       result.DrawID,
+		"drop_table_id": result.DropTableID,
+		"cost":          result.Cost,
+	})
+
+	render.JSON(w, r, result)
+}
+
+func (s Serving) getGachaDraw(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	drawID := chi.URLParam(r, "draw_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "getGachaDraw.root")
+	span.SetAttributes(attribute.String("server", "getGachaDraw"))
+	defer span.End()
+
+	result, err := s.Client.gachaDraw(ctx, w, userID, drawID)
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+	render.JSON(w, r, result)
+}
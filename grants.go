@@ -0,0 +1,286 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/go-chi/render"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	grantGranted      = "granted"
+	grantAlreadyOwned = "already_owned"
+	grantUnknownItem  = "unknown_item"
+	grantUnknownUser  = "unknown_user"
+	grantBannedUser   = "banned_user"
+)
+
+const (
+	// mutations in a commit are kept within this, Spanner counts every column and index entry written
+	maxCommitMutations = 40000
+	// a grant writes 6 columns of user_items and up to 3 index entries with the foreign key,
+	// and an audit log of 10 columns with an index entry when the user is different from the others
+	grantMutations = 6 + 3 + 10 + 1
+)
+
+var (
+	// grants in a transaction
+	grantChunkSize = maxCommitMutations / grantMutations
+	maxGrants      = 5000
+)
+
+type grantParams struct {
+	userID string
+	itemID string
+	// the item is time-limited if it's not zero
+	expiresAt time.Time
+}
+
+type userItemKey struct {
+	userID string
+	itemID string
+}
+
+type grantResult struct {
+	UserID string `json:"user_id"`
+	ItemID string `json:"item_id"`
+	Status string `json:"status"`
+}
+
+// grantItemsInTxn checks the users, the items and what the users have already,
+// then buffers inserts of user_items for the grants that can be applied.
+// Every path that gives items to users goes through this.
+func grantItemsInTxn(ctx context.Context, txn *spanner.ReadWriteTransaction, grants []grantParams) ([]grantResult, error) {
+
+	userIDs := map[string]bool{}
+	bannedIDs := map[string]bool{}
+	itemIDs := map[string]bool{}
+	keys := make([]spanner.KeySet, 0, len(grants))
+	for _, g := range grants {
+		userIDs[g.userID] = false
+		bannedIDs[g.userID] = false
+		itemIDs[g.itemID] = false
+		keys = append(keys, spanner.Key{g.userID, g.itemID})
+	}
+
+	if err := markExisting(ctx, txn, "SELECT user_id FROM users WHERE user_id IN UNNEST(@ids) AND deleted_at IS NULL", userIDs); err != nil {
+		return nil, err
+	}
+	if err := markExisting(ctx, txn, bannedUsersSQL, bannedIDs); err != nil {
+		return nil, err
+	}
+	if err := markExisting(ctx, txn, "SELECT item_id FROM items WHERE item_id IN UNNEST(@ids)", itemIDs); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	// expired items that the reaper has not deleted yet and soft deleted items are replaced
+	owned := map[userItemKey]bool{}
+	iter := txn.Read(ctx, "user_items", spanner.KeySets(keys...), []string{"user_id", "item_id", "expires_at", "deleted_at"})
+	err := iter.Do(func(row *spanner.Row) error {
+		var k userItemKey
+		var expiresAt, deletedAt spanner.NullTime
+		if err := row.Columns(&k.userID, &k.itemID, &expiresAt, &deletedAt); err != nil {
+			return err
+		}
+		if !(expiresAt.Valid && !expiresAt.Time.After(now) || deletedAt.Valid) {
+			owned[k] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]grantResult, 0, len(grants))
+	mutations := make([]*spanner.Mutation, 0, len(grants))
+	// granted item ids by user, in the order of grants
+	granted := map[string][]string{}
+	grantedUsers := []string{}
+	for _, g := range grants {
+		k := userItemKey{userID: g.userID, itemID: g.itemID}
+		result := grantResult{UserID: g.userID, ItemID: g.itemID}
+		switch {
+		case !userIDs[g.userID]:
+			result.Status = grantUnknownUser
+		case bannedIDs[g.userID]:
+			result.Status = grantBannedUser
+		case !itemIDs[g.itemID]:
+			result.Status = grantUnknownItem
+		case owned[k]:
+			result.Status = grantAlreadyOwned
+		default:
+			result.Status = grantGranted
+			// the same grant later in the list is already owned
+			owned[k] = true
+			expiresAt := spanner.NullTime{Time: g.expiresAt, Valid: !g.expiresAt.IsZero()}
+			mutations = append(mutations, spanner.InsertOrUpdate("user_items",
+				[]string{"user_id", "item_id", "expires_at", "deleted_at", "created_at", "updated_at"},
+				[]interface{}{g.userID, g.itemID, expiresAt, spanner.NullTime{}, spanner.CommitTimestamp, spanner.CommitTimestamp},
+			))
+			if _, ok := granted[g.userID]; !ok {
+				grantedUsers = append(grantedUsers, g.userID)
+			}
+			granted[g.userID] = append(granted[g.userID], g.itemID)
+		}
+		results = append(results, result)
+	}
+	for _, userID := range grantedUsers {
+		mutations = append(mutations, auditMutation(ctx, "items.granted", userID, "", nil, map[string]interface{}{"item_ids": granted[userID]}))
+	}
+
+	if err := txn.BufferWrite(mutations); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// set true to the ids found by the query
+func markExisting(ctx context.Context, txn *spanner.ReadWriteTransaction, sql string, ids map[string]bool) error {
+	list := make([]string, 0, len(ids))
+	for id := range ids {
+		list = append(list, id)
+	}
+	iter := txn.Query(ctx, spanner.Statement{SQL: sql, Params: map[string]interface{}{"ids": list}})
+	defer iter.Stop()
+	for {
+		row, err := iter.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var id string
+		if err := row.Columns(&id); err != nil {
+			return err
+		}
+		ids[id] = true
+	}
+}
+
+// grant items to users in chunks, each chunk is applied in a transaction
+func (d dbClient) grantItems(ctx context.Context, w io.Writer, grants []grantParams) ([]grantResult, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "grantItems")
+	defer span.End()
+
+	results := make([]grantResult, 0, len(grants))
+	affected := map[string]bool{}
+	for start := 0; start < len(grants); start += grantChunkSize {
+		end := start + grantChunkSize
+		if end > len(grants) {
+			end = len(grants)
+		}
+
+		var chunkResults []grantResult
+		_, err := d.sc.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+			var err error
+			chunkResults, err = grantItemsInTxn(ctx, txn, grants[start:end])
+			return err
+		})
+		if err != nil {
+			// the chunks committed already are not rolled back
+			d.invalidateAffected(affected)
+			return results, err
+		}
+		for _, r := range chunkResults {
+			if r.Status == grantGranted {
+				affected[r.UserID] = true
+			}
+		}
+		results = append(results, chunkResults...)
+	}
+
+	d.invalidateAffected(affected)
+	return results, nil
+}
+
+func (d dbClient) invalidateAffected(userIDs map[string]bool) {
+	for userID := range userIDs {
+		d.invalidateUserItems(userID)
+	}
+}
+
+type grantItemsRequest struct {
+	Grants []struct {
+		UserID    string     `json:"user_id"`
+		ItemID    string     `json:"item_id"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	} `json:"grants"`
+}
+
+func (s Serving) grantItems(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "grantItems.root")
+	span.SetAttributes(attribute.String("server", "grantItems"))
+	defer span.End()
+
+	var body grantItemsRequest
+	if err := render.DecodeJSON(r.Body, &body); err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if len(body.Grants) == 0 || len(body.Grants) > maxGrants {
+		errorRender(w, r, http.StatusBadRequest, fmt.Errorf("grants must have 1 to %d entries", maxGrants))
+		return
+	}
+
+	grants := make([]grantParams, 0, len(body.Grants))
+	for i, g := range body.Grants {
+		if g.UserID == "" || g.ItemID == "" {
+			errorRender(w, r, http.StatusBadRequest, fmt.Errorf("grants[%d]: user_id and item_id are required", i))
+			return
+		}
+		grant := grantParams{userID: g.UserID, itemID: g.ItemID}
+		if g.ExpiresAt != nil {
+			if !g.ExpiresAt.After(time.Now()) {
+				errorRender(w, r, http.StatusBadRequest, fmt.Errorf("grants[%d]: expires_at must be in the future", i))
+				return
+			}
+			grant.expiresAt = *g.ExpiresAt
+		}
+		grants = append(grants, grant)
+	}
+
+	results, err := s.Client.grantItems(ctx, w, grants)
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+
+	granted := map[string][]string{}
+	for _, r := range results {
+		if r.Status == grantGranted {
+			granted[r.UserID] = append(granted[r.UserID], r.ItemID)
+		}
+	}
+	for userID, itemIDs := range granted {
+		publishEvent("items.granted", map[string]interface{}{"id": userID, "items": itemIDs})
+	}
+
+	render.JSON(w, r, map[string]interface{}{"results": results})
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/google/uuid"
+	"github.com/shin5ok/egg-architecting/gamepb"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcServing serves the same operations as Serving over gRPC
+type grpcServing struct {
+	gamepb.UnimplementedGameServiceServer
+	Client GameUserOperation
+}
+
+func newGRPCServer(client GameUserOperation, limiter *rateLimiter, apiLimit rateLimit) *grpc.Server {
+	s := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(
+			otelgrpc.UnaryServerInterceptor(),
+			grpcRecoverer,
+			grpcAuth,
+			grpcRateLimit(limiter, apiLimit),
+			grpcAuditActor,
+			grpcBanCheck(client),
+		),
+	)
+	gamepb.RegisterGameServiceServer(s, grpcServing{Client: client})
+	return s
+}
+
+func serveGRPC(addr string, client GameUserOperation, cache *redis.Client) error {
+	apiLimit, err := loadRateLimit("api")
+	if err != nil {
+		return err
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Println("gRPC server is listening on", addr)
+	return newGRPCServer(client, newRateLimiter(cache), apiLimit).Serve(lis)
+}
+
+// grpcRecoverer is the same as middleware.Recoverer, a panic is logged and returned as INTERNAL
+func grpcRecoverer(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (res interface{}, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("panic in %s: %v\n%s", info.FullMethod, p, debug.Stack())
+			err = status.Error(codes.Internal, http.StatusText(http.StatusInternalServerError))
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// grpcRateLimit takes the tokens from the same buckets as the api group of HTTP, so that a client has one limit for both
+func grpcRateLimit(limiter *rateLimiter, limit rateLimit) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		header := func(name string) string {
+			if values := md.Get(name); len(values) > 0 {
+				return values[0]
+			}
+			return ""
+		}
+		remoteAddr := ""
+		if p, ok := peer.FromContext(ctx); ok {
+			remoteAddr = p.Addr.String()
+		}
+
+		allowed, tokens := limiter.take(fmt.Sprintf("rateLimit_api_%s", clientKey(header, remoteAddr)), limit)
+		if !allowed {
+			retryAfter := math.Ceil((1 - tokens) / limit.rate)
+			return nil, status.Errorf(codes.ResourceExhausted, "too many requests, retry after %d seconds", int(retryAfter))
+		}
+		return handler(ctx, req)
+	}
+}
+
+// grpcAuth is the same check as headerAuth, the header is passed as metadata
+func grpcAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if authHeaderName != "" {
+		md, _ := metadata.FromIncomingContext(ctx)
+		values := md.Get(strings.ToLower(authHeaderName))
+		if len(values) == 0 || values[0] == "" {
+			log.Printf("Forbidden request info: %s", info.FullMethod)
+			return nil, status.Error(codes.PermissionDenied, "You're NOT permitted to enter here")
+		}
+	}
+	return handler(ctx, req)
+}
+
+// grpcBanCheck is the same check as banCheck, for the requests with user_id
+func grpcBanCheck(client GameUserOperation) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		r, ok := req.(interface{ GetUserId() string })
+		if !ok || r.GetUserId() == "" {
+			return handler(ctx, req)
+		}
+		b, err := client.activeBan(ctx, io.Discard, r.GetUserId())
+		if err != nil {
+			return nil, grpcError(err)
+		}
+		if b != nil {
+			return nil, status.Errorf(codes.PermissionDenied, "%s: %s", errUserBanned, b.Reason)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// grpcError converts errors to gRPC status, following the http status errorStatus returns
+func grpcError(err error) error {
+	code := codes.Internal
+	switch errorStatus(err) {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusConflict:
+		code = codes.AlreadyExists
+	case http.StatusGone:
+		code = codes.FailedPrecondition
+	}
+	return status.Error(code, err.Error())
+}
+
+func (g grpcServing) CreateUser(ctx context.Context, req *gamepb.CreateUserRequest) (*gamepb.User, error) {
+	body := createUserRequest{
+		Name:     req.GetName(),
+		Locale:   req.GetLocale(),
+		Country:  req.GetCountry(),
+		Platform: req.GetPlatform(),
+		Timezone: req.GetTimezone(),
+	}
+	if err := body.validate(); err != nil {
+		return nil, grpcError(err)
+	}
+
+	userID := uuid.NewString()
+	err := g.Client.createUser(ctx, io.Discard, userParams{
+		userID:   userID,
+		userName: body.Name,
+		locale:   body.Locale,
+		country:  body.Country,
+		platform: body.Platform,
+		timezone: body.Timezone,
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &gamepb.User{
+		Id:       userID,
+		Name:     body.Name,
+		Locale:   body.Locale,
+		Country:  body.Country,
+		Platform: body.Platform,
+		Timezone: body.Timezone,
+	}, nil
+}
+
+func (g grpcServing) AddItemToUser(ctx context.Context, req *gamepb.AddItemToUserRequest) (*gamepb.AddItemToUserResponse, error) {
+	if req.GetUserId() == "" || req.GetItemId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "user_id and item_id are required")
+	}
+
+	err := g.Client.addItemToUser(ctx, io.Discard, userParams{userID: req.GetUserId()}, itemParams{itemID: req.GetItemId()})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	publishEvent("items.granted", map[string]interface{}{"id": req.GetUserId(), "items": []string{req.GetItemId()}})
+	return &gamepb.AddItemToUserResponse{}, nil
+}
+
+func (g grpcServing) ListUserItems(ctx context.Context, req *gamepb.ListUserItemsRequest) (*gamepb.ListUserItemsResponse, error) {
+	page, err := newPageParams(int(req.GetPageSize()), req.GetSort(), req.GetOrder(), req.GetPageToken())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	results, err := g.Client.userItems(ctx, io.Discard, req.GetUserId(), page)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	res := &gamepb.ListUserItemsResponse{
+		Items:         make([]*gamepb.Item, 0, len(results.Items)),
+		NextPageToken: results.NextCursor,
+	}
+	for _, item := range results.Items {
+		userName, _ := item["user_name"].(string)
+		itemName, _ := item["item_name"].(string)
+		itemID, _ := item["item_id"].(string)
+		res.Items = append(res.Items, &gamepb.Item{
+			UserName:  userName,
+			ItemName:  itemName,
+			ItemId:    itemID,
+			CreatedAt: itemTimestamp(item["created_at"]),
+			UpdatedAt: itemTimestamp(item["updated_at"]),
+		})
+	}
+	return res, nil
+}
+
+// itemTimestamp converts the time of the item, it's a string when the page is from the cache
+func itemTimestamp(v interface{}) *timestamppb.Timestamp {
+	switch v := v.(type) {
+	case time.Time:
+		return timestamppb.New(v)
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return timestamppb.New(t)
+		}
+	}
+	return nil
+}
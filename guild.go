@@ -0,0 +1,776 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"cloud.google.com/go/spanner"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+)
+
+type guildOperation interface {
+	createGuild(context.Context, io.Writer, guildParams) (guild, error)
+	guild(context.Context, io.Writer, string) (guild, error)
+	changeGuildMember(context.Context, io.Writer, guildParams) (string, error)
+	moveGuildItems(context.Context, io.Writer, guildParams) error
+}
+
+const (
+	guildRoleLeader  = "leader"
+	guildRoleOfficer = "officer"
+	guildRoleMember  = "member"
+)
+
+// a user can do what the lower roles can do
+var guildRoleRank = map[string]int{
+	guildRoleMember:  1,
+	guildRoleOfficer: 2,
+	guildRoleLeader:  3,
+}
+
+const (
+	guildActionJoin     = "join"
+	guildActionLeave    = "leave"
+	guildActionInvite   = "invite"
+	guildActionKick     = "kick"
+	guildActionRole     = "role"
+	guildActionDeposit  = "deposit"
+	guildActionWithdraw = "withdraw"
+)
+
+// kind of guild_requests, who asked for the membership
+const (
+	guildRequestByUser  = "request"
+	guildRequestByGuild = "invite"
+)
+
+var (
+	errGuildNotFound     = errors.New("guild not found")
+	errNotGuildMember    = errors.New("the user is not a member of the guild")
+	errAlreadyInGuild    = errors.New("the user is in a guild already")
+	errGuildPermission   = errors.New("the role of the user is not permitted to do it")
+	errGuildFull         = errors.New("the guild has no room for members")
+	errGuildItemNotFound = errors.New("the guild doesn't have the item")
+	errItemTimeLimited   = errors.New("time-limited items can't be deposited")
+	errGuildHasItems     = errors.New("the last member can't leave the guild with items, withdraw them first")
+)
+
+// how many members a new guild can have
+var guildMaxMembers = func() int64 {
+	n, err := strconv.ParseInt(os.Getenv("GUILD_MAX_MEMBERS"), 10, 64)
+	if err != nil || n <= 0 {
+		return 30
+	}
+	return n
+}()
+
+type guildParams struct {
+	guildID string
+	// who does the action
+	userID      string
+	memberID    string
+	role        string
+	action      string
+	name        string
+	description string
+	itemIDs     []string
+}
+
+type guildMember struct {
+	UserID   string    `json:"user_id"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+type guildRequest struct {
+	UserID    string    `json:"user_id"`
+	Kind      string    `json:"kind"`
+	InvitedBy string    `json:"invited_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type guildItem struct {
+	ItemID   string `json:"item_id"`
+	Quantity int64  `json:"quantity"`
+}
+
+type guild struct {
+	GuildID     string         `json:"guild_id"`
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	MaxMembers  int64          `json:"max_members"`
+	Members     []guildMember  `json:"members"`
+	Requests    []guildRequest `json:"requests"`
+	Items       []guildItem    `json:"items"`
+	CreatedAt   time.Time      `json:"created_at"`
+}
+
+func readGuild(ctx context.Context, txn spannerReader, guildID string) (guild, error) {
+	row, err := txn.ReadRow(ctx, "guilds", spanner.Key{guildID}, []string{"name", "description", "max_members", "created_at"})
+	if spanner.ErrCode(err) == codes.NotFound {
+		return guild{}, errGuildNotFound
+	}
+	if err != nil {
+		return guild{}, err
+	}
+	g := guild{GuildID: guildID}
+	var description spanner.NullString
+	if err := row.Columns(&g.Name, &description, &g.MaxMembers, &g.CreatedAt); err != nil {
+		return guild{}, err
+	}
+	g.Description = description.StringVal
+	return g, nil
+}
+
+// guildRoleInTxn returns empty string if the user is not a member
+func guildRoleInTxn(ctx context.Context, txn *spanner.ReadWriteTransaction, guildID, userID string) (string, error) {
+	row, err := txn.ReadRow(ctx, "guild_members", spanner.Key{guildID, userID}, []string{"role"})
+	if spanner.ErrCode(err) == codes.NotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var role string
+	err = row.Columns(&role)
+	return role, err
+}
+
+// userGuildInTxn returns the guild the user is in, or empty string
+func userGuildInTxn(ctx context.Context, txn *spanner.ReadWriteTransaction, userID string) (string, error) {
+	stmt := spanner.Statement{
+		SQL:    "SELECT guild_id FROM guild_members@{FORCE_INDEX=guild_members_by_user_id} WHERE user_id = @userID",
+		Params: map[string]interface{}{"userID": userID},
+	}
+	iter := txn.Query(ctx, stmt)
+	defer iter.Stop()
+	row, err := iter.Next()
+	if err == iterator.Done {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var guildID string
+	err = row.Columns(&guildID)
+	return guildID, err
+}
+
+// joinGuildInTxn adds the user as a member, the request or the invitation is deleted
+func joinGuildInTxn(ctx context.Context, txn *spanner.ReadWriteTransaction, g guild, userID string, now time.Time) error {
+	var count int64
+	stmt := spanner.Statement{
+		SQL:    "SELECT COUNT(*) FROM guild_members WHERE guild_id = @guildID",
+		Params: map[string]interface{}{"guildID": g.GuildID},
+	}
+	err := txn.Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		return row.Columns(&count)
+	})
+	if err != nil {
+		return err
+	}
+	if count >= g.MaxMembers {
+		return errGuildFull
+	}
+	return txn.BufferWrite([]*spanner.Mutation{
+		spanner.Delete("guild_requests", spanner.Key{g.GuildID, userID}),
+		spanner.Insert("guild_members", []string{"guild_id", "user_id", "role", "joined_at"}, []interface{}{g.GuildID, userID, guildRoleMember, now}),
+		auditMutation(ctx, "guild.joined", userID, g.GuildID, nil, map[string]interface{}{"role": guildRoleMember}),
+	})
+}
+
+// leaveGuildInTxn removes the member. When the leader leaves, an officer, or a member if there's no officer,
+// who joined first becomes the leader. The guild is deleted when the last member leaves, and it's refused
+// while the guild has items, unless the user is being erased. Then the items are recorded in the audit log.
+func leaveGuildInTxn(ctx context.Context, txn *spanner.ReadWriteTransaction, guildID, userID, role string, erasing bool) error {
+	mutations := []*spanner.Mutation{
+		spanner.Delete("guild_members", spanner.Key{guildID, userID}),
+		auditMutation(ctx, "guild.left", userID, guildID, map[string]interface{}{"role": role}, nil),
+	}
+	if role != guildRoleLeader {
+		return txn.BufferWrite(mutations)
+	}
+
+	stmt := spanner.Statement{
+		SQL: `SELECT user_id, role FROM guild_members WHERE guild_id = @guildID AND user_id != @userID
+		  ORDER BY CASE role WHEN 'officer' THEN 0 ELSE 1 END, joined_at LIMIT 1`,
+		Params: map[string]interface{}{"guildID": guildID, "userID": userID},
+	}
+	successor, successorRole := "", ""
+	err := txn.Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		return row.Columns(&successor, &successorRole)
+	})
+	if err != nil {
+		return err
+	}
+	if successor != "" {
+		mutations = append(mutations,
+			spanner.Update("guild_members", []string{"guild_id", "user_id", "role"}, []interface{}{guildID, successor, guildRoleLeader}),
+			auditMutation(ctx, "guild.role_changed", successor, guildID, map[string]interface{}{"role": successorRole}, map[string]interface{}{"role": guildRoleLeader}),
+		)
+		return txn.BufferWrite(mutations)
+	}
+
+	// guild_items are deleted with the guild
+	items := map[string]int64{}
+	err = txn.Read(ctx, "guild_items", spanner.Key{guildID}.AsPrefix(), []string{"item_id", "quantity"}).Do(func(row *spanner.Row) error {
+		var id string
+		var quantity int64
+		if err := row.Columns(&id, &quantity); err != nil {
+			return err
+		}
+		items[id] = quantity
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(items) > 0 && !erasing {
+		return errGuildHasItems
+	}
+	return txn.BufferWrite(append(mutations,
+		spanner.Delete("guilds", spanner.Key{guildID}),
+		auditMutation(ctx, "guild.deleted", userID, guildID, map[string]interface{}{"items": items}, nil),
+	))
+}
+
+// leaveGuildsInTxn takes the user out of the guild and cancels the requests, before the user is deleted.
+// Only an erasure deletes the guild with items, a soft delete is refused as leaving it is.
+func leaveGuildsInTxn(ctx context.Context, txn *spanner.ReadWriteTransaction, userID string, erasing bool) error {
+	guildID, err := userGuildInTxn(ctx, txn, userID)
+	if err != nil {
+		return err
+	}
+	if guildID != "" {
+		role, err := guildRoleInTxn(ctx, txn, guildID, userID)
+		if err != nil {
+			return err
+		}
+		if err := leaveGuildInTxn(ctx, txn, guildID, userID, role, erasing); err != nil {
+			return err
+		}
+	}
+	_, err = txn.Update(ctx, spanner.Statement{
+		SQL:    "DELETE FROM guild_requests WHERE user_id = @userID",
+		Params: map[string]interface{}{"userID": userID},
+	})
+	return err
+}
+
+// create a guild, the user becomes its leader
+func (d dbClient) createGuild(ctx context.Context, w io.Writer, p guildParams) (guild, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "createGuild")
+	defer span.End()
+
+	now := time.Now()
+	g := guild{
+		GuildID:     uuid.NewString(),
+		Name:        p.name,
+		Description: p.description,
+		MaxMembers:  guildMaxMembers,
+		Members:     []guildMember{{UserID: p.userID, Role: guildRoleLeader, JoinedAt: now}},
+		Requests:    []guildRequest{},
+		Items:       []guildItem{},
+		CreatedAt:   now,
+	}
+	_, err := d.sc.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		if err := userExistsInTxn(ctx, txn, p.userID); err != nil {
+			return err
+		}
+		current, err := userGuildInTxn(ctx, txn, p.userID)
+		if err != nil {
+			return err
+		}
+		if current != "" {
+			return errAlreadyInGuild
+		}
+		return txn.BufferWrite([]*spanner.Mutation{
+			spanner.Insert("guilds",
+				[]string{"guild_id", "name", "description", "max_members", "created_at", "updated_at"},
+				[]interface{}{g.GuildID, g.Name, nullString(g.Description), g.MaxMembers, now, now},
+			),
+			spanner.Insert("guild_members",
+				[]string{"guild_id", "user_id", "role", "joined_at"},
+				[]interface{}{g.GuildID, p.userID, guildRoleLeader, now},
+			),
+		})
+	})
+	if spanner.ErrCode(err) == codes.AlreadyExists {
+		return guild{}, errAlreadyInGuild
+	}
+	return g, err
+}
+
+// get the guild with its members, pending requests and items
+func (d dbClient) guild(ctx context.Context, w io.Writer, guildID string) (guild, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "guild")
+	defer span.End()
+
+	txn := d.sc.ReadOnlyTransaction()
+	defer txn.Close()
+
+	g, err := readGuild(ctx, txn, guildID)
+	if err != nil {
+		return guild{}, err
+	}
+
+	g.Members = []guildMember{}
+	err = txn.Read(ctx, "guild_members", spanner.Key{guildID}.AsPrefix(), []string{"user_id", "role", "joined_at"}).Do(func(row *spanner.Row) error {
+		var m guildMember
+		if err := row.Columns(&m.UserID, &m.Role, &m.JoinedAt); err != nil {
+			return err
+		}
+		g.Members = append(g.Members, m)
+		return nil
+	})
+	if err != nil {
+		return guild{}, err
+	}
+
+	g.Requests = []guildRequest{}
+	err = txn.Read(ctx, "guild_requests", spanner.Key{guildID}.AsPrefix(), []string{"user_id", "kind", "invited_by", "created_at"}).Do(func(row *spanner.Row) error {
+		var r guildRequest
+		var invitedBy spanner.NullString
+		if err := row.Columns(&r.UserID, &r.Kind, &invitedBy, &r.CreatedAt); err != nil {
+			return err
+		}
+		r.InvitedBy = invitedBy.StringVal
+		g.Requests = append(g.Requests, r)
+		return nil
+	})
+	if err != nil {
+		return guild{}, err
+	}
+
+	g.Items = []guildItem{}
+	err = txn.Read(ctx, "guild_items", spanner.Key{guildID}.AsPrefix(), []string{"item_id", "quantity"}).Do(func(row *spanner.Row) error {
+		var i guildItem
+		if err := row.Columns(&i.ItemID, &i.Quantity); err != nil {
+			return err
+		}
+		g.Items = append(g.Items, i)
+		return nil
+	})
+	if err != nil {
+		return guild{}, err
+	}
+	return g, nil
+}
+
+// change the membership by the action, and return the status of the member after it.
+// A user joins when both of the user and an officer or the leader ask for it, by join and invite.
+func (d dbClient) changeGuildMember(ctx context.Context, w io.Writer, p guildParams) (string, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "changeGuildMember")
+	defer span.End()
+
+	var status string
+	_, err := d.sc.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		now := time.Now()
+		g, err := readGuild(ctx, txn, p.guildID)
+		if err != nil {
+			return err
+		}
+		role, err := guildRoleInTxn(ctx, txn, p.guildID, p.userID)
+		if err != nil {
+			return err
+		}
+
+		// the member the action is done to
+		target := p.memberID
+		if p.action == guildActionJoin || p.action == guildActionLeave {
+			target = p.userID
+		}
+		if err := userExistsInTxn(ctx, txn, target); err != nil {
+			return err
+		}
+		targetRole, err := guildRoleInTxn(ctx, txn, p.guildID, target)
+		if err != nil {
+			return err
+		}
+
+		switch p.action {
+		case guildActionJoin, guildActionInvite:
+			if p.action == guildActionInvite && guildRoleRank[role] < guildRoleRank[guildRoleOfficer] {
+				return errGuildPermission
+			}
+			current, err := userGuildInTxn(ctx, txn, target)
+			if err != nil {
+				return err
+			}
+			if current != "" {
+				return errAlreadyInGuild
+			}
+
+			kind := guildRequestByUser
+			invitedBy := spanner.NullString{}
+			if p.action == guildActionInvite {
+				kind = guildRequestByGuild
+				invitedBy = spanner.NullString{StringVal: p.userID, Valid: true}
+			}
+			row, err := txn.ReadRow(ctx, "guild_requests", spanner.Key{p.guildID, target}, []string{"kind"})
+			if err != nil && spanner.ErrCode(err) != codes.NotFound {
+				return err
+			}
+			if err == nil {
+				var existing string
+				if err := row.Columns(&existing); err != nil {
+					return err
+				}
+				// the other side has asked already
+				if existing != kind {
+					status = guildRoleMember
+					return joinGuildInTxn(ctx, txn, g, target, now)
+				}
+			}
+
+			status = kind
+			return txn.BufferWrite([]*spanner.Mutation{
+				spanner.InsertOrUpdate("guild_requests",
+					[]string{"guild_id", "user_id", "kind", "invited_by", "created_at"},
+					[]interface{}{p.guildID, target, kind, invitedBy, now},
+				),
+			})
+		case guildActionLeave:
+			if role == "" {
+				return errNotGuildMember
+			}
+			status = "left"
+			return leaveGuildInTxn(ctx, txn, p.guildID, p.userID, role, false)
+		case guildActionKick:
+			if targetRole == "" {
+				return errNotGuildMember
+			}
+			// officers can kick members, the leader can kick officers too
+			if guildRoleRank[role] < guildRoleRank[guildRoleOfficer] || guildRoleRank[role] <= guildRoleRank[targetRole] {
+				return errGuildPermission
+			}
+			status = "kicked"
+			return txn.BufferWrite([]*spanner.Mutation{
+				spanner.Delete("guild_members", spanner.Key{p.guildID, target}),
+				auditMutation(ctx, "guild.kicked", target, p.guildID, map[string]interface{}{"role": targetRole}, map[string]interface{}{"kicked_by": p.userID}),
+			})
+		case guildActionRole:
+			if _, ok := guildRoleRank[p.role]; !ok {
+				return validationError{"role": "must be one of leader, officer or member"}
+			}
+			if role != guildRoleLeader || target == p.userID {
+				return errGuildPermission
+			}
+			if targetRole == "" {
+				return errNotGuildMember
+			}
+			columns := []string{"guild_id", "user_id", "role"}
+			mutations := []*spanner.Mutation{
+				spanner.Update("guild_members", columns, []interface{}{p.guildID, target, p.role}),
+				auditMutation(ctx, "guild.role_changed", target, p.guildID, map[string]interface{}{"role": targetRole}, map[string]interface{}{"role": p.role}),
+			}
+			// the leadership is handed over
+			if p.role == guildRoleLeader {
+				mutations = append(mutations,
+					spanner.Update("guild_members", columns, []interface{}{p.guildID, p.userID, guildRoleOfficer}),
+					auditMutation(ctx, "guild.role_changed", p.userID, p.guildID, map[string]interface{}{"role": guildRoleLeader}, map[string]interface{}{"role": guildRoleOfficer}),
+				)
+			}
+			status = p.role
+			return txn.BufferWrite(mutations)
+		}
+		return validationError{"action": "unknown action " + p.action}
+	})
+	// the unique index of guild_members, the user has joined another guild at the same time
+	if spanner.ErrCode(err) == codes.AlreadyExists {
+		return "", errAlreadyInGuild
+	}
+	return status, err
+}
+
+// deposit moves the user's items to the guild, and withdraw moves them back.
+// Any member can deposit, and officers and the leader can withdraw.
+func (d dbClient) moveGuildItems(ctx context.Context, w io.Writer, p guildParams) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "moveGuildItems")
+	defer span.End()
+
+	userKeys := make([]spanner.KeySet, 0, len(p.itemIDs))
+	guildKeys := make([]spanner.KeySet, 0, len(p.itemIDs))
+	for _, id := range p.itemIDs {
+		userKeys = append(userKeys, spanner.Key{p.userID, id})
+		guildKeys = append(guildKeys, spanner.Key{p.guildID, id})
+	}
+
+	_, err := d.sc.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		now := time.Now()
+		if _, err := readGuild(ctx, txn, p.guildID); err != nil {
+			return err
+		}
+		role, err := guildRoleInTxn(ctx, txn, p.guildID, p.userID)
+		if err != nil {
+			return err
+		}
+		if role == "" {
+			return errNotGuildMember
+		}
+		if p.action == guildActionWithdraw && guildRoleRank[role] < guildRoleRank[guildRoleOfficer] {
+			return errGuildPermission
+		}
+
+		quantities := map[string]int64{}
+		err = txn.Read(ctx, "guild_items", spanner.KeySets(guildKeys...), []string{"item_id", "quantity"}).Do(func(row *spanner.Row) error {
+			var id string
+			var quantity int64
+			if err := row.Columns(&id, &quantity); err != nil {
+				return err
+			}
+			quantities[id] = quantity
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// items the user has, expired or soft deleted ones are not counted
+		owned := map[string]bool{}
+		var limited []string
+		err = txn.Read(ctx, "user_items", spanner.KeySets(userKeys...), []string{"item_id", "expires_at", "deleted_at"}).Do(func(row *spanner.Row) error {
+			var id string
+			var expiresAt, deletedAt spanner.NullTime
+			if err := row.Columns(&id, &expiresAt, &deletedAt); err != nil {
+				return err
+			}
+			if deletedAt.Valid {
+				return nil
+			}
+			if !expiresAt.Valid {
+				owned[id] = true
+			} else if expiresAt.Time.After(now) {
+				owned[id] = true
+				limited = append(limited, id)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		columns := []string{"guild_id", "item_id", "quantity", "updated_at"}
+		mutations := []*spanner.Mutation{}
+		switch p.action {
+		case guildActionDeposit:
+			if len(owned) != len(p.itemIDs) {
+				return errNotOwned
+			}
+			if len(limited) > 0 {
+				return fmt.Errorf("%w: %v", errItemTimeLimited, limited)
+			}
+			for _, id := range p.itemIDs {
+				mutations = append(mutations,
+					spanner.Delete("user_items", spanner.Key{p.userID, id}),
+					spanner.InsertOrUpdate("guild_items", columns, []interface{}{p.guildID, id, quantities[id] + 1, now}),
+				)
+			}
+		case guildActionWithdraw:
+			for _, id := range p.itemIDs {
+				if quantities[id] == 0 {
+					return fmt.Errorf("%w: %s", errGuildItemNotFound, id)
+				}
+				if owned[id] {
+					return fmt.Errorf("%w: %s", errAlreadyOwned, id)
+				}
+				if quantities[id] == 1 {
+					mutations = append(mutations, spanner.Delete("guild_items", spanner.Key{p.guildID, id}))
+				} else {
+					mutations = append(mutations, spanner.Update("guild_items", columns, []interface{}{p.guildID, id, quantities[id] - 1, now}))
+				}
+				mutations = append(mutations, spanner.InsertOrUpdate("user_items",
+					[]string{"user_id", "item_id", "expires_at", "deleted_at", "created_at", "updated_at"},
+					[]interface{}{p.userID, id, spanner.NullTime{}, spanner.NullTime{}, spanner.CommitTimestamp, spanner.CommitTimestamp},
+				))
+			}
+		default:
+			return validationError{"action": "unknown action " + p.action}
+		}
+		mutations = append(mutations, auditMutation(ctx, "guild.items_"+p.action, p.userID, p.guildID, nil, map[string]interface{}{"item_ids": p.itemIDs}))
+		return txn.BufferWrite(mutations)
+	})
+	if err != nil {
+		return err
+	}
+
+	d.invalidateUserItems(p.userID)
+	return nil
+}
+
+func (s Serving) createGuild(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "createGuild.root")
+	span.SetAttributes(attribute.String("server", "createGuild"))
+	defer span.End()
+
+	var body struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+	if err := render.DecodeJSON(r.Body, &body); err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	invalid := validationError{}
+	if n := utf8.RuneCountInString(body.Name); n == 0 || n > 64 {
+		invalid["name"] = "must be 1 to 64 characters"
+	}
+	if utf8.RuneCountInString(body.Description) > 256 {
+		invalid["description"] = "must be up to 256 characters"
+	}
+	if len(invalid) > 0 {
+		errorRender(w, r, http.StatusBadRequest, invalid)
+		return
+	}
+
+	g, err := s.Client.createGuild(ctx, w, guildParams{userID: userID, name: body.Name, description: body.Description})
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+
+	publishEvent("guild.created", map[string]interface{}{"id": userID, "guild_id": g.GuildID})
+
+	render.JSON(w, r, g)
+}
+
+func (s Serving) getGuild(w http.ResponseWriter, r *http.Request) {
+	guildID := chi.URLParam(r, "guild_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "getGuild.root")
+	span.SetAttributes(attribute.String("server", "getGuild"))
+	defer span.End()
+
+	g, err := s.Client.guild(ctx, w, guildID)
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+	render.JSON(w, r, g)
+}
+
+func (s Serving) changeGuildMember(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	guildID := chi.URLParam(r, "guild_id")
+	action := chi.URLParam(r, "action")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "changeGuildMember.root")
+	span.SetAttributes(attribute.String("server", "changeGuildMember"))
+	defer span.End()
+
+	// join and leave have no body
+	var body struct {
+		MemberID string `json:"member_id"`
+		Role     string `json:"role"`
+	}
+	if err := render.DecodeJSON(r.Body, &body); err != nil && !errors.Is(err, io.EOF) {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if action != guildActionJoin && action != guildActionLeave && body.MemberID == "" {
+		errorRender(w, r, http.StatusBadRequest, validationError{"member_id": "is required"})
+		return
+	}
+
+	status, err := s.Client.changeGuildMember(ctx, w, guildParams{
+		guildID:  guildID,
+		userID:   userID,
+		memberID: body.MemberID,
+		role:     body.Role,
+		action:   action,
+	})
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+
+	memberID := body.MemberID
+	if memberID == "" {
+		memberID = userID
+	}
+	publishEvent("guild."+action, map[string]interface{}{"id": userID, "guild_id": guildID, "member_id": memberID, "status": status})
+
+	render.JSON(w, r, map[string]interface{}{"guild_id": guildID, "user_id": memberID, "status": status})
+}
+
+func (s Serving) moveGuildItems(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	guildID := chi.URLParam(r, "guild_id")
+	action := chi.URLParam(r, "action")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "moveGuildItems.root")
+	span.SetAttributes(attribute.String("server", "moveGuildItems"))
+	defer span.End()
+
+	var body struct {
+		ItemIDs []string `json:"item_ids"`
+	}
+	if err := render.DecodeJSON(r.Body, &body); err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	seen := map[string]bool{}
+	for _, id := range body.ItemIDs {
+		if seen[id] {
+			errorRender(w, r, http.StatusBadRequest, validationError{"item_ids": "must be unique"})
+			return
+		}
+		seen[id] = true
+	}
+	if len(body.ItemIDs) == 0 {
+		errorRender(w, r, http.StatusBadRequest, validationError{"item_ids": "at least one item is required"})
+		return
+	}
+
+	err := s.Client.moveGuildItems(ctx, w, guildParams{guildID: guildID, userID: userID, action: action, itemIDs: body.ItemIDs})
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+
+	event := "guild.items_deposited"
+	if action == guildActionWithdraw {
+		event = "guild.items_withdrawn"
+	}
+	publishEvent(event, map[string]interface{}{"id": userID, "guild_id": guildID, "items": body.ItemIDs})
+
+	render.JSON(w, r, map[string]interface{}{"guild_id": guildID, "item_ids": body.ItemIDs})
+}
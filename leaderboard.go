@@ -0,0 +1,440 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/go-redis/redis"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+)
+
+type leaderboardOperation interface {
+	submitScore(context.Context, io.Writer, string, string, int64) (leaderboardEntry, error)
+	leaderboardTop(context.Context, io.Writer, string, string, int) (leaderboardPage, error)
+	leaderboardAround(context.Context, io.Writer, string, string, string, int) (leaderboardPage, error)
+	rebuildLeaderboard(context.Context, io.Writer, string, string) (int, error)
+}
+
+var (
+	errLeaderboardNotFound = errors.New("leaderboard not found")
+	errNotRanked           = errors.New("the user has no score on the leaderboard")
+)
+
+var (
+	defaultLeaderboardLimit = 10
+	maxLeaderboardLimit     = 100
+	// boards of past seasons are kept in Redis for this after the season ends
+	leaderboardRetention = 7 * 24 * time.Hour
+)
+
+type leaderboard struct {
+	id     string
+	name   string
+	period string
+}
+
+// season returns the season of the time and when it ends, seasons change at midnight in UTC.
+// The end is zero for the board that never resets.
+func (b leaderboard) season(t time.Time) (string, time.Time) {
+	t = t.UTC()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch b.period {
+	case "daily":
+		return t.Format("2006-01-02"), midnight.AddDate(0, 0, 1)
+	case "weekly":
+		year, week := t.ISOWeek()
+		daysToMonday := (8 - int(t.Weekday())) % 7
+		if daysToMonday == 0 {
+			daysToMonday = 7
+		}
+		return fmt.Sprintf("%04d-W%02d", year, week), midnight.AddDate(0, 0, daysToMonday)
+	case "monthly":
+		return t.Format("2006-01"), time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return "all", time.Time{}
+}
+
+func leaderboardKey(boardID, season string) string {
+	return fmt.Sprintf("leaderboard_%s_%s", boardID, season)
+}
+
+// keeps the best score of the user, and the key expires after the season
+var submitScoreScript = redis.NewScript(`
+local current = redis.call("ZSCORE", KEYS[1], ARGV[2])
+if not current or tonumber(ARGV[1]) > tonumber(current) then
+  redis.call("ZADD", KEYS[1], ARGV[1], ARGV[2])
+end
+if tonumber(ARGV[3]) > 0 then
+  redis.call("EXPIREAT", KEYS[1], ARGV[3])
+end
+return redis.call("ZSCORE", KEYS[1], ARGV[2])
+`)
+
+type leaderboardEntry struct {
+	Rank   int64  `json:"rank"`
+	UserID string `json:"user_id"`
+	Score  int64  `json:"score"`
+}
+
+type leaderboardPage struct {
+	BoardID string             `json:"board_id"`
+	Season  string             `json:"season"`
+	User    *leaderboardEntry  `json:"user,omitempty"`
+	Entries []leaderboardEntry `json:"entries"`
+}
+
+func (d dbClient) readLeaderboard(ctx context.Context, boardID string) (leaderboard, error) {
+	row, err := d.sc.Single().ReadRow(ctx, "leaderboards", spanner.Key{boardID}, []string{"name", "period"})
+	if spanner.ErrCode(err) == codes.NotFound {
+		return leaderboard{}, errLeaderboardNotFound
+	}
+	if err != nil {
+		return leaderboard{}, err
+	}
+	b := leaderboard{id: boardID}
+	err = row.Columns(&b.name, &b.period)
+	return b, err
+}
+
+// the current season is used if season is empty
+func (b leaderboard) seasonKey(season string) (string, string) {
+	if season == "" {
+		season, _ = b.season(time.Now())
+	}
+	return season, leaderboardKey(b.id, season)
+}
+
+// rankedRange gets the entries from start to stop in rank order, both are 0 based
+func (d dbClient) rankedRange(key string, start, stop int64) ([]leaderboardEntry, error) {
+	zs, err := d.cache.ZRevRangeWithScores(key, start, stop).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]leaderboardEntry, 0, len(zs))
+	for i, z := range zs {
+		entries = append(entries, leaderboardEntry{
+			Rank:   start + int64(i) + 1,
+			UserID: z.Member.(string),
+			Score:  int64(z.Score),
+		})
+	}
+	return entries, nil
+}
+
+// submit a score, the best score of the user in the season is kept
+func (d dbClient) submitScore(ctx context.Context, w io.Writer, boardID, userID string, score int64) (leaderboardEntry, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "submitScore")
+	defer span.End()
+
+	b, err := d.readLeaderboard(ctx, boardID)
+	if err != nil {
+		return leaderboardEntry{}, err
+	}
+	season, ends := b.season(time.Now())
+
+	best := score
+	_, err = d.sc.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		if err := userExistsInTxn(ctx, txn, userID); err != nil {
+			return err
+		}
+		if err := notBannedInTxn(ctx, txn, userID); err != nil {
+			return err
+		}
+
+		best = score
+		row, err := txn.ReadRow(ctx, "leaderboard_scores", spanner.Key{userID, boardID, season}, []string{"score"})
+		if err == nil {
+			var current int64
+			if err := row.Columns(&current); err != nil {
+				return err
+			}
+			if current >= score {
+				best = current
+				return nil
+			}
+		} else if spanner.ErrCode(err) != codes.NotFound {
+			return err
+		}
+
+		return txn.BufferWrite([]*spanner.Mutation{
+			spanner.InsertOrUpdate("leaderboard_scores",
+				[]string{"user_id", "board_id", "season", "score", "updated_at"},
+				[]interface{}{userID, boardID, season, best, time.Now()},
+			),
+		})
+	})
+	if err != nil {
+		return leaderboardEntry{}, err
+	}
+
+	// Spanner has the score even if Redis fails, the board can be rebuilt from it
+	key := leaderboardKey(boardID, season)
+	var expireAt int64
+	if !ends.IsZero() {
+		expireAt = ends.Add(leaderboardRetention).Unix()
+	}
+	if err := submitScoreScript.Run(d.cache, []string{key}, best, userID, expireAt).Err(); err != nil {
+		return leaderboardEntry{}, err
+	}
+	rank, err := d.cache.ZRevRank(key, userID).Result()
+	if err != nil {
+		return leaderboardEntry{}, err
+	}
+	return leaderboardEntry{Rank: rank + 1, UserID: userID, Score: best}, nil
+}
+
+// get the top entries of the board
+func (d dbClient) leaderboardTop(ctx context.Context, w io.Writer, boardID, season string, limit int) (leaderboardPage, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "leaderboardTop")
+	defer span.End()
+
+	b, err := d.readLeaderboard(ctx, boardID)
+	if err != nil {
+		return leaderboardPage{}, err
+	}
+	season, key := b.seasonKey(season)
+
+	entries, err := d.rankedRange(key, 0, int64(limit)-1)
+	if err != nil {
+		return leaderboardPage{}, err
+	}
+	return leaderboardPage{BoardID: boardID, Season: season, Entries: entries}, nil
+}
+
+// get the rank of the user and the entries around
+func (d dbClient) leaderboardAround(ctx context.Context, w io.Writer, boardID, season, userID string, around int) (leaderboardPage, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "leaderboardAround")
+	defer span.End()
+
+	b, err := d.readLeaderboard(ctx, boardID)
+	if err != nil {
+		return leaderboardPage{}, err
+	}
+	season, key := b.seasonKey(season)
+
+	rank, err := d.cache.ZRevRank(key, userID).Result()
+	if err == redis.Nil {
+		return leaderboardPage{}, errNotRanked
+	}
+	if err != nil {
+		return leaderboardPage{}, err
+	}
+
+	start := rank - int64(around)
+	if start < 0 {
+		start = 0
+	}
+	entries, err := d.rankedRange(key, start, rank+int64(around))
+	if err != nil {
+		return leaderboardPage{}, err
+	}
+
+	page := leaderboardPage{BoardID: boardID, Season: season, Entries: entries}
+	for i := range entries {
+		if entries[i].UserID == userID {
+			page.User = &entries[i]
+		}
+	}
+	return page, nil
+}
+
+// rebuild the board in Redis from the scores in Spanner
+func (d dbClient) rebuildLeaderboard(ctx context.Context, w io.Writer, boardID, season string) (int, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "rebuildLeaderboard")
+	defer span.End()
+
+	b, err := d.readLeaderboard(ctx, boardID)
+	if err != nil {
+		return 0, err
+	}
+	season, key := b.seasonKey(season)
+
+	// the board is built in another key, then replaced at once
+	tmpKey := key + "_rebuild"
+	if err := d.cache.Del(tmpKey).Err(); err != nil {
+		return 0, err
+	}
+
+	stmt := spanner.Statement{
+		SQL: `SELECT user_id, score FROM leaderboard_scores@{FORCE_INDEX=leaderboard_scores_by_board}
+		  WHERE board_id = @boardID AND season = @season`,
+		Params: map[string]interface{}{"boardID": boardID, "season": season},
+	}
+	count := 0
+	members := make([]redis.Z, 0, 1000)
+	flush := func() error {
+		if len(members) == 0 {
+			return nil
+		}
+		err := d.cache.ZAdd(tmpKey, members...).Err()
+		members = members[:0]
+		return err
+	}
+	err = d.sc.Single().Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		var userID string
+		var score int64
+		if err := row.Columns(&userID, &score); err != nil {
+			return err
+		}
+		members = append(members, redis.Z{Score: float64(score), Member: userID})
+		count++
+		if len(members) < cap(members) {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		d.cache.Del(tmpKey)
+		return 0, err
+	}
+
+	if count == 0 {
+		return 0, d.cache.Del(key).Err()
+	}
+	if err := d.cache.Rename(tmpKey, key).Err(); err != nil {
+		return 0, err
+	}
+	current, ends := b.season(time.Now())
+	switch {
+	case season != current:
+		// a past season is kept for the retention from now on
+		err = d.cache.Expire(key, leaderboardRetention).Err()
+	case !ends.IsZero():
+		err = d.cache.ExpireAt(key, ends.Add(leaderboardRetention)).Err()
+	}
+	return count, err
+}
+
+func (s Serving) submitScore(w http.ResponseWriter, r *http.Request) {
+	boardID := chi.URLParam(r, "board_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "submitScore.root")
+	span.SetAttributes(attribute.String("server", "submitScore"))
+	defer span.End()
+
+	var body struct {
+		UserID string `json:"user_id"`
+		Score  int64  `json:"score"`
+	}
+	if err := render.DecodeJSON(r.Body, &body); err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	// scores are float64 in Redis
+	if body.Score < 0 || body.Score > 1<<53 {
+		errorRender(w, r, http.StatusBadRequest, validationError{"score": "must be between 0 and 2^53"})
+		return
+	}
+
+	entry, err := s.Client.submitScore(ctx, w, boardID, body.UserID, body.Score)
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+
+	publishEvent("score.submitted", map[string]interface{}{"id": body.UserID, "board_id": boardID, "score": body.Score, "best": entry.Score})
+
+	render.JSON(w, r, entry)
+}
+
+func (s Serving) getLeaderboard(w http.ResponseWriter, r *http.Request) {
+	boardID := chi.URLParam(r, "board_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "getLeaderboard.root")
+	span.SetAttributes(attribute.String("server", "getLeaderboard"))
+	defer span.End()
+
+	limit := defaultLeaderboardLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxLeaderboardLimit {
+			errorRender(w, r, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", maxLeaderboardLimit))
+			return
+		}
+		limit = n
+	}
+
+	page, err := s.Client.leaderboardTop(ctx, w, boardID, r.URL.Query().Get("season"), limit)
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+	render.JSON(w, r, page)
+}
+
+func (s Serving) getLeaderboardAround(w http.ResponseWriter, r *http.Request) {
+	boardID := chi.URLParam(r, "board_id")
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "getLeaderboardAround.root")
+	span.SetAttributes(attribute.String("server", "getLeaderboardAround"))
+	defer span.End()
+
+	around := 0
+	if v := r.URL.Query().Get("around"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxLeaderboardLimit/2 {
+			errorRender(w, r, http.StatusBadRequest, fmt.Errorf("around must be between 0 and %d", maxLeaderboardLimit/2))
+			return
+		}
+		around = n
+	}
+
+	page, err := s.Client.leaderboardAround(ctx, w, boardID, r.URL.Query().Get("season"), userID, around)
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+	render.JSON(w, r, page)
+}
+
+func (s Serving) rebuildLeaderboard(w http.ResponseWriter, r *http.Request) {
+	boardID := chi.URLParam(r, "board_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "rebuildLeaderboard.root")
+	span.SetAttributes(attribute.String("server", "rebuildLeaderboard"))
+	defer span.End()
+
+	count, err := s.Client.rebuildLeaderboard(ctx, w, boardID, r.URL.Query().Get("season"))
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+	render.JSON(w, r, map[string]interface{}{"board_id": boardID, "entries": count})
+}
@@ -0,0 +1,307 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+	// time zones are embedded, the container image may not have them
+	_ "time/tzdata"
+
+	"cloud.google.com/go/civil"
+	"cloud.google.com/go/spanner"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+)
+
+type loginBonusOperation interface {
+	loginBonus(context.Context, io.Writer, string) (loginBonusStatus, error)
+	claimLoginBonus(context.Context, io.Writer, string) (loginClaim, error)
+}
+
+var (
+	errNoActiveCalendar = errors.New("no login calendar is active")
+	errAlreadyClaimed   = errors.New("login bonus is already claimed today")
+)
+
+type loginCalendarDay struct {
+	Day     int64    `json:"day"`
+	ItemIDs []string `json:"item_ids"`
+}
+
+type loginCalendar struct {
+	seasonID string
+	name     string
+	startsOn civil.Date
+	endsOn   civil.Date
+	// sorted by day
+	days []loginCalendarDay
+}
+
+// dayFor is the reward of the next claim, the calendar starts over after the last day
+func (c loginCalendar) dayFor(totalDays int64) loginCalendarDay {
+	return c.days[totalDays%int64(len(c.days))]
+}
+
+// the season whose dates include today, the latest one wins if they overlap
+func readActiveCalendar(ctx context.Context, txn spannerReader, today civil.Date) (loginCalendar, error) {
+	stmt := spanner.Statement{
+		SQL: `SELECT season_id, name, starts_on, ends_on FROM login_calendars
+		  WHERE starts_on <= @today AND ends_on >= @today
+		  ORDER BY starts_on DESC LIMIT 1`,
+		Params: map[string]interface{}{"today": today},
+	}
+
+	var c loginCalendar
+	found := false
+	err := txn.Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		found = true
+		return row.Columns(&c.seasonID, &c.name, &c.startsOn, &c.endsOn)
+	})
+	if err != nil {
+		return loginCalendar{}, err
+	}
+	if !found {
+		return loginCalendar{}, errNoActiveCalendar
+	}
+
+	iter := txn.Read(ctx, "login_calendar_days", spanner.Key{c.seasonID}.AsPrefix(), []string{"day", "item_ids"})
+	err = iter.Do(func(row *spanner.Row) error {
+		var d loginCalendarDay
+		if err := row.Columns(&d.Day, &d.ItemIDs); err != nil {
+			return err
+		}
+		c.days = append(c.days, d)
+		return nil
+	})
+	if err != nil {
+		return loginCalendar{}, err
+	}
+	if len(c.days) == 0 {
+		return loginCalendar{}, fmt.Errorf("login calendar %s has no days", c.seasonID)
+	}
+	return c, nil
+}
+
+type loginClaimState struct {
+	found         bool
+	lastClaimDate civil.Date
+	streak        int64
+	totalDays     int64
+}
+
+func readLoginClaim(ctx context.Context, txn spannerReader, userID, seasonID string) (loginClaimState, error) {
+	row, err := txn.ReadRow(ctx, "login_claims", spanner.Key{userID, seasonID}, []string{"last_claim_date", "streak", "total_days"})
+	if spanner.ErrCode(err) == codes.NotFound {
+		return loginClaimState{}, nil
+	}
+	if err != nil {
+		return loginClaimState{}, err
+	}
+	state := loginClaimState{found: true}
+	err = row.Columns(&state.lastClaimDate, &state.streak, &state.totalDays)
+	return state, err
+}
+
+// userToday is the date in the user's timezone, UTC is used when it's not set
+func userToday(ctx context.Context, txn spannerReader, userID string, now time.Time) (civil.Date, error) {
+	row, err := txn.ReadRow(ctx, "users", spanner.Key{userID}, []string{"timezone", "deleted_at"})
+	if spanner.ErrCode(err) == codes.NotFound {
+		return civil.Date{}, errUserNotFound
+	}
+	if err != nil {
+		return civil.Date{}, err
+	}
+	var timezone spanner.NullString
+	var deletedAt spanner.NullTime
+	if err := row.Columns(&timezone, &deletedAt); err != nil {
+		return civil.Date{}, err
+	}
+	if deletedAt.Valid {
+		return civil.Date{}, errUserNotFound
+	}
+	loc, err := time.LoadLocation(timezone.StringVal)
+	if err != nil {
+		loc = time.UTC
+	}
+	return civil.DateOf(now.In(loc)), nil
+}
+
+type loginBonusStatus struct {
+	SeasonID     string             `json:"season_id"`
+	Name         string             `json:"name"`
+	StartsOn     civil.Date         `json:"starts_on"`
+	EndsOn       civil.Date         `json:"ends_on"`
+	Today        civil.Date         `json:"today"`
+	ClaimedToday bool               `json:"claimed_today"`
+	Streak       int64              `json:"streak"`
+	TotalDays    int64              `json:"total_days"`
+	NextDay      int64              `json:"next_day"`
+	Days         []loginCalendarDay `json:"days"`
+}
+
+type loginClaim struct {
+	SeasonID  string        `json:"season_id"`
+	Date      civil.Date    `json:"date"`
+	Day       int64         `json:"day"`
+	Streak    int64         `json:"streak"`
+	TotalDays int64         `json:"total_days"`
+	Results   []grantResult `json:"results"`
+}
+
+// get the calendar of the current season and how far the user has claimed
+func (d dbClient) loginBonus(ctx context.Context, w io.Writer, userID string) (loginBonusStatus, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "loginBonus")
+	defer span.End()
+
+	txn := d.sc.ReadOnlyTransaction()
+	defer txn.Close()
+
+	today, err := userToday(ctx, txn, userID, time.Now())
+	if err != nil {
+		return loginBonusStatus{}, err
+	}
+	c, err := readActiveCalendar(ctx, txn, today)
+	if err != nil {
+		return loginBonusStatus{}, err
+	}
+	state, err := readLoginClaim(ctx, txn, userID, c.seasonID)
+	if err != nil {
+		return loginBonusStatus{}, err
+	}
+
+	status := loginBonusStatus{
+		SeasonID:     c.seasonID,
+		Name:         c.name,
+		StartsOn:     c.startsOn,
+		EndsOn:       c.endsOn,
+		Today:        today,
+		ClaimedToday: state.found && !today.After(state.lastClaimDate),
+		TotalDays:    state.totalDays,
+		NextDay:      c.dayFor(state.totalDays).Day,
+		Days:         c.days,
+	}
+	// the streak is broken when yesterday was missed
+	if state.found && !state.lastClaimDate.Before(today.AddDays(-1)) {
+		status.Streak = state.streak
+	}
+	return status, nil
+}
+
+// claim the reward of the day, items are granted in the same way as addItemToUser
+func (d dbClient) claimLoginBonus(ctx context.Context, w io.Writer, userID string) (loginClaim, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "claimLoginBonus")
+	defer span.End()
+
+	now := time.Now()
+	var claim loginClaim
+	_, err := d.sc.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		today, err := userToday(ctx, txn, userID, now)
+		if err != nil {
+			return err
+		}
+		c, err := readActiveCalendar(ctx, txn, today)
+		if err != nil {
+			return err
+		}
+		state, err := readLoginClaim(ctx, txn, userID, c.seasonID)
+		if err != nil {
+			return err
+		}
+		// it can be before the last claim if the timezone has changed
+		if state.found && !today.After(state.lastClaimDate) {
+			return errAlreadyClaimed
+		}
+
+		claim = loginClaim{SeasonID: c.seasonID, Date: today, Streak: 1, TotalDays: state.totalDays + 1}
+		if state.found && state.lastClaimDate == today.AddDays(-1) {
+			claim.Streak = state.streak + 1
+		}
+
+		day := c.dayFor(state.totalDays)
+		claim.Day = day.Day
+		grants := make([]grantParams, 0, len(day.ItemIDs))
+		for _, itemID := range day.ItemIDs {
+			grants = append(grants, grantParams{userID: userID, itemID: itemID})
+		}
+		claim.Results, err = grantItemsInTxn(ctx, txn, grants)
+		if err != nil {
+			return err
+		}
+
+		return txn.BufferWrite([]*spanner.Mutation{
+			spanner.InsertOrUpdate("login_claims",
+				[]string{"user_id", "season_id", "last_claim_date", "streak", "total_days", "updated_at"},
+				[]interface{}{userID, c.seasonID, today, claim.Streak, claim.TotalDays, now},
+			),
+		})
+	})
+	if err != nil {
+		return loginClaim{}, err
+	}
+
+	d.invalidateUserItems(userID)
+	return claim, nil
+}
+
+func (s Serving) getLoginBonus(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "getLoginBonus.root")
+	span.SetAttributes(attribute.String("server", "getLoginBonus"))
+	defer span.End()
+
+	status, err := s.Client.loginBonus(ctx, w, userID)
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+	render.JSON(w, r, status)
+}
+
+func (s Serving) claimLoginBonus(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "claimLoginBonus.root")
+	span.SetAttributes(attribute.String("server", "claimLoginBonus"))
+	defer span.End()
+
+	claim, err := s.Client.claimLoginBonus(ctx, w, userID)
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+
+	publishEvent("login_bonus.claimed", map[string]interface{}{
+		"id":        userID,
+		"season_id": claim.SeasonID,
+		"day":       claim.Day,
+		"streak":    claim.Streak,
+	})
+
+	render.JSON(w, r, claim)
+}
@@ -0,0 +1,476 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type mailOperation interface {
+	sendMails(context.Context, io.Writer, mailParams) (int, error)
+	mails(context.Context, io.Writer, string) ([]mail, error)
+	claimMails(context.Context, io.Writer, string, []string) ([]mailClaim, error)
+}
+
+var (
+	errMailNotFound = errors.New("mail not found")
+	errMailExpired  = errors.New("mail has expired")
+	errMailClaimed  = errors.New("mail is already claimed")
+)
+
+var (
+	// mails are inserted by this number in a mutation batch
+	mailChunkSize = 1000
+	// mails are kept for this if expires_at is not specified
+	mailDefaultTTL = 30 * 24 * time.Hour
+	// up to the number of the latest mails are listed
+	maxMails = 100
+)
+
+// mailSegment selects users by their attributes, empty fields match everyone
+type mailSegment struct {
+	Country  string `json:"country"`
+	Platform string `json:"platform"`
+	Locale   string `json:"locale"`
+}
+
+func (m mailSegment) empty() bool {
+	return m.Country == "" && m.Platform == "" && m.Locale == ""
+}
+
+// mailParams is sent to userIDs, or to the users in segment if userIDs is empty
+type mailParams struct {
+	mailID    string
+	userIDs   []string
+	segment   mailSegment
+	sender    string
+	subject   string
+	body      string
+	itemIDs   []string
+	expiresAt time.Time
+}
+
+type mail struct {
+	MailID    string     `json:"mail_id"`
+	Sender    string     `json:"sender"`
+	Subject   string     `json:"subject"`
+	Body      string     `json:"body,omitempty"`
+	ItemIDs   []string   `json:"item_ids"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	Claimed   bool       `json:"claimed"`
+	ClaimedAt *time.Time `json:"claimed_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// mailClaim is the result of claiming a mail. The items owned already are kept in the mail, which stays unclaimed
+// until they are claimed too.
+type mailClaim struct {
+	MailID      string        `json:"mail_id"`
+	Results     []grantResult `json:"results"`
+	Claimed     bool          `json:"claimed"`
+	KeptItemIDs []string      `json:"kept_item_ids"`
+}
+
+// send a mail to the users, the same mail_id is used for all of them
+func (d dbClient) sendMails(ctx context.Context, w io.Writer, m mailParams) (int, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "sendMails")
+	defer span.End()
+
+	now := time.Now()
+	sent := 0
+	send := func(userIDs []string) error {
+		mutations := make([]*spanner.Mutation, 0, len(userIDs))
+		for _, userID := range userIDs {
+			mutations = append(mutations, spanner.Insert("mails",
+				[]string{"user_id", "mail_id", "sender", "subject", "body", "item_ids", "expires_at", "created_at"},
+				[]interface{}{userID, m.mailID, m.sender, m.subject, nullString(m.body), m.itemIDs, m.expiresAt, now},
+			))
+		}
+		// one for each chunk, they are written separately
+		mutations = append(mutations, auditMutation(ctx, "mails.sent", "", m.mailID, nil, map[string]interface{}{
+			"subject":  m.subject,
+			"item_ids": m.itemIDs,
+			"users":    len(userIDs),
+		}))
+		if _, err := d.sc.Apply(ctx, mutations); err != nil {
+			return err
+		}
+		sent += len(userIDs)
+		return nil
+	}
+
+	users := map[string]bool{}
+	for _, userID := range m.userIDs {
+		users[userID] = false
+	}
+	items := map[string]bool{}
+	for _, itemID := range m.itemIDs {
+		items[itemID] = false
+	}
+	_, err := d.sc.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		if err := markExisting(ctx, txn, "SELECT user_id FROM users WHERE user_id IN UNNEST(@ids) AND deleted_at IS NULL", users); err != nil {
+			return err
+		}
+		return markExisting(ctx, txn, "SELECT item_id FROM items WHERE item_id IN UNNEST(@ids)", items)
+	})
+	if err != nil {
+		return 0, err
+	}
+	for userID, exists := range users {
+		if !exists {
+			return 0, fmt.Errorf("%w: %s", errUserNotFound, userID)
+		}
+	}
+	for itemID, exists := range items {
+		if !exists {
+			return 0, fmt.Errorf("%w: %s", errItemNotFound, itemID)
+		}
+	}
+
+	if len(m.userIDs) > 0 {
+		for start := 0; start < len(m.userIDs); start += mailChunkSize {
+			end := start + mailChunkSize
+			if end > len(m.userIDs) {
+				end = len(m.userIDs)
+			}
+			if err := send(m.userIDs[start:end]); err != nil {
+				return sent, err
+			}
+		}
+		return sent, nil
+	}
+
+	stmt := spanner.Statement{
+		SQL: `SELECT user_id FROM users
+		  WHERE deleted_at IS NULL
+		  AND (@country IS NULL OR country = @country)
+		  AND (@platform IS NULL OR platform = @platform)
+		  AND (@locale IS NULL OR locale = @locale)`,
+		Params: map[string]interface{}{
+			"country":  nullString(m.segment.Country),
+			"platform": nullString(m.segment.Platform),
+			"locale":   nullString(m.segment.Locale),
+		},
+	}
+	chunk := make([]string, 0, mailChunkSize)
+	err = d.sc.Single().Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		var userID string
+		if err := row.Columns(&userID); err != nil {
+			return err
+		}
+		chunk = append(chunk, userID)
+		if len(chunk) < mailChunkSize {
+			return nil
+		}
+		err := send(chunk)
+		chunk = chunk[:0]
+		return err
+	})
+	if err == nil && len(chunk) > 0 {
+		err = send(chunk)
+	}
+	// the chunks sent already are not rolled back
+	return sent, err
+}
+
+// list the latest mails of the user that have not expired
+func (d dbClient) mails(ctx context.Context, w io.Writer, userID string) ([]mail, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "mails")
+	defer span.End()
+
+	if _, err := d.userProfile(ctx, w, userID); err != nil {
+		return nil, err
+	}
+
+	stmt := spanner.Statement{
+		SQL: `SELECT mail_id, sender, subject, body, item_ids, expires_at, claimed_at, created_at FROM mails
+		  WHERE user_id = @userID AND expires_at > CURRENT_TIMESTAMP()
+		  ORDER BY created_at DESC LIMIT @limit`,
+		Params: map[string]interface{}{"userID": userID, "limit": maxMails},
+	}
+	results := []mail{}
+	err := d.sc.Single().Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		var m mail
+		var body spanner.NullString
+		var claimedAt spanner.NullTime
+		if err := row.Columns(&m.MailID, &m.Sender, &m.Subject, &body, &m.ItemIDs, &m.ExpiresAt, &claimedAt, &m.CreatedAt); err != nil {
+			return err
+		}
+		m.Body = body.StringVal
+		if claimedAt.Valid {
+			m.Claimed = true
+			m.ClaimedAt = &claimedAt.Time
+		}
+		results = append(results, m)
+		return nil
+	})
+	return results, err
+}
+
+// claim the mails and grant their items in a transaction, all claimable mails if mailIDs is empty
+func (d dbClient) claimMails(ctx context.Context, w io.Writer, userID string, mailIDs []string) ([]mailClaim, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "claimMails")
+	defer span.End()
+
+	var claims []mailClaim
+	_, err := d.sc.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		claims = []mailClaim{}
+		now := time.Now()
+
+		keys := spanner.KeySet(spanner.Key{userID}.AsPrefix())
+		if len(mailIDs) > 0 {
+			ks := make([]spanner.KeySet, 0, len(mailIDs))
+			for _, mailID := range mailIDs {
+				ks = append(ks, spanner.Key{userID, mailID})
+			}
+			keys = spanner.KeySets(ks...)
+		}
+
+		type claimable struct {
+			mailID  string
+			itemIDs []string
+		}
+		found := map[string]claimable{}
+		err := txn.Read(ctx, "mails", keys, []string{"mail_id", "item_ids", "expires_at", "claimed_at"}).Do(func(row *spanner.Row) error {
+			var c claimable
+			var expiresAt time.Time
+			var claimedAt spanner.NullTime
+			if err := row.Columns(&c.mailID, &c.itemIDs, &expiresAt, &claimedAt); err != nil {
+				return err
+			}
+			switch {
+			case claimedAt.Valid && len(mailIDs) > 0:
+				return fmt.Errorf("%w: %s", errMailClaimed, c.mailID)
+			case !expiresAt.After(now) && len(mailIDs) > 0:
+				return fmt.Errorf("%w: %s", errMailExpired, c.mailID)
+			case claimedAt.Valid, !expiresAt.After(now):
+				return nil
+			}
+			found[c.mailID] = c
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, mailID := range mailIDs {
+			if _, ok := found[mailID]; !ok {
+				return fmt.Errorf("%w: %s", errMailNotFound, mailID)
+			}
+		}
+
+		order := mailIDs
+		if len(order) == 0 {
+			for mailID := range found {
+				order = append(order, mailID)
+			}
+			sort.Strings(order)
+		}
+		grants := []grantParams{}
+		for _, mailID := range order {
+			for _, itemID := range found[mailID].itemIDs {
+				grants = append(grants, grantParams{userID: userID, itemID: itemID})
+			}
+		}
+		results, err := grantItemsInTxn(ctx, txn, grants)
+		if err != nil {
+			return err
+		}
+
+		mutations := make([]*spanner.Mutation, 0, len(order))
+		for _, mailID := range order {
+			n := len(found[mailID].itemIDs)
+			c := mailClaim{MailID: mailID, Results: results[:n], KeptItemIDs: []string{}}
+			results = results[n:]
+			for _, r := range c.Results {
+				if r.Status == grantAlreadyOwned {
+					c.KeptItemIDs = append(c.KeptItemIDs, r.ItemID)
+				}
+			}
+			c.Claimed = len(c.KeptItemIDs) == 0
+			claims = append(claims, c)
+			if !c.Claimed {
+				mutations = append(mutations, spanner.Update("mails",
+					[]string{"user_id", "mail_id", "item_ids"},
+					[]interface{}{userID, mailID, c.KeptItemIDs},
+				))
+				continue
+			}
+			mutations = append(mutations, spanner.Update("mails",
+				[]string{"user_id", "mail_id", "claimed_at"},
+				[]interface{}{userID, mailID, now},
+			))
+		}
+		return txn.BufferWrite(mutations)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(claims) > 0 {
+		d.invalidateUserItems(userID)
+	}
+	return claims, nil
+}
+
+type sendMailsRequest struct {
+	UserIDs   []string     `json:"user_ids"`
+	Segment   *mailSegment `json:"segment"`
+	Sender    string       `json:"sender"`
+	Subject   string       `json:"subject"`
+	Body      string       `json:"body"`
+	ItemIDs   []string     `json:"item_ids"`
+	ExpiresAt *time.Time   `json:"expires_at"`
+}
+
+func (s sendMailsRequest) validate() error {
+	invalid := validationError{}
+	switch {
+	case len(s.UserIDs) == 0 && s.Segment == nil:
+		invalid["user_ids"] = "user_ids or segment is required"
+	case len(s.UserIDs) > 0 && s.Segment != nil:
+		invalid["segment"] = "can't be used with user_ids"
+	case s.Segment != nil && s.Segment.empty():
+		invalid["segment"] = "at least one of country, platform and locale is required"
+	}
+	seen := map[string]bool{}
+	for _, userID := range s.UserIDs {
+		if seen[userID] {
+			invalid["user_ids"] = fmt.Sprintf("%s is duplicated", userID)
+		}
+		seen[userID] = true
+	}
+	if s.Subject == "" {
+		invalid["subject"] = "is required"
+	}
+	if s.ExpiresAt != nil && !s.ExpiresAt.After(time.Now()) {
+		invalid["expires_at"] = "must be in the future"
+	}
+	if len(invalid) > 0 {
+		return invalid
+	}
+	return nil
+}
+
+func (s Serving) sendMails(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "sendMails.root")
+	span.SetAttributes(attribute.String("server", "sendMails"))
+	defer span.End()
+
+	var body sendMailsRequest
+	if err := render.DecodeJSON(r.Body, &body); err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if err := body.validate(); err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+
+	m := mailParams{
+		mailID:    uuid.NewString(),
+		userIDs:   body.UserIDs,
+		sender:    body.Sender,
+		subject:   body.Subject,
+		body:      body.Body,
+		itemIDs:   body.ItemIDs,
+		expiresAt: time.Now().Add(mailDefaultTTL),
+	}
+	if m.sender == "" {
+		m.sender = "system"
+	}
+	if m.itemIDs == nil {
+		m.itemIDs = []string{}
+	}
+	if body.Segment != nil {
+		m.segment = *body.Segment
+	}
+	if body.ExpiresAt != nil {
+		m.expiresAt = *body.ExpiresAt
+	}
+
+	sent, err := s.Client.sendMails(ctx, w, m)
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+
+	publishEvent("mails.sent", map[string]interface{}{"mail_id": m.mailID, "recipients": sent, "items": m.itemIDs})
+
+	render.JSON(w, r, map[string]interface{}{"mail_id": m.mailID, "recipients": sent})
+}
+
+func (s Serving) getMails(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "getMails.root")
+	span.SetAttributes(attribute.String("server", "getMails"))
+	defer span.End()
+
+	results, err := s.Client.mails(ctx, w, userID)
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+	render.JSON(w, r, map[string]interface{}{"mails": results})
+}
+
+func (s Serving) claimMail(w http.ResponseWriter, r *http.Request) {
+	s.claimMails(w, r, []string{chi.URLParam(r, "mail_id")})
+}
+
+func (s Serving) claimAllMails(w http.ResponseWriter, r *http.Request) {
+	s.claimMails(w, r, nil)
+}
+
+func (s Serving) claimMails(w http.ResponseWriter, r *http.Request, mailIDs []string) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "claimMails.root")
+	span.SetAttributes(attribute.String("server", "claimMails"))
+	defer span.End()
+
+	claims, err := s.Client.claimMails(ctx, w, userID, mailIDs)
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+
+	for _, c := range claims {
+		publishEvent("mail.claimed", map[string]interface{}{"id": userID, "mail_id": c.MailID})
+	}
+
+	render.JSON(w, r, map[string]interface{}{"claims": claims})
+}
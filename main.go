@@ -17,6 +17,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -47,23 +48,49 @@ var (
 )
 
 var (
-	topicName      = os.Getenv("TOPIC_NAME")
-	authHeaderName = os.Getenv("AUTH_HEADER")
-	pubsubClient   *pubsub.Client
+	topicName         = os.Getenv("TOPIC_NAME")
+	authHeaderName    = os.Getenv("AUTH_HEADER")
+	validateResponses = os.Getenv("OPENAPI_VALIDATE_RESPONSES") != ""
+	grpcPort          = os.Getenv("GRPC_PORT")
+	pubsubClient      *pubsub.Client
 )
 
 type Serving struct {
 	Client GameUserOperation
+	// used by rate limiting, the limits are kept in memory if it's nil
+	Cache *redis.Client
+}
+
+func newRedisClient() *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:        redisHost,
+		Password:    "",
+		DB:          0,
+		PoolSize:    10,
+		PoolTimeout: 30 * time.Second,
+		DialTimeout: 1 * time.Second,
+	})
 }
 
 type User struct {
-	Name string `json:"name"`
-	Id   string `json:"id"`
+	Name     string `json:"name"`
+	Id       string `json:"id"`
+	Locale   string `json:"locale,omitempty"`
+	Country  string `json:"country,omitempty"`
+	Platform string `json:"platform,omitempty"`
+	Timezone string `json:"timezone,omitempty"`
 }
 
 func main() {
 
 	ctx := context.Background()
+	if len(os.Args) > 1 {
+		if err := runCommand(ctx, os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	tp, err := newTracer(projectId)
 	if err != nil {
 		log.Fatal(err)
@@ -81,6 +108,12 @@ func main() {
 		log.Fatal((err))
 	}
 
+	policy, err := loadNamePolicy()
+	if err != nil {
+		log.Fatal(err)
+	}
+	userNamePolicy = policy
+
 	p, err := pubsub.NewClient(ctx, projectId)
 	if err != nil {
 		log.Fatal(err)
@@ -88,14 +121,7 @@ func main() {
 	pubsubClient = p
 	defer pubsubClient.Close()
 
-	rdb := redis.NewClient(&redis.Options{
-		Addr:        redisHost,
-		Password:    "",
-		DB:          0,
-		PoolSize:    10,
-		PoolTimeout: 30 * time.Second,
-		DialTimeout: 1 * time.Second,
-	})
+	rdb := newRedisClient()
 
 	client, err := newClient(ctx, spannerString, rdb)
 	if err != nil {
@@ -107,9 +133,58 @@ func main() {
 
 	s := Serving{
 		Client: client,
+		Cache:  rdb,
 	}
 
+	trackAchievements(client)
+	startItemReaper(ctx, client)
+	startPurger(ctx, client)
+
 	oplog := httplog.LogEntry(context.Background())
+
+	r, err := newRouter(s, validateResponses)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if grpcPort != "" {
+		go func() {
+			if err := serveGRPC(":"+grpcPort, client, rdb); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	if err := http.ListenAndServe(":"+servicePort, r); err != nil {
+		oplog.Err(err)
+	}
+
+}
+
+// newRouter builds all routes, also used in test.
+// With checkResponses, responses are checked against the OpenAPI spec.
+func newRouter(s Serving, checkResponses bool) (chi.Router, error) {
+
+	doc, err := loadOpenapiSpec()
+	if err != nil {
+		return nil, err
+	}
+	validator, err := openapiValidator(doc, checkResponses)
+	if err != nil {
+		return nil, err
+	}
+
+	limiter := newRateLimiter(s.Cache)
+	apiLimit, err := loadRateLimit("api")
+	if err != nil {
+		return nil, err
+	}
+	createUserLimit, err := loadRateLimit("create_user")
+	if err != nil {
+		return nil, err
+	}
+	limitCreateUser := limiter.limit("create_user", createUserLimit)
+
 	/* jsonify logging */
 	httpLogger := httplog.NewLogger(appName, httplog.Options{JSON: true, LevelFieldName: "severity", Concise: true})
 
@@ -117,8 +192,8 @@ func main() {
 	m := chiprometheus.NewMiddleware(appName)
 
 	r := chi.NewRouter()
-	// r.Use(middleware.Throttle(8))
 	r.Use(middleware.RequestID)
+	r.Use(auditActorMiddleware)
 	r.Use(middleware.Recoverer)
 	r.Use(httplog.RequestLogger(httpLogger))
 	r.Use(middleware.Timeout(60 * time.Second))
@@ -126,24 +201,122 @@ func main() {
 
 	r.Use(m)
 	r.Handle("/metrics", promhttp.Handler())
+	r.Get("/openapi.json", serveOpenapiSpec(doc))
 
-	r.Get("/ping", s.pingPong)
+	r.With(validator).Get("/ping", s.pingPong)
 
 	r.Route("/api", func(t chi.Router) {
+		t.Use(limiter.limit("api", apiLimit))
+		t.Use(s.banCheck)
+		t.Use(validator)
 		t.Get("/user_id/{user_id:[a-z0-9-.]+}", s.getUserItems)
-		t.Post("/user/{user_name:[a-z0-9-.]+}", s.createUser)
+		t.Get("/user_id/{user_id:[a-z0-9-.]+}/profile", s.getUser)
+		t.Patch("/user_id/{user_id:[a-z0-9-.]+}", s.renameUser)
+		t.Delete("/user_id/{user_id:[a-z0-9-.]+}", s.deleteUser)
+		t.With(limitCreateUser).Post("/users", s.createUserWithBody)
+		// compatible with the older clients that pass the name in path
+		t.With(limitCreateUser).Post("/user/{user_name:[a-z0-9-.]+}", s.createUser)
+		t.Get("/user_name/{user_name}/available", s.userNameAvailable)
 		t.Put("/user_id/{user_id:[a-z0-9-.]+}/{item_id:[a-z0-9-.]+}", s.addItemToUser)
+		t.Post("/user_id/{user_id:[a-z0-9-.]+}/gifts", s.sendGift)
+		t.Post("/trades", s.tradeItems)
+		t.Get("/user_id/{user_id:[a-z0-9-.]+}/trades", s.getTrades)
+		t.Post("/user_id/{user_id:[a-z0-9-.]+}/trades/{trade_id:[a-z0-9-.]+}/{action:accept|decline|cancel}", s.changeTrade)
+		t.Get("/currencies", s.getCurrencies)
+		t.Get("/user_id/{user_id:[a-z0-9-.]+}/balances", s.getBalances)
+		t.Get("/user_id/{user_id:[a-z0-9-.]+}/ledger", s.getLedger)
+		t.Get("/drop_tables/{drop_table_id:[a-z0-9-.]+}/odds", s.getDropTableOdds)
+		t.Post("/user_id/{user_id:[a-z0-9-.]+}/draws", s.drawGacha)
+		t.Get("/user_id/{user_id:[a-z0-9-.]+}/draws/{draw_id:[a-z0-9-.]+}", s.getGachaDraw)
+		t.Get("/user_id/{user_id:[a-z0-9-.]+}/login_bonus", s.getLoginBonus)
+		t.Post("/user_id/{user_id:[a-z0-9-.]+}/login_bonus", s.claimLoginBonus)
+		t.Get("/user_id/{user_id:[a-z0-9-.]+}/mails", s.getMails)
+		t.Post("/user_id/{user_id:[a-z0-9-.]+}/mails/claim", s.claimAllMails)
+		t.Post("/user_id/{user_id:[a-z0-9-.]+}/mails/{mail_id:[a-z0-9-.]+}/claim", s.claimMail)
+		t.Get("/user_id/{user_id:[a-z0-9-.]+}/achievements", s.getAchievements)
+		t.Get("/offers", s.getOffers)
+		t.Post("/user_id/{user_id:[a-z0-9-.]+}/purchases", s.purchaseOffer)
+		t.Get("/user_id/{user_id:[a-z0-9-.]+}/friends", s.getFriends)
+		t.Post("/user_id/{user_id:[a-z0-9-.]+}/friends/{friend_id:[a-z0-9-.]+}/{action:request|accept|decline|cancel|remove|block|unblock}", s.changeFriendship)
+		t.Post("/user_id/{user_id:[a-z0-9-.]+}/guilds", s.createGuild)
+		t.Get("/guilds/{guild_id:[a-z0-9-.]+}", s.getGuild)
+		t.Post("/user_id/{user_id:[a-z0-9-.]+}/guilds/{guild_id:[a-z0-9-.]+}/{action:join|leave|invite|kick|role}", s.changeGuildMember)
+		t.Post("/user_id/{user_id:[a-z0-9-.]+}/guilds/{guild_id:[a-z0-9-.]+}/items/{action:deposit|withdraw}", s.moveGuildItems)
+		t.Get("/leaderboards/{board_id:[a-z0-9_-]+}", s.getLeaderboard)
+		t.Post("/leaderboards/{board_id:[a-z0-9_-]+}/scores", s.submitScore)
+		t.Get("/leaderboards/{board_id:[a-z0-9_-]+}/user_id/{user_id:[a-z0-9-.]+}", s.getLeaderboardAround)
 	})
 
-	if err := http.ListenAndServe(":"+servicePort, r); err != nil {
-		oplog.Err(err)
-	}
+	// for operators and other services, not for players
+	r.Route("/admin", func(t chi.Router) {
+		t.Use(adminAuth)
+		t.Use(validator)
+		t.Post("/grants", s.grantItems)
+		t.Post("/mails", s.sendMails)
+		t.Post("/leaderboards/{board_id:[a-z0-9_-]+}/rebuild", s.rebuildLeaderboard)
+		t.Get("/audit", s.getAuditLog)
+		t.Post("/users/{user_id:[a-z0-9-.]+}/balances/{currency:[a-z0-9_]+}", s.creditBalance)
+		t.Get("/users/{user_id:[a-z0-9-.]+}/bans", s.getBans)
+		t.Post("/users/{user_id:[a-z0-9-.]+}/bans", s.banUser)
+		t.Post("/users/{user_id:[a-z0-9-.]+}/bans/lift", s.liftBans)
+		t.Post("/users/{user_id:[a-z0-9-.]+}/restore", s.restoreUser)
+		t.Get("/users/{user_id:[a-z0-9-.]+}/items", s.getUserItemsForAdmin)
+		t.Delete("/users/{user_id:[a-z0-9-.]+}/items/{item_id:[a-z0-9-.]+}", s.deleteUserItem)
+		t.Post("/users/{user_id:[a-z0-9-.]+}/items/{item_id:[a-z0-9-.]+}/restore", s.restoreUserItem)
+		t.Get("/users/{user_id:[a-z0-9-.]+}/export", s.exportUser)
+		t.Post("/users/{user_id:[a-z0-9-.]+}/erase", s.eraseUser)
+	})
 
+	return r, nil
 }
 
 var errorRender = func(w http.ResponseWriter, r *http.Request, httpCode int, err error) {
 	render.Status(r, httpCode)
-	render.JSON(w, r, map[string]interface{}{"ERROR": err.Error()})
+	body := map[string]interface{}{"ERROR": err.Error()}
+	var invalid validationError
+	if errors.As(err, &invalid) {
+		body["FIELDS"] = invalid
+	}
+	render.JSON(w, r, body)
+}
+
+// map errors returned by GameUserOperation to http status code
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, errUserNotFound), errors.Is(err, errItemNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errDropTableNotFound), errors.Is(err, errDrawNotFound), errors.Is(err, errNoActiveCalendar):
+		return http.StatusNotFound
+	case errors.Is(err, errMailNotFound), errors.Is(err, errLeaderboardNotFound), errors.Is(err, errNotRanked):
+		return http.StatusNotFound
+	case errors.Is(err, errOfferNotFound), errors.Is(err, errCurrencyNotFound), errors.Is(err, errTradeNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errFriendRequestNotFound), errors.Is(err, errNotFriends), errors.Is(err, errNotBlocked):
+		return http.StatusNotFound
+	case errors.Is(err, errGuildNotFound), errors.Is(err, errNotGuildMember), errors.Is(err, errGuildItemNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errBlocked), errors.Is(err, errGuildPermission), errors.Is(err, errUserBanned):
+		return http.StatusForbidden
+	case errors.Is(err, errAlreadyInGuild), errors.Is(err, errGuildFull), errors.Is(err, errItemTimeLimited), errors.Is(err, errGuildHasItems):
+		return http.StatusConflict
+	case errors.Is(err, errAlreadyFriends), errors.Is(err, errAlreadyRequested), errors.Is(err, errFriendLimit):
+		return http.StatusConflict
+	case errors.Is(err, errMailExpired), errors.Is(err, errRetentionExpired):
+		return http.StatusGone
+	case errors.Is(err, errMailClaimed), errors.Is(err, errNotDeleted):
+		return http.StatusConflict
+	case errors.Is(err, errNameTaken), errors.Is(err, errAlreadyOwned):
+		return http.StatusConflict
+	case errors.Is(err, errNotOwned), errors.Is(err, errConcurrentModification), errors.Is(err, errTradeNotProposed):
+		return http.StatusConflict
+	case errors.Is(err, errInsufficientBalance), errors.Is(err, errAlreadyClaimed):
+		return http.StatusConflict
+	case errors.Is(err, errOfferNotAvailable), errors.Is(err, errSoldOut), errors.Is(err, errPurchaseLimit):
+		return http.StatusConflict
+	case errors.Is(err, errSelfTrade), errors.Is(err, errSelfFriend), errors.As(err, &validationError{}):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
 }
 
 func (s Serving) getUserItems(w http.ResponseWriter, r *http.Request) {
@@ -160,7 +333,13 @@ func (s Serving) getUserItems(w http.ResponseWriter, r *http.Request) {
 	trace := fmt.Sprintf("projects/%s/traces/%s", projectId, span.SpanContext().TraceID().String())
 	oplog.Info().Str("trace", trace).Str("spanId", span.SpanContext().SpanID().String()).Msg("test")
 
-	results, err := s.Client.userItems(ctx, w, userID)
+	page, err := parsePageParams(r)
+	if err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	results, err := s.Client.userItems(ctx, w, userID, page)
 	if err != nil {
 		errorRender(w, r, http.StatusInternalServerError, err)
 		return
@@ -184,9 +363,14 @@ func (s Serving) createUser(w http.ResponseWriter, r *http.Request) {
 	span.SetAttributes(attribute.String("server", "createUser"))
 	defer span.End()
 
+	if err := userNamePolicy.validate(userName); err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+
 	err := s.Client.createUser(ctx, w, userParams{userID: userId.String(), userName: userName})
 	if err != nil {
-		errorRender(w, r, http.StatusInternalServerError, err)
+		errorRender(w, r, errorStatus(err), err)
 		return
 	}
 	render.JSON(w, r, User{
@@ -195,6 +379,46 @@ func (s Serving) createUser(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func (s Serving) createUserWithBody(w http.ResponseWriter, r *http.Request) {
+	userId, _ := uuid.NewRandom()
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "createUserWithBody.root")
+	span.SetAttributes(attribute.String("server", "createUserWithBody"))
+	defer span.End()
+
+	var body createUserRequest
+	if err := render.DecodeJSON(r.Body, &body); err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if err := body.validate(); err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	err := s.Client.createUser(ctx, w, userParams{
+		userID:   userId.String(),
+		userName: body.Name,
+		locale:   body.Locale,
+		country:  body.Country,
+		platform: body.Platform,
+		timezone: body.Timezone,
+	})
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+	render.JSON(w, r, User{
+		Id:       userId.String(),
+		Name:     body.Name,
+		Locale:   body.Locale,
+		Country:  body.Country,
+		Platform: body.Platform,
+		Timezone: body.Timezone,
+	})
+}
+
 func (s Serving) addItemToUser(w http.ResponseWriter, r *http.Request) {
 	userID := chi.URLParam(r, "user_id")
 	itemID := chi.URLParam(r, "item_id")
@@ -206,12 +430,118 @@ func (s Serving) addItemToUser(w http.ResponseWriter, r *http.Request) {
 
 	err := s.Client.addItemToUser(ctx, w, userParams{userID: userID}, itemParams{itemID: itemID})
 	if err != nil {
-		errorRender(w, r, http.StatusInternalServerError, err)
+		errorRender(w, r, errorStatus(err), err)
 		return
 	}
+
+	publishEvent("items.granted", map[string]interface{}{"id": userID, "items": []string{itemID}})
+
 	render.JSON(w, r, map[string]string{})
 }
 
+func (s Serving) getUser(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "getUser.root")
+	span.SetAttributes(attribute.String("server", "getUser"))
+	defer span.End()
+
+	result, err := s.Client.userProfile(ctx, w, userID)
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+	// the profile is still returned without the count
+	if count, err := s.Client.friendCount(ctx, w, userID); err == nil {
+		result.FriendCount = &count
+	} else {
+		log.Println(err)
+	}
+	render.JSON(w, r, result)
+}
+
+func (s Serving) renameUser(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "renameUser.root")
+	span.SetAttributes(attribute.String("server", "renameUser"))
+	defer span.End()
+
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := render.DecodeJSON(r.Body, &body); err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if err := userNamePolicy.validate(body.Name); err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	err := s.Client.renameUser(ctx, w, userParams{userID: userID, userName: body.Name})
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+
+	publishEvent("user.renamed", map[string]interface{}{"id": userID, "name": body.Name})
+
+	render.JSON(w, r, User{
+		Id:   userID,
+		Name: body.Name,
+	})
+}
+
+func (s Serving) deleteUser(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "deleteUser.root")
+	span.SetAttributes(attribute.String("server", "deleteUser"))
+	defer span.End()
+
+	err := s.Client.deleteUser(ctx, w, userID)
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+
+	publishEvent("user.deleted", map[string]interface{}{"id": userID})
+
+	render.JSON(w, r, map[string]string{})
+}
+
+func (s Serving) userNameAvailable(w http.ResponseWriter, r *http.Request) {
+	userName := chi.URLParam(r, "user_name")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "userNameAvailable.root")
+	span.SetAttributes(attribute.String("server", "userNameAvailable"))
+	defer span.End()
+
+	result := map[string]interface{}{"name": userName, "available": false}
+	if err := userNamePolicy.validate(userName); err != nil {
+		result["reason"] = err.Error()
+		render.JSON(w, r, result)
+		return
+	}
+
+	taken, err := s.Client.userNameTaken(ctx, w, userName)
+	if err != nil {
+		errorRender(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if taken {
+		result["reason"] = errNameTaken.Error()
+	} else {
+		result["available"] = true
+	}
+	render.JSON(w, r, result)
+}
+
 func (s Serving) pingPong(w http.ResponseWriter, r *http.Request) {
 	render.Status(r, http.StatusOK)
 	render.PlainText(w, r, "Pong\n")
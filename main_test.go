@@ -21,23 +21,39 @@ Note: Before running this test, run spanner emulator and create an instance as "
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"cloud.google.com/go/spanner"
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-redis/redis"
+	"github.com/google/uuid"
 	gonanoid "github.com/matoous/go-nanoid"
+	"github.com/shin5ok/egg-architecting/gamepb"
 	"github.com/shin5ok/egg-architecting/testutil"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
 )
 
 var (
@@ -80,7 +96,7 @@ func init() {
 		DialTimeout: 1 * time.Second,
 	})
 
-	client, err := newClient(ctx, spannerString, rdb)
+	client, err := newClient(ctx, fakeDbString, rdb)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -90,16 +106,27 @@ func init() {
 	}
 
 	schemaFiles, _ := filepath.Glob("schemas/*_ddl.sql")
+	sortSchemaFiles(schemaFiles)
 	if err := testutil.InitData(ctx, fakeDbString, schemaFiles); err != nil {
 		log.Fatal(err)
 	}
 
 	dmlFiles, _ := filepath.Glob("schemas/*_dml.sql")
+	sortSchemaFiles(dmlFiles)
 	if err := testutil.MakeData(ctx, fakeDbString, dmlFiles); err != nil {
 		log.Fatal(err)
 	}
 }
 
+// schema files are applied in the order of their numbers, 100 comes after 99
+func sortSchemaFiles(files []string) {
+	number := func(file string) int {
+		n, _ := strconv.Atoi(strings.SplitN(filepath.Base(file), "-", 2)[0])
+		return n
+	}
+	sort.SliceStable(files, func(i, j int) bool { return number(files[i]) < number(files[j]) })
+}
+
 func Test_run(t *testing.T) {
 
 	req, err := http.NewRequest("GET", "/", nil)
@@ -139,6 +166,33 @@ func Test_createUser(t *testing.T) {
 
 }
 
+func Test_createUserWithBody(t *testing.T) {
+
+	// the order matters, the second one conflicts with the first one
+	cases := []struct {
+		body     string
+		expected int
+	}{
+		{`{"name": "テスト ユーザー", "locale": "ja-jp", "country": "jp", "platform": "ios"}`, http.StatusOK},
+		{`{"name": "テスト ユーザー"}`, http.StatusConflict},
+		{`{"name": "x", "country": "XX", "platform": "fax"}`, http.StatusBadRequest},
+		{`{"name": `, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		r := &http.Request{}
+		req, err := http.NewRequestWithContext(r.Context(), "POST", "/api/users", strings.NewReader(c.body))
+		assert.Nil(t, err)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(fakeServing.createUserWithBody)
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != c.expected {
+			t.Errorf("Expected: %d. Got: %d, Message: %s, Body: %s", c.expected, rr.Code, rr.Body, c.body)
+		}
+	}
+}
+
 // This test depends on Test_createUser
 func Test_addItemUser(t *testing.T) {
 
@@ -182,6 +236,1457 @@ func Test_getUserItems(t *testing.T) {
 	}
 }
 
+func Test_getUserItemsPaging(t *testing.T) {
+
+	ctx := chi.NewRouteContext()
+	ctx.URLParams.Add("user_id", userTestID)
+
+	r := &http.Request{}
+	uriPath := fmt.Sprintf("/api/user_id/%s?limit=1&sort=acquired_at&order=desc", userTestID)
+	req, err := http.NewRequestWithContext(r.Context(), "GET", uriPath, nil)
+	assert.Nil(t, err)
+	newReq := req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, ctx))
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(fakeServing.getUserItems)
+	handler.ServeHTTP(rr, newReq)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("Expected: %d. Got: %d, Message: %s", http.StatusOK, rr.Code, rr.Body)
+	}
+	var page itemPage
+	json.Unmarshal(rr.Body.Bytes(), &page)
+	assert.Equal(t, 1, len(page.Items))
+	assert.Equal(t, "", page.NextCursor)
+
+}
+
+func Test_getUserItemsBadCursor(t *testing.T) {
+
+	ctx := chi.NewRouteContext()
+	ctx.URLParams.Add("user_id", userTestID)
+
+	r := &http.Request{}
+	cursor := encodeCursor(pageCursor{Sort: "item_name", ItemID: itemTestID})
+	uriPath := fmt.Sprintf("/api/user_id/%s?sort=item_id&cursor=%s", userTestID, cursor)
+	req, err := http.NewRequestWithContext(r.Context(), "GET", uriPath, nil)
+	assert.Nil(t, err)
+	newReq := req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, ctx))
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(fakeServing.getUserItems)
+	handler.ServeHTTP(rr, newReq)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("Expected: %d. Got: %d, Message: %s", http.StatusBadRequest, rr.Code, rr.Body)
+	}
+}
+
+func Test_getUser(t *testing.T) {
+
+	ctx := chi.NewRouteContext()
+	ctx.URLParams.Add("user_id", userTestID)
+
+	r := &http.Request{}
+	uriPath := fmt.Sprintf("/api/user_id/%s/profile", userTestID)
+	req, err := http.NewRequestWithContext(r.Context(), "GET", uriPath, nil)
+	assert.Nil(t, err)
+	newReq := req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, ctx))
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(fakeServing.getUser)
+	handler.ServeHTTP(rr, newReq)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("Expected: %d. Got: %d, Message: %s", http.StatusOK, rr.Code, rr.Body)
+	}
+	var u userProfile
+	json.Unmarshal(rr.Body.Bytes(), &u)
+	assert.Equal(t, userTestID, u.Id)
+}
+
+func Test_renameUser(t *testing.T) {
+
+	ctx := chi.NewRouteContext()
+	ctx.URLParams.Add("user_id", userTestID)
+
+	r := &http.Request{}
+	uriPath := fmt.Sprintf("/api/user_id/%s", userTestID)
+	body := strings.NewReader(`{"name": "test-user-renamed"}`)
+	req, err := http.NewRequestWithContext(r.Context(), "PATCH", uriPath, body)
+	assert.Nil(t, err)
+	newReq := req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, ctx))
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(fakeServing.renameUser)
+	handler.ServeHTTP(rr, newReq)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("Expected: %d. Got: %d, Message: %s", http.StatusOK, rr.Code, rr.Body)
+	}
+}
+
+func Test_deleteUser(t *testing.T) {
+
+	userID := uuid.NewString()
+	err := fakeServing.Client.createUser(context.Background(), io.Discard, userParams{userID: userID, userName: "test-user-deleted"})
+	assert.Nil(t, err)
+
+	for _, expected := range []int{http.StatusOK, http.StatusNotFound} {
+		ctx := chi.NewRouteContext()
+		ctx.URLParams.Add("user_id", userID)
+
+		r := &http.Request{}
+		uriPath := fmt.Sprintf("/api/user_id/%s", userID)
+		req, err := http.NewRequestWithContext(r.Context(), "DELETE", uriPath, nil)
+		assert.Nil(t, err)
+		newReq := req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, ctx))
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(fakeServing.deleteUser)
+		handler.ServeHTTP(rr, newReq)
+
+		if status := rr.Code; status != expected {
+			t.Errorf("Expected: %d. Got: %d, Message: %s", expected, rr.Code, rr.Body)
+		}
+	}
+}
+
+func Test_userNameAvailable(t *testing.T) {
+
+	cases := map[string]bool{
+		"test-user-renamed": false,
+		"TEST-USER-RENAMED": false,
+		"x":                 false,
+		"someone-new":       true,
+	}
+	for name, expected := range cases {
+		ctx := chi.NewRouteContext()
+		ctx.URLParams.Add("user_name", name)
+
+		r := &http.Request{}
+		uriPath := fmt.Sprintf("/api/user_name/%s/available", name)
+		req, err := http.NewRequestWithContext(r.Context(), "GET", uriPath, nil)
+		assert.Nil(t, err)
+		newReq := req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, ctx))
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(fakeServing.userNameAvailable)
+		handler.ServeHTTP(rr, newReq)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("Expected: %d. Got: %d, Message: %s", http.StatusOK, rr.Code, rr.Body)
+		}
+		var result map[string]interface{}
+		json.Unmarshal(rr.Body.Bytes(), &result)
+		assert.Equal(t, expected, result["available"], name)
+	}
+}
+
+func Test_createUserDuplicatedName(t *testing.T) {
+
+	err := fakeServing.Client.createUser(context.Background(), io.Discard, userParams{userID: uuid.NewString(), userName: "Test-User-Renamed"})
+	assert.ErrorIs(t, err, errNameTaken)
+}
+
+func Test_namePolicy(t *testing.T) {
+
+	p := userNamePolicy
+	p.reserved = []string{"admin"}
+
+	assert.Nil(t, p.validate("foo"))
+	assert.NotNil(t, p.validate("fo"))
+	assert.NotNil(t, p.validate(strings.Repeat("a", 33)))
+	assert.Nil(t, p.validate("foo bar"))
+	assert.Nil(t, p.validate("テストユーザー"))
+	assert.NotNil(t, p.validate("foo  bar"))
+	assert.NotNil(t, p.validate("foo!"))
+	assert.NotNil(t, p.validate("the-admin"))
+}
+
+// Requests go through the router with response validation,
+// so that the OpenAPI spec doesn't drift from the handlers
+func Test_openapi(t *testing.T) {
+
+	router, err := newRouter(fakeServing, true)
+	assert.Nil(t, err)
+
+	cases := []struct {
+		method   string
+		path     string
+		body     string
+		expected int
+	}{
+		{"GET", "/ping", "", http.StatusOK},
+		{"GET", "/openapi.json", "", http.StatusOK},
+		{"POST", "/api/users", `{"name": "openapi-user", "platform": "web"}`, http.StatusOK},
+		{"POST", "/api/users", `{"platform": "web"}`, http.StatusBadRequest},
+		{"GET", "/api/user_name/openapi-user/available", "", http.StatusOK},
+		{"GET", "/api/user_id/" + userTestID + "?limit=10&sort=item_name", "", http.StatusOK},
+		{"GET", "/api/user_id/" + userTestID + "?limit=0", "", http.StatusBadRequest},
+		{"GET", "/api/user_id/" + userTestID + fmt.Sprintf("?limit=%d", maxPageLimit), "", http.StatusOK},
+		{"GET", "/api/user_id/" + userTestID + fmt.Sprintf("?limit=%d", maxPageLimit+1), "", http.StatusBadRequest},
+		{"GET", "/api/user_id/" + userTestID + "/profile", "", http.StatusOK},
+		{"GET", "/api/user_id/no-such-user/profile", "", http.StatusNotFound},
+	}
+	for _, c := range cases {
+		req, err := http.NewRequest(c.method, c.path, strings.NewReader(c.body))
+		assert.Nil(t, err)
+		if c.body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != c.expected {
+			t.Errorf("%s %s Expected: %d. Got: %d, Message: %s", c.method, c.path, c.expected, rr.Code, rr.Body)
+		}
+	}
+
+	// the spec allows the same page size as the code
+	doc, err := loadOpenapiSpec()
+	assert.Nil(t, err)
+	for _, path := range []string{"/api/user_id/{user_id}", "/admin/users/{user_id}/items"} {
+		limit := doc.Paths.Find(path).Get.Parameters.GetByInAndName("query", "limit")
+		assert.Equal(t, float64(maxPageLimit), *limit.Schema.Value.Max, path)
+	}
+}
+
+func Test_grpc(t *testing.T) {
+
+	lis := bufconn.Listen(1024 * 1024)
+	server := newGRPCServer(fakeServing.Client, newRateLimiter(nil), defaultRateLimits["api"])
+	go server.Serve(lis)
+	defer server.Stop()
+
+	ctx := context.Background()
+	conn, err := grpc.DialContext(ctx, "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	assert.Nil(t, err)
+	defer conn.Close()
+	client := gamepb.NewGameServiceClient(conn)
+
+	user, err := client.CreateUser(ctx, &gamepb.CreateUserRequest{Name: "grpc-user", Platform: "pc"})
+	assert.Nil(t, err)
+
+	_, err = client.CreateUser(ctx, &gamepb.CreateUserRequest{Name: "grpc-user"})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	_, err = client.CreateUser(ctx, &gamepb.CreateUserRequest{Name: "grpc-user-2", Country: "XX"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = client.AddItemToUser(ctx, &gamepb.AddItemToUserRequest{UserId: user.GetId(), ItemId: itemTestID})
+	assert.Nil(t, err)
+
+	items, err := client.ListUserItems(ctx, &gamepb.ListUserItemsRequest{UserId: user.GetId(), PageSize: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(items.GetItems()))
+	assert.Equal(t, itemTestID, items.GetItems()[0].GetItemId())
+	assert.NotNil(t, items.GetItems()[0].GetCreatedAt())
+	assert.Equal(t, items.GetItems()[0].GetCreatedAt().AsTime(), items.GetItems()[0].GetUpdatedAt().AsTime())
+
+	_, err = client.ListUserItems(ctx, &gamepb.ListUserItemsRequest{UserId: user.GetId(), Sort: "price"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func Test_grpcInterceptors(t *testing.T) {
+
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}})
+	info := &grpc.UnaryServerInfo{FullMethod: "/game.GameService/ListUserItems"}
+
+	// a panic is returned as INTERNAL, and the server keeps running
+	_, err := grpcRecoverer(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		panic("broken handler")
+	})
+	assert.Equal(t, codes.Internal, status.Code(err))
+
+	limit := grpcRateLimit(newRateLimiter(nil), rateLimit{rate: 1, burst: 2})
+	ok := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+	for i, expected := range []codes.Code{codes.OK, codes.OK, codes.ResourceExhausted} {
+		_, err := limit(ctx, nil, info, ok)
+		assert.Equal(t, expected, status.Code(err), i)
+	}
+
+	// another client has its own bucket
+	other := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1234}})
+	_, err = limit(other, nil, info, ok)
+	assert.Nil(t, err)
+}
+
+func Test_rateLimit(t *testing.T) {
+
+	limiter := newRateLimiter(nil)
+	handler := limiter.limit("test", rateLimit{rate: 1, burst: 2})(http.HandlerFunc(fakeServing.pingPong))
+
+	for i, expected := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		req, err := http.NewRequest("GET", "/ping", nil)
+		assert.Nil(t, err)
+		req.RemoteAddr = "192.0.2.1:1234"
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != expected {
+			t.Errorf("#%d Expected: %d. Got: %d, Message: %s", i, expected, rr.Code, rr.Body)
+		}
+		assert.Equal(t, "2", rr.Header().Get("RateLimit-Limit"))
+		if expected == http.StatusTooManyRequests {
+			assert.Equal(t, "1", rr.Header().Get("Retry-After"))
+		}
+	}
+
+	// another client has its own bucket
+	req, _ := http.NewRequest("GET", "/ping", nil)
+	req.RemoteAddr = "192.0.2.2:1234"
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// X-Forwarded-For is used only as far as the trusted proxies appended
+	hops := trustedProxyHops
+	trustedProxyHops = 0
+	req.Header.Set("X-Forwarded-For", "203.0.113.1, 192.0.2.3, 198.51.100.1")
+	assert.Equal(t, "ip:192.0.2.2", clientKey(req.Header.Get, req.RemoteAddr))
+	trustedProxyHops = 2
+	assert.Equal(t, "ip:192.0.2.3", clientKey(req.Header.Get, req.RemoteAddr))
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	assert.Equal(t, "ip:192.0.2.2", clientKey(req.Header.Get, req.RemoteAddr))
+	trustedProxyHops = hops
+
+	// the API key comes before the address
+	req.Header.Set("X-API-Key", "some-key")
+	assert.True(t, strings.HasPrefix(clientKey(req.Header.Get, req.RemoteAddr), "key:"))
+}
+
+func Test_grantItems(t *testing.T) {
+
+	otherItemID := "46f026ae-c6e9-4e41-82e5-240c7645a553"
+	body := fmt.Sprintf(`{"grants": [
+		{"user_id": "%[1]s", "item_id": "%[2]s"},
+		{"user_id": "%[1]s", "item_id": "%[2]s"},
+		{"user_id": "%[1]s", "item_id": "%[3]s"},
+		{"user_id": "%[1]s", "item_id": "no-such-item"},
+		{"user_id": "no-such-user", "item_id": "%[2]s"}
+	]}`, userTestID, otherItemID, itemTestID)
+
+	r := &http.Request{}
+	req, err := http.NewRequestWithContext(r.Context(), "POST", "/admin/grants", strings.NewReader(body))
+	assert.Nil(t, err)
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(fakeServing.grantItems)
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("Expected: %d. Got: %d, Message: %s", http.StatusOK, rr.Code, rr.Body)
+	}
+	var res struct {
+		Results []grantResult `json:"results"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &res)
+	statuses := []string{}
+	for _, r := range res.Results {
+		statuses = append(statuses, r.Status)
+	}
+	assert.Equal(t, []string{grantGranted, grantAlreadyOwned, grantAlreadyOwned, grantUnknownItem, grantUnknownUser}, statuses)
+
+	// a single grant is the same
+	err = fakeServing.Client.addItemToUser(context.Background(), io.Discard, userParams{userID: userTestID}, itemParams{itemID: otherItemID})
+	assert.ErrorIs(t, err, errAlreadyOwned)
+}
+
+func Test_giftAndTrade(t *testing.T) {
+
+	ctx := context.Background()
+	item1 := "7470b7c2-c4ef-449e-bd6a-0471a7d258e8"
+	item2 := "6d027790-3e97-4e84-9131-98295b1ce2b3"
+	userA, userB := uuid.NewString(), uuid.NewString()
+	assert.Nil(t, fakeServing.Client.createUser(ctx, io.Discard, userParams{userID: userA, userName: "trade-user-a"}))
+	assert.Nil(t, fakeServing.Client.createUser(ctx, io.Discard, userParams{userID: userB, userName: "trade-user-b"}))
+	_, err := fakeServing.Client.grantItems(ctx, io.Discard, []grantParams{{userID: userA, itemID: item1}, {userID: userA, itemID: item2}})
+	assert.Nil(t, err)
+
+	gift := func(from, to, itemID string) int {
+		routeCtx := chi.NewRouteContext()
+		routeCtx.URLParams.Add("user_id", from)
+		body := fmt.Sprintf(`{"to_user_id": "%s", "item_id": "%s"}`, to, itemID)
+		req, err := http.NewRequest("POST", "/api/user_id/"+from+"/gifts", strings.NewReader(body))
+		assert.Nil(t, err)
+		newReq := req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, routeCtx))
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(fakeServing.sendGift).ServeHTTP(rr, newReq)
+		return rr.Code
+	}
+	assert.Equal(t, http.StatusOK, gift(userA, userB, item1))
+	assert.Equal(t, http.StatusConflict, gift(userA, userB, item1))
+	assert.Equal(t, http.StatusBadRequest, gift(userA, userA, item2))
+	assert.Equal(t, http.StatusNotFound, gift(userA, "no-such-user", item2))
+
+	proposeTrade := func(body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "/api/trades", strings.NewReader(body))
+		assert.Nil(t, err)
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(fakeServing.tradeItems).ServeHTTP(rr, req)
+		return rr
+	}
+	change := func(userID, tradeID, action string) int {
+		routeCtx := chi.NewRouteContext()
+		routeCtx.URLParams.Add("user_id", userID)
+		routeCtx.URLParams.Add("trade_id", tradeID)
+		routeCtx.URLParams.Add("action", action)
+		req, err := http.NewRequest("POST", "/api/user_id/"+userID+"/trades/"+tradeID+"/"+action, nil)
+		assert.Nil(t, err)
+		newReq := req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, routeCtx))
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(fakeServing.changeTrade).ServeHTTP(rr, newReq)
+		return rr.Code
+	}
+	body := fmt.Sprintf(`{"user_id": "%s", "item_ids": ["%s"], "partner_id": "%s", "partner_item_ids": ["%s"]}`, userA, item2, userB, item1)
+	rr := proposeTrade(body)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var proposed trade
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &proposed))
+	assert.Equal(t, tradeStatusProposed, proposed.Status)
+
+	// nothing is moved until the partner accepts
+	page, err := fakeServing.Client.userItems(ctx, io.Discard, userA, pageParams{limit: 10, sort: "item_id"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(page.Items))
+	assert.Equal(t, item2, page.Items[0]["item_id"])
+
+	trades, err := fakeServing.Client.trades(ctx, io.Discard, userB, tradeStatusProposed)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(trades))
+	assert.Equal(t, proposed.TradeID, trades[0].TradeID)
+
+	// only the partner accepts it
+	assert.Equal(t, http.StatusNotFound, change(userA, proposed.TradeID, tradeActionAccept))
+	assert.Equal(t, http.StatusOK, change(userB, proposed.TradeID, tradeActionAccept))
+	assert.Equal(t, http.StatusConflict, change(userB, proposed.TradeID, tradeActionAccept))
+	assert.Equal(t, http.StatusConflict, change(userA, proposed.TradeID, tradeActionCancel))
+
+	// userA doesn't have item2 anymore
+	assert.Equal(t, http.StatusConflict, proposeTrade(body).Code)
+	assert.Equal(t, http.StatusBadRequest, proposeTrade(fmt.Sprintf(`{"user_id": "%s", "item_ids": ["%s"], "partner_id": "%s", "partner_item_ids": []}`, userA, item1, userB)).Code)
+
+	// a declined trade moves nothing
+	rr = proposeTrade(fmt.Sprintf(`{"user_id": "%s", "item_ids": ["%s"], "partner_id": "%s", "partner_item_ids": ["%s"]}`, userA, item1, userB, item2))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &proposed))
+	assert.Equal(t, http.StatusOK, change(userB, proposed.TradeID, tradeActionDecline))
+	assert.Equal(t, http.StatusConflict, change(userB, proposed.TradeID, tradeActionAccept))
+
+	page, err = fakeServing.Client.userItems(ctx, io.Discard, userA, pageParams{limit: 10, sort: "item_id"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(page.Items))
+	assert.Equal(t, item1, page.Items[0]["item_id"])
+
+	// the item is moved away and back by other requests after it's read
+	client := fakeServing.Client.(dbClient)
+	keys := []spanner.KeySet{spanner.Key{userA, item1}}
+	before, err := itemVersions(ctx, client.sc.Single(), keys)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, gift(userA, userB, item1))
+	assert.Equal(t, http.StatusOK, gift(userB, userA, item1))
+	_, err = client.sc.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		return unchangedInTxn(ctx, txn, keys, before)
+	})
+	assert.ErrorIs(t, err, errConcurrentModification)
+}
+
+func Test_drawItemsOdds(t *testing.T) {
+
+	table := dropTable{
+		entries: []dropTableEntry{
+			{ItemID: "a", Weight: 70, Rarity: "R"},
+			{ItemID: "b", Weight: 25, Rarity: "SR"},
+			{ItemID: "c", Weight: 5, Rarity: "SSR"},
+		},
+	}
+	odds := table.odds()
+
+	// the same seed gives the same results
+	first, _ := drawItems(table, 42, 10, 0)
+	second, _ := drawItems(table, 42, 10, 0)
+	assert.Equal(t, first, second)
+
+	n := 100000
+	results, _ := drawItems(table, 1, n, 0)
+	counts := map[string]int{}
+	for _, r := range results {
+		counts[r.ItemID]++
+	}
+	for _, e := range odds.Entries {
+		assert.InDelta(t, e.Probability, float64(counts[e.ItemID])/float64(n), 0.01, e.ItemID)
+	}
+
+	// pity gives SSR at the 10th draw without SSR
+	table.pityThreshold = 10
+	table.pityRarity = "SSR"
+	results, pity := drawItems(table, 1, 1, 9)
+	assert.Equal(t, "c", results[0].ItemID)
+	assert.True(t, results[0].Pity)
+	assert.Equal(t, int64(0), pity)
+}
+
+func Test_gacha(t *testing.T) {
+
+	ctx := context.Background()
+	dropTableID := "0a4e9f7e-51b4-4f0a-9a43-4b8f2f1c5d01"
+	userID := uuid.NewString()
+	assert.Nil(t, fakeServing.Client.createUser(ctx, io.Discard, userParams{userID: userID, userName: "gacha-user"}))
+
+	odds, err := fakeServing.Client.dropTableOdds(ctx, io.Discard, dropTableID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), odds.Cost)
+	assert.Equal(t, 64, len(odds.TableHash))
+
+	draw := func(count int) *httptest.ResponseRecorder {
+		routeCtx := chi.NewRouteContext()
+		routeCtx.URLParams.Add("user_id", userID)
+		body := fmt.Sprintf(`{"drop_table_id": "%s", "count": %d}`, dropTableID, count)
+		req, err := http.NewRequest("POST", "/api/user_id/"+userID+"/draws", strings.NewReader(body))
+		assert.Nil(t, err)
+		newReq := req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, routeCtx))
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(fakeServing.drawGacha).ServeHTTP(rr, newReq)
+		return rr
+	}
+	assert.Equal(t, http.StatusConflict, draw(1).Code)
+	assert.Equal(t, http.StatusBadRequest, draw(11).Code)
+
+	_, err = fakeServing.Client.creditBalance(ctx, io.Discard, userID, "gem", 1000, reasonCredit, uuid.NewString())
+	assert.Nil(t, err)
+
+	rr := draw(10)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var result drawResult
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &result))
+	assert.Equal(t, odds.TableHash, result.TableHash)
+	assert.Equal(t, 10, len(result.Results))
+
+	assert.Equal(t, int64(1000), result.Cost)
+	assert.Equal(t, int64(0), *result.Balance)
+
+	// the record replays to the same results
+	record, err := fakeServing.Client.gachaDraw(ctx, io.Discard, userID, result.DrawID)
+	assert.Nil(t, err)
+	table, err := readDropTable(ctx, fakeServing.Client.(dbClient).sc.Single(), dropTableID)
+	assert.Nil(t, err)
+	replayed, _ := drawItems(table, record.Seed, len(record.Results), record.PityBefore)
+	for i := range replayed {
+		assert.Equal(t, replayed[i].ItemID, record.Results[i].ItemID)
+	}
+
+	_, err = fakeServing.Client.gachaDraw(ctx, io.Discard, userID, "no-such-draw")
+	assert.ErrorIs(t, err, errDrawNotFound)
+}
+
+func Test_gachaDuplicate(t *testing.T) {
+
+	ctx := context.Background()
+	dropTableID := "0a4e9f7e-51b4-4f0a-9a43-4b8f2f1c5d01"
+	userID := uuid.NewString()
+	assert.Nil(t, fakeServing.Client.createUser(ctx, io.Discard, userParams{userID: userID, userName: "gacha-duplicate"}))
+
+	// the user has every item of the drop table
+	odds, err := fakeServing.Client.dropTableOdds(ctx, io.Discard, dropTableID)
+	assert.Nil(t, err)
+	grants := []grantParams{}
+	for _, e := range odds.Entries {
+		grants = append(grants, grantParams{userID: userID, itemID: e.ItemID})
+	}
+	_, err = fakeServing.Client.grantItems(ctx, io.Discard, grants)
+	assert.Nil(t, err)
+
+	_, err = fakeServing.Client.creditBalance(ctx, io.Discard, userID, "gem", 100, reasonCredit, uuid.NewString())
+	assert.Nil(t, err)
+
+	result, err := fakeServing.Client.drawGacha(ctx, io.Discard, drawParams{userID: userID, dropTableID: dropTableID, count: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, grantAlreadyOwned, result.Results[0].Status)
+	assert.Equal(t, int64(100), result.Cost)
+	assert.Equal(t, int64(0), *result.Balance)
+
+	ledger, err := fakeServing.Client.ledger(ctx, io.Discard, userID, "gem", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(ledger))
+}
+
+func Test_loginBonus(t *testing.T) {
+
+	ctx := context.Background()
+	userID := uuid.NewString()
+	assert.Nil(t, fakeServing.Client.createUser(ctx, io.Discard, userParams{userID: userID, userName: "login-user", timezone: "Asia/Tokyo"}))
+
+	claim := func() *httptest.ResponseRecorder {
+		routeCtx := chi.NewRouteContext()
+		routeCtx.URLParams.Add("user_id", userID)
+		req, err := http.NewRequest("POST", "/api/user_id/"+userID+"/login_bonus", nil)
+		assert.Nil(t, err)
+		newReq := req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, routeCtx))
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(fakeServing.claimLoginBonus).ServeHTTP(rr, newReq)
+		return rr
+	}
+
+	rr := claim()
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var first loginClaim
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &first))
+	assert.Equal(t, int64(1), first.Day)
+	assert.Equal(t, int64(1), first.Streak)
+	assert.Equal(t, grantGranted, first.Results[0].Status)
+	assert.Equal(t, http.StatusConflict, claim().Code)
+
+	status, err := fakeServing.Client.loginBonus(ctx, io.Discard, userID)
+	assert.Nil(t, err)
+	assert.True(t, status.ClaimedToday)
+	assert.Equal(t, int64(2), status.NextDay)
+
+	// pretend the last claim was yesterday
+	_, err = fakeServing.Client.(dbClient).sc.Apply(ctx, []*spanner.Mutation{
+		spanner.Update("login_claims", []string{"user_id", "season_id", "last_claim_date"},
+			[]interface{}{userID, first.SeasonID, first.Date.AddDays(-1)}),
+	})
+	assert.Nil(t, err)
+
+	rr = claim()
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var second loginClaim
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &second))
+	assert.Equal(t, int64(2), second.Day)
+	assert.Equal(t, int64(2), second.Streak)
+}
+
+func Test_mailbox(t *testing.T) {
+
+	ctx := context.Background()
+	itemID := "c54189f2-6211-4ad7-805e-23899b94c456"
+	userID := uuid.NewString()
+	assert.Nil(t, fakeServing.Client.createUser(ctx, io.Discard, userParams{userID: userID, userName: "mail-user", country: "NZ"}))
+
+	send := func(body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "/admin/mails", strings.NewReader(body))
+		assert.Nil(t, err)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(fakeServing.sendMails).ServeHTTP(rr, req)
+		return rr
+	}
+	rr := send(fmt.Sprintf(`{"user_ids": ["%s"], "subject": "sorry", "item_ids": ["%s"]}`, userID, itemID))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var sent struct {
+		MailID     string `json:"mail_id"`
+		Recipients int    `json:"recipients"`
+	}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &sent))
+	assert.Equal(t, 1, sent.Recipients)
+	assert.Equal(t, http.StatusOK, send(fmt.Sprintf(`{"segment": {"country": "NZ"}, "subject": "event", "item_ids": ["%s"]}`, itemID)).Code)
+	assert.Equal(t, http.StatusBadRequest, send(`{"segment": {}, "subject": "everyone"}`).Code)
+	assert.Equal(t, http.StatusNotFound, send(`{"user_ids": ["no-such-user"], "subject": "nobody"}`).Code)
+
+	mails, err := fakeServing.Client.mails(ctx, io.Discard, userID)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(mails))
+
+	claim := func(path string, handler http.HandlerFunc, mailID string) *httptest.ResponseRecorder {
+		routeCtx := chi.NewRouteContext()
+		routeCtx.URLParams.Add("user_id", userID)
+		routeCtx.URLParams.Add("mail_id", mailID)
+		req, err := http.NewRequest("POST", path, nil)
+		assert.Nil(t, err)
+		newReq := req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, routeCtx))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, newReq)
+		return rr
+	}
+	path := "/api/user_id/" + userID + "/mails/" + sent.MailID + "/claim"
+	assert.Equal(t, http.StatusOK, claim(path, fakeServing.claimMail, sent.MailID).Code)
+	assert.Equal(t, http.StatusConflict, claim(path, fakeServing.claimMail, sent.MailID).Code)
+
+	// the other mail has the same item, which is owned already
+	rr = claim("/api/user_id/"+userID+"/mails/claim", fakeServing.claimAllMails, "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var claimed struct {
+		Claims []mailClaim `json:"claims"`
+	}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &claimed))
+	assert.Equal(t, 1, len(claimed.Claims))
+	assert.Equal(t, grantAlreadyOwned, claimed.Claims[0].Results[0].Status)
+
+	// the item is kept in the mail, not lost
+	assert.False(t, claimed.Claims[0].Claimed)
+	assert.Equal(t, []string{itemID}, claimed.Claims[0].KeptItemIDs)
+	mails, err = fakeServing.Client.mails(ctx, io.Discard, userID)
+	assert.Nil(t, err)
+	for _, m := range mails {
+		if m.MailID == claimed.Claims[0].MailID {
+			assert.False(t, m.Claimed)
+			assert.Equal(t, []string{itemID}, m.ItemIDs)
+		}
+	}
+
+	// admin API is disabled without ADMIN_TOKEN
+	req, err := http.NewRequest("POST", "/admin/mails", nil)
+	assert.Nil(t, err)
+	rr = httptest.NewRecorder()
+	adminAuth(http.HandlerFunc(fakeServing.sendMails)).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func Test_leaderboardSeason(t *testing.T) {
+
+	// Sunday
+	now := time.Date(2023, 1, 8, 15, 0, 0, 0, time.UTC)
+	cases := []struct {
+		period string
+		season string
+		ends   time.Time
+	}{
+		{"none", "all", time.Time{}},
+		{"daily", "2023-01-08", time.Date(2023, 1, 9, 0, 0, 0, 0, time.UTC)},
+		{"weekly", "2023-W01", time.Date(2023, 1, 9, 0, 0, 0, 0, time.UTC)},
+		{"monthly", "2023-01", time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		season, ends := leaderboard{period: c.period}.season(now)
+		assert.Equal(t, c.season, season, c.period)
+		assert.Equal(t, c.ends, ends, c.period)
+	}
+}
+
+func Test_leaderboard(t *testing.T) {
+
+	ctx := context.Background()
+	boardID := "weekly_score"
+	userIDs := []string{}
+	for i, score := range []int64{100, 300, 200} {
+		userID := uuid.NewString()
+		userIDs = append(userIDs, userID)
+		assert.Nil(t, fakeServing.Client.createUser(ctx, io.Discard, userParams{userID: userID, userName: fmt.Sprintf("board-user-%d", i)}))
+
+		body := fmt.Sprintf(`{"user_id": "%s", "score": %d}`, userID, score)
+		routeCtx := chi.NewRouteContext()
+		routeCtx.URLParams.Add("board_id", boardID)
+		req, err := http.NewRequest("POST", "/api/leaderboards/"+boardID+"/scores", strings.NewReader(body))
+		assert.Nil(t, err)
+		newReq := req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, routeCtx))
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(fakeServing.submitScore).ServeHTTP(rr, newReq)
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+
+	// a lower score doesn't replace the best one
+	entry, err := fakeServing.Client.submitScore(ctx, io.Discard, boardID, userIDs[1], 10)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(300), entry.Score)
+
+	top, err := fakeServing.Client.leaderboardTop(ctx, io.Discard, boardID, "", 10)
+	assert.Nil(t, err)
+	assert.True(t, len(top.Entries) >= 3)
+
+	around, err := fakeServing.Client.leaderboardAround(ctx, io.Discard, boardID, "", userIDs[2], 1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(200), around.User.Score)
+	assert.Equal(t, 3, len(around.Entries))
+
+	// the board comes back from Spanner after Redis loses it
+	season, key := leaderboard{id: boardID, period: "weekly"}.seasonKey("")
+	assert.Nil(t, fakeServing.Client.(dbClient).cache.Del(key).Err())
+	count, err := fakeServing.Client.rebuildLeaderboard(ctx, io.Discard, boardID, season)
+	assert.Nil(t, err)
+	assert.True(t, count >= 3)
+	around, err = fakeServing.Client.leaderboardAround(ctx, io.Discard, boardID, season, userIDs[2], 0)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(200), around.User.Score)
+
+	_, err = fakeServing.Client.leaderboardTop(ctx, io.Discard, "no_such_board", "", 10)
+	assert.ErrorIs(t, err, errLeaderboardNotFound)
+}
+
+func Test_achievements(t *testing.T) {
+
+	ctx := context.Background()
+	userID := uuid.NewString()
+	assert.Nil(t, fakeServing.Client.createUser(ctx, io.Discard, userParams{userID: userID, userName: "achievement-user"}))
+
+	// 10 items by 10 draws, which spend 1000 gems
+	_, err := fakeServing.Client.creditBalance(ctx, io.Discard, userID, "gem", 1000, reasonCredit, uuid.NewString())
+	assert.Nil(t, err)
+	_, err = fakeServing.Client.drawGacha(ctx, io.Discard, drawParams{userID: userID, dropTableID: "0a4e9f7e-51b4-4f0a-9a43-4b8f2f1c5d01", count: 10})
+	assert.Nil(t, err)
+
+	completed, err := fakeServing.Client.updateAchievements(ctx, io.Discard, userID)
+	assert.Nil(t, err)
+	ids := []string{}
+	for _, p := range completed {
+		ids = append(ids, p.AchievementID)
+	}
+	assert.Contains(t, ids, "spend_1000_gems")
+
+	// nothing is completed twice
+	completed, err = fakeServing.Client.updateAchievements(ctx, io.Discard, userID)
+	assert.Nil(t, err)
+	for _, p := range completed {
+		assert.NotContains(t, ids, p.AchievementID)
+	}
+
+	routeCtx := chi.NewRouteContext()
+	routeCtx.URLParams.Add("user_id", userID)
+	req, err := http.NewRequest("GET", "/api/user_id/"+userID+"/achievements", nil)
+	assert.Nil(t, err)
+	newReq := req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, routeCtx))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(fakeServing.getAchievements).ServeHTTP(rr, newReq)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var res struct {
+		Achievements []achievementProgress `json:"achievements"`
+	}
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &res))
+	for _, p := range res.Achievements {
+		switch p.AchievementID {
+		case "spend_1000_gems":
+			assert.True(t, p.Completed)
+			assert.Equal(t, int64(1000), p.Progress)
+		case "login_7_days":
+			assert.False(t, p.Completed)
+		}
+	}
+}
+
+func Test_itemExpiry(t *testing.T) {
+
+	ctx := context.Background()
+	client := fakeServing.Client.(dbClient)
+	expiring := "ddb6c0d3-c63f-4dd4-a8be-9096f79e249d"
+	permanent := "8872e50a-d627-4737-9c99-c540fd550f6b"
+	userID := uuid.NewString()
+	assert.Nil(t, client.createUser(ctx, io.Discard, userParams{userID: userID, userName: "expiry-user"}))
+	_, err := client.grantItems(ctx, io.Discard, []grantParams{
+		{userID: userID, itemID: expiring, expiresAt: time.Now().Add(-time.Minute)},
+		{userID: userID, itemID: permanent},
+	})
+	assert.Nil(t, err)
+
+	page, err := client.userItems(ctx, io.Discard, userID, pageParams{limit: 10, sort: "item_id"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(page.Items))
+	assert.Equal(t, permanent, page.Items[0]["item_id"])
+
+	page, err = client.userItems(ctx, io.Discard, userID, pageParams{limit: 10, sort: "item_id", includeExpired: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(page.Items))
+
+	// expired items can't be given away
+	other := uuid.NewString()
+	assert.Nil(t, client.createUser(ctx, io.Discard, userParams{userID: other, userName: "expiry-other"}))
+	_, err = client.tradeItems(ctx, io.Discard, tradeParams{userID: userID, itemIDs: []string{expiring}, partnerID: other})
+	assert.ErrorIs(t, err, errNotOwned)
+
+	n, err := client.reapExpiredItems(ctx, time.Now())
+	assert.Nil(t, err)
+	assert.True(t, n >= 1)
+
+	page, err = client.userItems(ctx, io.Discard, userID, pageParams{limit: 10, sort: "item_id", includeExpired: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(page.Items))
+}
+
+func Test_shop(t *testing.T) {
+
+	ctx := context.Background()
+	starter := "3f9a7c2e-6b1d-4e8f-a0c5-9d2b4e6f8a10"
+	limited := "7c1e5a9b-2d4f-4b6a-8e0c-3f5a7b9d1c2e"
+	userID := uuid.NewString()
+	assert.Nil(t, fakeServing.Client.createUser(ctx, io.Discard, userParams{userID: userID, userName: "shop-user"}))
+
+	offers, err := fakeServing.Client.offers(ctx, io.Discard)
+	assert.Nil(t, err)
+	assert.True(t, len(offers) >= 2)
+
+	_, err = fakeServing.Client.purchaseOffer(ctx, io.Discard, userID, starter)
+	assert.ErrorIs(t, err, errInsufficientBalance)
+
+	_, err = fakeServing.Client.creditBalance(ctx, io.Discard, userID, "gem", 1000, reasonCredit, uuid.NewString())
+	assert.Nil(t, err)
+
+	p, err := fakeServing.Client.purchaseOffer(ctx, io.Discard, userID, starter)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(700), p.Balance)
+	assert.Equal(t, 2, len(p.Results))
+
+	// the starter bundle is once per user
+	_, err = fakeServing.Client.purchaseOffer(ctx, io.Discard, userID, starter)
+	assert.ErrorIs(t, err, errPurchaseLimit)
+
+	p, err = fakeServing.Client.purchaseOffer(ctx, io.Discard, userID, limited)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(200), p.Balance)
+
+	_, err = fakeServing.Client.purchaseOffer(ctx, io.Discard, userID, "no-such-offer")
+	assert.ErrorIs(t, err, errOfferNotFound)
+
+	past := time.Now().Add(-time.Hour)
+	assert.False(t, offer{EndsAt: &past}.onSale(time.Now()))
+}
+
+func Test_ledger(t *testing.T) {
+
+	ctx := context.Background()
+	userID := uuid.NewString()
+	assert.Nil(t, fakeServing.Client.createUser(ctx, io.Discard, userParams{userID: userID, userName: "ledger-user"}))
+
+	_, err := fakeServing.Client.creditBalance(ctx, io.Discard, userID, "no_such_currency", 100, reasonCredit, uuid.NewString())
+	assert.ErrorIs(t, err, errCurrencyNotFound)
+
+	correlationID := uuid.NewString()
+	_, err = fakeServing.Client.creditBalance(ctx, io.Discard, userID, "gem", 1000, "event_reward", correlationID)
+	assert.Nil(t, err)
+	p, err := fakeServing.Client.purchaseOffer(ctx, io.Discard, userID, "3f9a7c2e-6b1d-4e8f-a0c5-9d2b4e6f8a10")
+	assert.Nil(t, err)
+
+	entries, err := fakeServing.Client.ledger(ctx, io.Discard, userID, "gem", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, int64(-300), entries[0].Amount)
+	assert.Equal(t, int64(700), entries[0].Balance)
+	assert.Equal(t, reasonPurchase, entries[0].Reason)
+	assert.Equal(t, p.PurchaseID, entries[0].CorrelationID)
+	assert.Equal(t, correlationID, entries[1].CorrelationID)
+
+	mismatches, err := fakeServing.Client.reconcileBalances(ctx, io.Discard)
+	assert.Nil(t, err)
+	for _, m := range mismatches {
+		assert.NotEqual(t, userID, m.UserID)
+	}
+}
+
+func Test_friends(t *testing.T) {
+
+	ctx := context.Background()
+	client := fakeServing.Client
+	alice, bob, carol := uuid.NewString(), uuid.NewString(), uuid.NewString()
+	for i, userID := range []string{alice, bob, carol} {
+		assert.Nil(t, client.createUser(ctx, io.Discard, userParams{userID: userID, userName: fmt.Sprintf("friend-user%d", i)}))
+	}
+	change := func(userID, friendID, action string) (friendship, error) {
+		return client.changeFriendship(ctx, io.Discard, friendParams{userID: userID, friendID: friendID, action: action})
+	}
+
+	_, err := change(alice, alice, friendActionRequest)
+	assert.ErrorIs(t, err, errSelfFriend)
+
+	f, err := change(alice, bob, friendActionRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, friendStatusRequested, f.Status)
+	_, err = change(alice, bob, friendActionRequest)
+	assert.ErrorIs(t, err, errAlreadyRequested)
+
+	// both directions are written
+	pending, err := client.friendships(ctx, io.Discard, bob, friendStatusPending)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(pending))
+	assert.Equal(t, alice, pending[0].FriendID)
+
+	f, err = change(bob, alice, friendActionAccept)
+	assert.Nil(t, err)
+	assert.Equal(t, friendStatusFriend, f.Status)
+	count, err := client.friendCount(ctx, io.Discard, alice)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), count)
+
+	// the request is cancelled, then declined
+	_, err = change(carol, alice, friendActionRequest)
+	assert.Nil(t, err)
+	_, err = change(carol, alice, friendActionCancel)
+	assert.Nil(t, err)
+	_, err = change(alice, carol, friendActionDecline)
+	assert.ErrorIs(t, err, errFriendRequestNotFound)
+
+	// blocking removes the friendship, and the blocked user can't request
+	_, err = change(bob, alice, friendActionBlock)
+	assert.Nil(t, err)
+	_, err = change(alice, bob, friendActionRequest)
+	assert.ErrorIs(t, err, errBlocked)
+	friends, err := client.friendships(ctx, io.Discard, alice, "")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(friends))
+	count, err = client.friendCount(ctx, io.Discard, alice)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), count)
+
+	_, err = change(bob, alice, friendActionUnblock)
+	assert.Nil(t, err)
+	_, err = change(bob, alice, friendActionUnblock)
+	assert.ErrorIs(t, err, errNotBlocked)
+}
+
+func Test_guilds(t *testing.T) {
+
+	ctx := context.Background()
+	client := fakeServing.Client
+	leader, officer, member := uuid.NewString(), uuid.NewString(), uuid.NewString()
+	for i, userID := range []string{leader, officer, member} {
+		assert.Nil(t, client.createUser(ctx, io.Discard, userParams{userID: userID, userName: fmt.Sprintf("guild-user%d", i)}))
+	}
+
+	g, err := client.createGuild(ctx, io.Discard, guildParams{userID: leader, name: "test guild"})
+	assert.Nil(t, err)
+	_, err = client.createGuild(ctx, io.Discard, guildParams{userID: leader, name: "another guild"})
+	assert.ErrorIs(t, err, errAlreadyInGuild)
+
+	change := func(userID, memberID, action, role string) (string, error) {
+		return client.changeGuildMember(ctx, io.Discard, guildParams{guildID: g.GuildID, userID: userID, memberID: memberID, action: action, role: role})
+	}
+
+	// joined by the request and the invitation
+	status, err := change(officer, "", guildActionJoin, "")
+	assert.Nil(t, err)
+	assert.Equal(t, guildRequestByUser, status)
+	status, err = change(leader, officer, guildActionInvite, "")
+	assert.Nil(t, err)
+	assert.Equal(t, guildRoleMember, status)
+	status, err = change(leader, member, guildActionInvite, "")
+	assert.Nil(t, err)
+	assert.Equal(t, guildRequestByGuild, status)
+	status, err = change(member, "", guildActionJoin, "")
+	assert.Nil(t, err)
+	assert.Equal(t, guildRoleMember, status)
+
+	_, err = change(member, officer, guildActionRole, guildRoleOfficer)
+	assert.ErrorIs(t, err, errGuildPermission)
+	_, err = change(leader, officer, guildActionRole, guildRoleOfficer)
+	assert.Nil(t, err)
+
+	// the item moves to the guild and back
+	_, err = client.grantItems(ctx, io.Discard, []grantParams{{userID: member, itemID: itemTestID}})
+	assert.Nil(t, err)
+	deposit := guildParams{guildID: g.GuildID, userID: member, action: guildActionDeposit, itemIDs: []string{itemTestID}}
+	assert.Nil(t, client.moveGuildItems(ctx, io.Discard, deposit))
+	assert.ErrorIs(t, client.moveGuildItems(ctx, io.Discard, deposit), errNotOwned)
+
+	withdraw := guildParams{guildID: g.GuildID, userID: member, action: guildActionWithdraw, itemIDs: []string{itemTestID}}
+	assert.ErrorIs(t, client.moveGuildItems(ctx, io.Discard, withdraw), errGuildPermission)
+	withdraw.userID = officer
+	assert.Nil(t, client.moveGuildItems(ctx, io.Discard, withdraw))
+	assert.ErrorIs(t, client.moveGuildItems(ctx, io.Discard, withdraw), errGuildItemNotFound)
+
+	// officers can kick members, and the leader can kick officers
+	_, err = change(officer, member, guildActionKick, "")
+	assert.Nil(t, err)
+	_, err = change(leader, officer, guildActionKick, "")
+	assert.Nil(t, err)
+	entries, err := client.auditLog(ctx, io.Discard, auditQuery{userID: member, action: "guild.kicked", since: g.CreatedAt.Add(-time.Minute), until: time.Now().Add(time.Minute), limit: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.JSONEq(t, fmt.Sprintf(`{"kicked_by": "%s"}`, officer), string(entries[0].After))
+
+	// the last member can't leave with the items in the guild
+	_, err = client.grantItems(ctx, io.Discard, []grantParams{{userID: leader, itemID: itemTestID}})
+	assert.Nil(t, err)
+	deposit.userID = leader
+	assert.Nil(t, client.moveGuildItems(ctx, io.Discard, deposit))
+	_, err = change(leader, "", guildActionLeave, "")
+	assert.ErrorIs(t, err, errGuildHasItems)
+	assert.ErrorIs(t, client.deleteUser(ctx, io.Discard, leader), errGuildHasItems)
+	withdraw.userID = leader
+	assert.Nil(t, client.moveGuildItems(ctx, io.Discard, withdraw))
+
+	// the guild is deleted with the last member
+	_, err = change(leader, "", guildActionLeave, "")
+	assert.Nil(t, err)
+	_, err = client.guild(ctx, io.Discard, g.GuildID)
+	assert.ErrorIs(t, err, errGuildNotFound)
+}
+
+func Test_bans(t *testing.T) {
+
+	ctx := context.Background()
+	client := fakeServing.Client
+	userID := uuid.NewString()
+	assert.Nil(t, client.createUser(ctx, io.Discard, userParams{userID: userID, userName: "banned-user"}))
+
+	request := func() int {
+		req, err := http.NewRequest("GET", "/api/user_id/"+userID+"/profile", nil)
+		assert.Nil(t, err)
+		rr := httptest.NewRecorder()
+		fakeServing.banCheck(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})).ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// not banned, and it's cached
+	assert.Equal(t, http.StatusOK, request())
+
+	expiresAt := time.Now().Add(time.Hour)
+	_, err := client.banUser(ctx, io.Discard, banParams{userID: userID, reason: "cheating", issuedBy: "support", expiresAt: expiresAt})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, request())
+
+	_, err = client.banUser(ctx, io.Discard, banParams{userID: userID, reason: "cheating again", issuedBy: "support"})
+	assert.Nil(t, err)
+	b, err := client.activeBan(ctx, io.Discard, userID)
+	assert.Nil(t, err)
+	assert.Nil(t, b.ExpiresAt)
+
+	lifted, err := client.liftBans(ctx, io.Discard, userID, "support")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, lifted)
+	assert.Equal(t, http.StatusOK, request())
+
+	bans, err := client.bans(ctx, io.Discard, userID)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(bans))
+	for _, b := range bans {
+		assert.False(t, b.active(time.Now()))
+	}
+}
+
+func Test_bansInBody(t *testing.T) {
+
+	ctx := context.Background()
+	client := fakeServing.Client
+	userID := uuid.NewString()
+	alt := uuid.NewString()
+	assert.Nil(t, client.createUser(ctx, io.Discard, userParams{userID: userID, userName: "banned-body-user"}))
+	assert.Nil(t, client.createUser(ctx, io.Discard, userParams{userID: alt, userName: "banned-body-alt"}))
+	_, err := client.grantItems(ctx, io.Discard, []grantParams{{userID: userID, itemID: itemTestID}})
+	assert.Nil(t, err)
+
+	_, err = client.banUser(ctx, io.Discard, banParams{userID: userID, reason: "cheating", issuedBy: "support"})
+	assert.Nil(t, err)
+
+	// the user ids in the body are checked, not only the one in the path
+	_, err = client.tradeItems(ctx, io.Discard, tradeParams{userID: userID, itemIDs: []string{itemTestID}, partnerID: alt})
+	assert.ErrorIs(t, err, errUserBanned)
+	_, err = client.submitScore(ctx, io.Discard, "weekly_score", userID, 100)
+	assert.ErrorIs(t, err, errUserBanned)
+	results, err := client.grantItems(ctx, io.Discard, []grantParams{{userID: userID, itemID: "c54189f2-6211-4ad7-805e-23899b94c456"}, {userID: alt, itemID: "c54189f2-6211-4ad7-805e-23899b94c456"}})
+	assert.Nil(t, err)
+	assert.Equal(t, grantBannedUser, results[0].Status)
+	assert.Equal(t, grantGranted, results[1].Status)
+
+	lis := bufconn.Listen(1024 * 1024)
+	server := newGRPCServer(client, newRateLimiter(nil), defaultRateLimits["api"])
+	go server.Serve(lis)
+	defer server.Stop()
+
+	conn, err := grpc.DialContext(ctx, "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	assert.Nil(t, err)
+	defer conn.Close()
+	grpcClient := gamepb.NewGameServiceClient(conn)
+
+	_, err = grpcClient.ListUserItems(ctx, &gamepb.ListUserItemsRequest{UserId: userID, PageSize: 10})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = grpcClient.AddItemToUser(ctx, &gamepb.AddItemToUserRequest{UserId: userID, ItemId: "c54189f2-6211-4ad7-805e-23899b94c456"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = grpcClient.ListUserItems(ctx, &gamepb.ListUserItemsRequest{UserId: alt, PageSize: 10})
+	assert.Nil(t, err)
+}
+
+func Test_auditLog(t *testing.T) {
+
+	ctx := context.Background()
+	client := fakeServing.Client
+	userID := uuid.NewString()
+	since := time.Now().Add(-time.Minute)
+	assert.Nil(t, client.createUser(ctx, io.Discard, userParams{userID: userID, userName: "audited-user"}))
+
+	adminCtx := withAuditActor(context.WithValue(ctx, middleware.RequestIDKey, "test-request"), "admin:tester")
+	_, err := client.creditBalance(adminCtx, io.Discard, userID, "gem", 100, reasonCredit, uuid.NewString())
+	assert.Nil(t, err)
+	assert.Nil(t, client.renameUser(adminCtx, io.Discard, userParams{userID: userID, userName: "audited-user2"}))
+
+	entries, err := client.auditLog(ctx, io.Discard, auditQuery{userID: userID, since: since, until: time.Now().Add(time.Minute), limit: 10})
+	assert.Nil(t, err)
+	actions := map[string]auditEntry{}
+	for _, e := range entries {
+		actions[e.Action] = e
+	}
+	assert.Equal(t, systemActor, actions["user.created"].Actor)
+	assert.Equal(t, "admin:tester", actions["balance.changed"].Actor)
+	assert.Equal(t, "test-request", actions["balance.changed"].RequestID)
+	assert.JSONEq(t, `{"name": "audited-user"}`, string(actions["user.renamed"].Before))
+	assert.JSONEq(t, `{"name": "audited-user2"}`, string(actions["user.renamed"].After))
+
+	entries, err = client.auditLog(ctx, io.Discard, auditQuery{userID: userID, action: "user.renamed", since: since, until: time.Now().Add(time.Minute), limit: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+}
+
+func Test_softDelete(t *testing.T) {
+
+	ctx := context.Background()
+	client := fakeServing.Client
+	itemID := "c54189f2-6211-4ad7-805e-23899b94c456"
+	userID := uuid.NewString()
+	assert.Nil(t, client.createUser(ctx, io.Discard, userParams{userID: userID, userName: "soft-deleted-user"}))
+	assert.Nil(t, client.addItemToUser(ctx, io.Discard, userParams{userID: userID}, itemParams{itemID: itemID}))
+
+	count := func(p pageParams) int {
+		page, err := client.userItems(ctx, io.Discard, userID, p)
+		assert.Nil(t, err)
+		return len(page.Items)
+	}
+	assert.Nil(t, client.deleteUserItem(ctx, io.Discard, userID, itemID))
+	assert.ErrorIs(t, client.deleteUserItem(ctx, io.Discard, userID, itemID), errNotOwned)
+	assert.Equal(t, 0, count(pageParams{limit: 10, sort: "item_id"}))
+	assert.Equal(t, 1, count(pageParams{limit: 10, sort: "item_id", includeDeleted: true}))
+
+	assert.Nil(t, client.restoreUserItem(ctx, io.Discard, userID, itemID))
+	assert.ErrorIs(t, client.restoreUserItem(ctx, io.Discard, userID, itemID), errNotDeleted)
+	assert.Equal(t, 1, count(pageParams{limit: 10, sort: "item_id"}))
+
+	// the friendships are removed in both directions
+	friendID := uuid.NewString()
+	assert.Nil(t, client.createUser(ctx, io.Discard, userParams{userID: friendID, userName: "soft-deleted-friend"}))
+	_, err := client.changeFriendship(ctx, io.Discard, friendParams{userID: userID, friendID: friendID, action: friendActionRequest})
+	assert.Nil(t, err)
+
+	assert.Nil(t, client.deleteUser(ctx, io.Discard, userID))
+	_, err = client.userProfile(ctx, io.Discard, userID)
+	assert.ErrorIs(t, err, errUserNotFound)
+	assert.Equal(t, 0, count(pageParams{limit: 10, sort: "item_id"}))
+	friends, err := client.friendships(ctx, io.Discard, friendID, "")
+	assert.Nil(t, err)
+	assert.Empty(t, friends)
+
+	// too late to restore
+	retention := softDeleteRetention
+	softDeleteRetention = 0
+	assert.ErrorIs(t, client.restoreUser(ctx, io.Discard, userID), errRetentionExpired)
+	softDeleteRetention = retention
+
+	assert.Nil(t, client.restoreUser(ctx, io.Discard, userID))
+	_, err = client.userProfile(ctx, io.Discard, userID)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count(pageParams{limit: 10, sort: "item_id"}))
+	friends, err = client.friendships(ctx, io.Discard, userID, "")
+	assert.Nil(t, err)
+	assert.Empty(t, friends)
+
+	// purged after the retention
+	assert.Nil(t, client.deleteUser(ctx, io.Discard, userID))
+	purged, err := client.(dbClient).purgeDeleted(ctx, io.Discard, time.Now().Add(softDeleteRetention+time.Minute))
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, purged.Users, 1)
+	assert.ErrorIs(t, client.restoreUser(ctx, io.Discard, userID), errUserNotFound)
+}
+
+func Test_privacy(t *testing.T) {
+
+	ctx := context.Background()
+	client := fakeServing.Client
+	itemID := "c54189f2-6211-4ad7-805e-23899b94c456"
+	userID := uuid.NewString()
+	assert.Nil(t, client.createUser(ctx, io.Discard, userParams{userID: userID, userName: "erased-user"}))
+	assert.Nil(t, client.addItemToUser(ctx, io.Discard, userParams{userID: userID}, itemParams{itemID: itemID}))
+	_, err := client.creditBalance(ctx, io.Discard, userID, "gem", 100, reasonCredit, uuid.NewString())
+	assert.Nil(t, err)
+
+	// a gift is recorded for the sender, with the user as the target
+	sender := uuid.NewString()
+	assert.Nil(t, client.createUser(ctx, io.Discard, userParams{userID: sender, userName: "erased-user-friend"}))
+	assert.Nil(t, client.addItemToUser(ctx, io.Discard, userParams{userID: sender}, itemParams{itemID: itemTestID}))
+	_, err = client.tradeItems(ctx, io.Discard, tradeParams{userID: sender, itemIDs: []string{itemTestID}, partnerID: userID})
+	assert.Nil(t, err)
+
+	// leaving the guild on the erasure writes audit logs of the user
+	_, err = client.createGuild(ctx, io.Discard, guildParams{userID: userID, name: "erased guild"})
+	assert.Nil(t, err)
+
+	archive, err := client.exportUser(ctx, io.Discard, userID)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(archive.Tables["users"]))
+	assert.Equal(t, "erased-user", archive.Tables["users"][0]["name"])
+	assert.Equal(t, 2, len(archive.Tables["user_items"]))
+	assert.Equal(t, int64(100), archive.Tables["user_balances"][0]["balance"])
+	assert.NotEmpty(t, archive.Tables["audit_log"])
+	assert.Equal(t, 1, len(archive.Tables["audit_log_as_target"]))
+
+	receipt, err := client.eraseUser(ctx, io.Discard, userID, "privacy")
+	assert.Nil(t, err)
+	assert.Equal(t, subjectHash(userID), receipt.SubjectHash)
+	assert.Equal(t, int64(2), receipt.DeletedRows["user_items"])
+	assert.NotZero(t, receipt.AnonymisedRows["audit_log"])
+	assert.Equal(t, int64(1), receipt.AnonymisedRows["audit_log_as_target"])
+	assert.NotNil(t, receipt.CompletedAt)
+
+	var mentions int64
+	err = client.(dbClient).sc.Single().Query(ctx, spanner.Statement{
+		SQL: `SELECT COUNT(*) FROM audit_log WHERE target_user_id = @userID OR target = @userID OR actor = CONCAT('user:', @userID)
+		  OR JSON_VALUE(after, '$.to') = @userID`,
+		Params: map[string]interface{}{"userID": userID},
+	}).Do(func(row *spanner.Row) error {
+		return row.Columns(&mentions)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), mentions)
+
+	_, err = client.exportUser(ctx, io.Discard, userID)
+	assert.ErrorIs(t, err, errUserNotFound)
+	entries, err := client.auditLog(ctx, io.Discard, auditQuery{userID: userID, since: receipt.CreatedAt.Add(-time.Hour), until: time.Now().Add(time.Minute), limit: 10})
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+	_, err = client.eraseUser(ctx, io.Discard, userID, "privacy")
+	assert.ErrorIs(t, err, errUserNotFound)
+
+	// the user was deleted but Redis was not cleaned up, it's resumed from the receipt
+	_, err = client.(dbClient).sc.Apply(ctx, []*spanner.Mutation{
+		spanner.Update("erasure_receipts", []string{"receipt_id", "pending_cache", "completed_at"},
+			[]interface{}{receipt.ReceiptID, spanner.NullJSON{Value: erasureCache{Leaderboards: []string{}, FriendCounts: []string{}}, Valid: true}, spanner.NullTime{}}),
+	})
+	assert.Nil(t, err)
+	resumed, err := client.eraseUser(ctx, io.Discard, userID, "privacy")
+	assert.Nil(t, err)
+	assert.Equal(t, receipt.ReceiptID, resumed.ReceiptID)
+	assert.Equal(t, receipt.DeletedRows, resumed.DeletedRows)
+	assert.NotNil(t, resumed.CompletedAt)
+	_, err = client.eraseUser(ctx, io.Discard, userID, "privacy")
+	assert.ErrorIs(t, err, errUserNotFound)
+}
+
+func Test_bulkImport(t *testing.T) {
+
+	ctx := context.Background()
+	client := fakeServing.Client.(dbClient)
+	itemID := "c54189f2-6211-4ad7-805e-23899b94c456"
+	dir := t.TempDir()
+	assert.Nil(t, client.createUser(ctx, io.Discard, userParams{userID: uuid.NewString(), userName: "bulk-taken"}))
+
+	usersFile := filepath.Join(dir, "users.jsonl")
+	assert.Nil(t, os.WriteFile(usersFile, []byte(`{"user_id": "bulk-user-1", "name": "bulk-user-1", "country": "JP"}
+{"user_id": "bulk-user-2", "name": "bulk-user-2", "created_at": "2020-01-01T00:00:00Z"}
+{"user_id": "BAD", "name": "bad-id"}
+not json
+{"user_id": "bulk-user-3", "name": "bulk-taken"}
+`), 0644))
+	p, err := parseBulkFlags("bulk-import", []string{"-table", "users", "-file", usersFile, "-batch", "2", "-parallel", "2"})
+	assert.Nil(t, err)
+	result, err := client.importRecords(ctx, io.Discard, p)
+	assert.Nil(t, err)
+	assert.Equal(t, bulkResult{Read: 5, Imported: 2, Rejected: 3}, result)
+	rejects, err := os.ReadFile(p.rejects)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, strings.Count(string(rejects), "\n"))
+	_, err = os.Stat(p.checkpoint)
+	assert.True(t, os.IsNotExist(err))
+
+	itemsFile := filepath.Join(dir, "items.csv")
+	assert.Nil(t, os.WriteFile(itemsFile, []byte(fmt.Sprintf(`user_id,item_id,expires_at
+bulk-user-1,%[1]s,
+bulk-user-2,%[1]s,2030-01-01T00:00:00Z
+bulk-user-1,no-such-item,
+no-such-user,%[1]s,
+`, itemID)), 0644))
+	p, err = parseBulkFlags("bulk-import", []string{"-table", "user_items", "-file", itemsFile})
+	assert.Nil(t, err)
+	assert.Equal(t, "csv", p.format)
+	result, err = client.importRecords(ctx, io.Discard, p)
+	assert.Nil(t, err)
+	assert.Equal(t, bulkResult{Read: 4, Imported: 2, Rejected: 2}, result)
+	page, err := client.userItems(ctx, io.Discard, "bulk-user-2", pageParams{limit: 10, sort: "item_id"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(page.Items))
+
+	// resumed after the records in the checkpoint, the rows written and rejected before are not reported again
+	assert.Nil(t, writeCheckpoint(p, bulkCheckpoint{Records: 1, Written: 4}))
+	result, err = client.importRecords(ctx, io.Discard, p)
+	assert.Nil(t, err)
+	assert.Equal(t, bulkResult{Skipped: 2, Read: 3, Rejected: 2}, result)
+	rejects, err = os.ReadFile(p.rejects)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, strings.Count(string(rejects), "\n"))
+
+	// the second record was written by a batch that failed midway
+	assert.Nil(t, writeCheckpoint(p, bulkCheckpoint{Records: 1, Written: 1, WrittenRows: []int{2}}))
+	result, err = client.importRecords(ctx, io.Discard, p)
+	assert.Nil(t, err)
+	assert.Equal(t, bulkResult{Skipped: 2, Read: 3, Rejected: 2}, result)
+	rejects, err = os.ReadFile(p.rejects)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, strings.Count(string(rejects), "\n"))
+
+	// the report starts again without a checkpoint
+	result, err = client.importRecords(ctx, io.Discard, p)
+	assert.Nil(t, err)
+	assert.Equal(t, bulkResult{Read: 4, Rejected: 4}, result)
+	rejects, err = os.ReadFile(p.rejects)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, strings.Count(string(rejects), "\n"))
+
+	// existing users are not overwritten
+	renameFile := filepath.Join(dir, "rename.jsonl")
+	assert.Nil(t, os.WriteFile(renameFile, []byte(`{"user_id": "bulk-user-1", "name": "bulk-renamed"}
+`), 0644))
+	p, err = parseBulkFlags("bulk-import", []string{"-table", "users", "-file", renameFile})
+	assert.Nil(t, err)
+	result, err = client.importRecords(ctx, io.Discard, p)
+	assert.Nil(t, err)
+	assert.Equal(t, bulkResult{Read: 1, Rejected: 1}, result)
+	profile, err := client.userProfile(ctx, io.Discard, "bulk-user-1")
+	assert.Nil(t, err)
+	assert.Equal(t, "bulk-user-1", profile.Name)
+
+	var out bytes.Buffer
+	n, err := client.exportRecords(ctx, &out, "users", "csv")
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, n, 3)
+	assert.Contains(t, out.String(), "bulk-user-1,bulk-user-1,,JP,")
+}
+
+func Test_commitTimestamps(t *testing.T) {
+
+	ctx := context.Background()
+	client := fakeServing.Client
+	first := "c54189f2-6211-4ad7-805e-23899b94c456"
+	second := "8872e50a-d627-4737-9c99-c540fd550f6b"
+	userID := uuid.NewString()
+	before := time.Now().Add(-time.Minute)
+	assert.Nil(t, client.createUser(ctx, io.Discard, userParams{userID: userID, userName: "timestamp-user"}))
+	assert.Nil(t, client.addItemToUser(ctx, io.Discard, userParams{userID: userID}, itemParams{itemID: first}))
+	assert.Nil(t, client.addItemToUser(ctx, io.Discard, userParams{userID: userID}, itemParams{itemID: second}))
+
+	profile, err := client.userProfile(ctx, io.Discard, userID)
+	assert.Nil(t, err)
+	assert.True(t, profile.CreatedAt.After(before))
+	assert.Equal(t, profile.CreatedAt, profile.UpdatedAt)
+
+	page, err := client.userItems(ctx, io.Discard, userID, pageParams{limit: 10, sort: "acquired_at"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(page.Items))
+	assert.Equal(t, first, page.Items[0]["item_id"])
+	firstAt, ok := page.Items[0]["created_at"].(time.Time)
+	assert.True(t, ok)
+	secondAt, ok := page.Items[1]["created_at"].(time.Time)
+	assert.True(t, ok)
+	assert.True(t, secondAt.After(firstAt))
+	assert.Equal(t, firstAt, page.Items[0]["updated_at"])
+
+	// deleting and restoring are changes of the row too
+	assert.Nil(t, client.deleteUserItem(ctx, io.Discard, userID, first))
+	assert.Nil(t, client.restoreUserItem(ctx, io.Discard, userID, first))
+	page, err = client.userItems(ctx, io.Discard, userID, pageParams{limit: 10, sort: "acquired_at"})
+	assert.Nil(t, err)
+	assert.Equal(t, firstAt, page.Items[0]["created_at"])
+	updatedAt, ok := page.Items[0]["updated_at"].(time.Time)
+	assert.True(t, ok)
+	assert.True(t, updatedAt.After(secondAt))
+}
+
 func Test_cleaning(t *testing.T) {
 	t.Cleanup(
 		func() {
@@ -0,0 +1,117 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type namePolicy struct {
+	minLength int
+	maxLength int
+	pattern   *regexp.Regexp
+	// lower-cased words a name must not contain
+	reserved []string
+}
+
+var userNamePolicy = namePolicy{
+	minLength: 3,
+	maxLength: 32,
+	// letters and digits of any language, words can be separated by a single space
+	pattern: regexp.MustCompile(`^[\p{L}\p{N}._-]+( [\p{L}\p{N}._-]+)*$`),
+}
+
+// build the policy from environment variables, unset ones keep the default
+func loadNamePolicy() (namePolicy, error) {
+	p := userNamePolicy
+
+	if v := os.Getenv("NAME_MIN_LENGTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return p, fmt.Errorf("NAME_MIN_LENGTH: %w", err)
+		}
+		p.minLength = n
+	}
+	if v := os.Getenv("NAME_MAX_LENGTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return p, fmt.Errorf("NAME_MAX_LENGTH: %w", err)
+		}
+		p.maxLength = n
+	}
+	if v := os.Getenv("NAME_PATTERN"); v != "" {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return p, fmt.Errorf("NAME_PATTERN: %w", err)
+		}
+		p.pattern = re
+	}
+	if v := os.Getenv("RESERVED_NAMES_FILE"); v != "" {
+		words, err := readReservedNames(v)
+		if err != nil {
+			return p, err
+		}
+		p.reserved = words
+	}
+	return p, nil
+}
+
+// one word per line, empty lines and lines starting with '#' are ignored
+func readReservedNames(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var words []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		word := strings.TrimSpace(scanner.Text())
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+		words = append(words, strings.ToLower(word))
+	}
+	return words, scanner.Err()
+}
+
+// validate returns an error that describes why the name is not acceptable
+func (p namePolicy) validate(name string) error {
+	length := utf8.RuneCountInString(name)
+	if length < p.minLength {
+		return fmt.Errorf("name must be at least %d characters", p.minLength)
+	}
+	if length > p.maxLength {
+		return fmt.Errorf("name must be at most %d characters", p.maxLength)
+	}
+	if !p.pattern.MatchString(name) {
+		return fmt.Errorf("name contains characters that are not allowed")
+	}
+	lower := strings.ToLower(name)
+	for _, word := range p.reserved {
+		if strings.Contains(lower, word) {
+			return fmt.Errorf("name contains a reserved word")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,2043 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/go-chi/render"
+)
+
+// The spec is kept in the source, not in a separate file, so that the container image has it as well.
+// Update it whenever a route is added to the router.
+const openapiSpec = `
+openapi: 3.0.3
+info:
+  title: game-api
+  version: 1.0.0
+paths:
+  /ping:
+    get:
+      operationId: pingPong
+      responses:
+        "200":
+          description: the server is alive
+          content:
+            text/plain:
+              schema:
+                type: string
+  /metrics:
+    get:
+      operationId: metrics
+      responses:
+        "200":
+          description: metrics for prometheus
+          content:
+            text/plain:
+              schema:
+                type: string
+  /openapi.json:
+    get:
+      operationId: openapi
+      responses:
+        "200":
+          description: this document
+          content:
+            application/json:
+              schema:
+                type: object
+  /api/users:
+    post:
+      operationId: createUserWithBody
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              $ref: "#/components/schemas/CreateUserRequest"
+      responses:
+        "200":
+          $ref: "#/components/responses/User"
+        default:
+          $ref: "#/components/responses/Error"
+  /api/user/{user_name}:
+    post:
+      operationId: createUser
+      parameters:
+        - $ref: "#/components/parameters/UserName"
+      responses:
+        "200":
+          $ref: "#/components/responses/User"
+        default:
+          $ref: "#/components/responses/Error"
+  /api/user_name/{user_name}/available:
+    get:
+      operationId: userNameAvailable
+      parameters:
+        - name: user_name
+          in: path
+          required: true
+          schema:
+            type: string
+      responses:
+        "200":
+          description: whether the name can be used
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [name, available]
+                properties:
+                  name:
+                    type: string
+                  available:
+                    type: boolean
+                  reason:
+                    type: string
+        default:
+          $ref: "#/components/responses/Error"
+  /api/user_id/{user_id}:
+    get:
+      operationId: getUserItems
+      parameters:
+        - $ref: "#/components/parameters/UserID"
+        - name: limit
+          in: query
+          schema:
+            type: integer
+            minimum: 1
+            maximum: 1000
+        - name: cursor
+          in: query
+          schema:
+            type: string
+        - name: sort
+          in: query
+          schema:
+            type: string
+            enum: [item_id, acquired_at, item_name]
+        - name: order
+          in: query
+          schema:
+            type: string
+            enum: [asc, desc]
+        - name: include_expired
+          in: query
+          schema:
+            type: boolean
+      responses:
+        "200":
+          description: a page of items the user has
+          content:
+            application/json:
+              schema:
+                $ref: "#/components/schemas/ItemPage"
+        default:
+          $ref: "#/components/responses/Error"
+    patch:
+      operationId: renameUser
+      parameters:
+        - $ref: "#/components/parameters/UserID"
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              type: object
+              required: [name]
+              properties:
+                name:
+                  type: string
+      responses:
+        "200":
+          $ref: "#/components/responses/User"
+        default:
+          $ref: "#/components/responses/Error"
+    delete:
+      operationId: deleteUser
+      parameters:
+        - $ref: "#/components/parameters/UserID"
+      responses:
+        "200":
+          $ref: "#/components/responses/Empty"
+        default:
+          $ref: "#/components/responses/Error"
+  /api/user_id/{user_id}/profile:
+    get:
+      operationId: getUser
+      parameters:
+        - $ref: "#/components/parameters/UserID"
+      responses:
+        "200":
+          description: the user's profile
+          content:
+            application/json:
+              schema:
+                $ref: "#/components/schemas/UserProfile"
+        default:
+          $ref: "#/components/responses/Error"
+  /api/user_id/{user_id}/{item_id}:
+    put:
+      operationId: addItemToUser
+      parameters:
+        - $ref: "#/components/parameters/UserID"
+        - $ref: "#/components/parameters/ItemID"
+      responses:
+        "200":
+          $ref: "#/components/responses/Empty"
+        default:
+          $ref: "#/components/responses/Error"
+  /api/user_id/{user_id}/gifts:
+    post:
+      operationId: sendGift
+      parameters:
+        - $ref: "#/components/parameters/UserID"
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              type: object
+              required: [to_user_id, item_id]
+              properties:
+                to_user_id:
+                  type: string
+                item_id:
+                  type: string
+      responses:
+        "200":
+          $ref: "#/components/responses/Trade"
+        default:
+          $ref: "#/components/responses/Error"
+  /api/trades:
+    post:
+      operationId: tradeItems
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              type: object
+              required: [user_id, item_ids, partner_id, partner_item_ids]
+              properties:
+                user_id:
+                  type: string
+                item_ids:
+                  type: array
+                  items:
+                    type: string
+                partner_id:
+                  type: string
+                partner_item_ids:
+                  type: array
+                  items:
+                    type: string
+      responses:
+        "200":
+          $ref: "#/components/responses/Trade"
+        default:
+          $ref: "#/components/responses/Error"
+  /api/user_id/{user_id}/trades:
+    get:
+      operationId: getTrades
+      parameters:
+        - $ref: "#/components/parameters/UserID"
+        - name: status
+          in: query
+          schema:
+            type: string
+            enum: [proposed, completed, declined, cancelled]
+      responses:
+        "200":
+          description: the latest trades the user proposed or was proposed
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [trades]
+                properties:
+                  trades:
+                    type: array
+                    items:
+                      $ref: "#/components/schemas/Trade"
+        default:
+          $ref: "#/components/responses/Error"
+  /api/user_id/{user_id}/trades/{trade_id}/{action}:
+    post:
+      operationId: changeTrade
+      parameters:
+        - $ref: "#/components/parameters/UserID"
+        - name: trade_id
+          in: path
+          required: true
+          schema:
+            type: string
+            pattern: "^[a-z0-9-.]+$"
+        - name: action
+          in: path
+          required: true
+          schema:
+            type: string
+            enum: [accept, decline, cancel]
+      responses:
+        "200":
+          $ref: "#/components/responses/Trade"
+        default:
+          $ref: "#/components/responses/Error"
+  /api/user_id/{user_id}/balances:
+    get:
+      operationId: getBalances
+      parameters:
+        - $ref: "#/components/parameters/UserID"
+      responses:
+        "200":
+          description: balance of each currency the user has had
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [balances]
+                properties:
+                  balances:
+                    type: object
+                    additionalProperties:
+                      type: integer
+        default:
+          $ref: "#/components/responses/Error"
+  /api/currencies:
+    get:
+      operationId: getCurrencies
+      responses:
+        "200":
+          description: definitions of all currencies
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [currencies]
+                properties:
+                  currencies:
+                    type: array
+                    items:
+                      type: object
+                      required: [currency, name, kind]
+                      properties:
+                        currency:
+                          type: string
+                        name:
+                          type: string
+                        kind:
+                          type: string
+        default:
+          $ref: "#/components/responses/Error"
+  /api/user_id/{user_id}/ledger:
+    get:
+      operationId: getLedger
+      parameters:
+        - $ref: "#/components/parameters/UserID"
+        - name: currency
+          in: query
+          schema:
+            type: string
+        - name: limit
+          in: query
+          schema:
+            type: integer
+            minimum: 1
+            maximum: 500
+      responses:
+        "200":
+          description: the latest ledger entries, newest first
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [entries]
+                properties:
+                  entries:
+                    type: array
+                    items:
+                      $ref: "#/components/schemas/LedgerEntry"
+        default:
+          $ref: "#/components/responses/Error"
+  /api/drop_tables/{drop_table_id}/odds:
+    get:
+      operationId: getDropTableOdds
+      parameters:
+        - name: drop_table_id
+          in: path
+          required: true
+          schema:
+            type: string
+            pattern: "^[a-z0-9-.]+$"
+      responses:
+        "200":
+          description: probability of each item, computed from the weights
+          content:
+            application/json:
+              schema:
+                $ref: "#/components/schemas/DropTableOdds"
+        default:
+          $ref: "#/components/responses/Error"
+  /api/user_id/{user_id}/draws:
+    post:
+      operationId: drawGacha
+      parameters:
+        - $ref: "#/components/parameters/UserID"
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              type: object
+              required: [drop_table_id]
+              properties:
+                drop_table_id:
+                  type: string
+                count:
+                  type: integer
+                  minimum: 1
+                  maximum: 10
+      responses:
+        "200":
+          $ref: "#/components/responses/Draw"
+        default:
+          $ref: "#/components/responses/Error"
+  /api/user_id/{user_id}/draws/{draw_id}:
+    get:
+      operationId: getGachaDraw
+      parameters:
+        - $ref: "#/components/parameters/UserID"
+        - name: draw_id
+          in: path
+          required: true
+          schema:
+            type: string
+            pattern: "^[a-z0-9-.]+$"
+      responses:
+        "200":
+          $ref: "#/components/responses/Draw"
+        default:
+          $ref: "#/components/responses/Error"
+  /api/user_id/{user_id}/login_bonus:
+    get:
+      operationId: getLoginBonus
+      parameters:
+        - $ref: "#/components/parameters/UserID"
+      responses:
+        "200":
+          description: the calendar of the current season and the progress of the user
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [season_id, name, starts_on, ends_on, today, claimed_today, streak, total_days, next_day, days]
+                properties:
+                  season_id:
+                    type: string
+                  name:
+                    type: string
+                  starts_on:
+                    type: string
+                    format: date
+                  ends_on:
+                    type: string
+                    format: date
+                  today:
+                    type: string
+                    format: date
+                  claimed_today:
+                    type: boolean
+                  streak:
+                    type: integer
+                  total_days:
+                    type: integer
+                  next_day:
+                    type: integer
+                  days:
+                    type: array
+                    items:
+                      type: object
+                      required: [day, item_ids]
+                      properties:
+                        day:
+                          type: integer
+                        item_ids:
+                          type: array
+                          items:
+                            type: string
+        default:
+          $ref: "#/components/responses/Error"
+    post:
+      operationId: claimLoginBonus
+      parameters:
+        - $ref: "#/components/parameters/UserID"
+      responses:
+        "200":
+          description: the reward of the day was granted
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [season_id, date, day, streak, total_days, results]
+                properties:
+                  season_id:
+                    type: string
+                  date:
+                    type: string
+                    format: date
+                  day:
+                    type: integer
+                  streak:
+                    type: integer
+                  total_days:
+                    type: integer
+                  results:
+                    type: array
+                    items:
+                      $ref: "#/components/schemas/GrantResult"
+        default:
+          $ref: "#/components/responses/Error"
+  /api/user_id/{user_id}/mails:
+    get:
+      operationId: getMails
+      parameters:
+        - $ref: "#/components/parameters/UserID"
+      responses:
+        "200":
+          description: the latest mails that have not expired
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [mails]
+                properties:
+                  mails:
+                    type: array
+                    items:
+                      $ref: "#/components/schemas/Mail"
+        default:
+          $ref: "#/components/responses/Error"
+  /api/user_id/{user_id}/mails/claim:
+    post:
+      operationId: claimAllMails
+      parameters:
+        - $ref: "#/components/parameters/UserID"
+      responses:
+        "200":
+          $ref: "#/components/responses/MailClaims"
+        default:
+          $ref: "#/components/responses/Error"
+  /api/user_id/{user_id}/mails/{mail_id}/claim:
+    post:
+      operationId: claimMail
+      parameters:
+        - $ref: "#/components/parameters/UserID"
+        - name: mail_id
+          in: path
+          required: true
+          schema:
+            type: string
+            pattern: "^[a-z0-9-.]+$"
+      responses:
+        "200":
+          $ref: "#/components/responses/MailClaims"
+        default:
+          $ref: "#/components/responses/Error"
+  /admin/mails:
+    post:
+      operationId: sendMails
+      parameters:
+        - $ref: "#/components/parameters/AdminToken"
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              type: object
+              required: [subject]
+              properties:
+                user_ids:
+                  type: array
+                  items:
+                    type: string
+                segment:
+                  type: object
+                  properties:
+                    country:
+                      type: string
+                    platform:
+                      type: string
+                    locale:
+                      type: string
+                sender:
+                  type: string
+                subject:
+                  type: string
+                body:
+                  type: string
+                item_ids:
+                  type: array
+                  items:
+                    type: string
+                expires_at:
+                  type: string
+                  format: date-time
+      responses:
+        "200":
+          description: the mail was sent
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [mail_id, recipients]
+                properties:
+                  mail_id:
+                    type: string
+                  recipients:
+                    type: integer
+        default:
+          $ref: "#/components/responses/Error"
+  /api/user_id/{user_id}/achievements:
+    get:
+      operationId: getAchievements
+      parameters:
+        - $ref: "#/components/parameters/UserID"
+      responses:
+        "200":
+          description: progress of every achievement
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [achievements]
+                properties:
+                  achievements:
+                    type: array
+                    items:
+                      type: object
+                      required: [achievement_id, name, criteria, progress, target, reward_item_ids, completed]
+                      properties:
+                        achievement_id:
+                          type: string
+                        name:
+                          type: string
+                        criteria:
+                          type: string
+                          enum: [items_owned, currency_spent, login_days]
+                        currency:
+                          type: string
+                        progress:
+                          type: integer
+                        target:
+                          type: integer
+                        reward_item_ids:
+                          type: array
+                          items:
+                            type: string
+                        completed:
+                          type: boolean
+                        completed_at:
+                          type: string
+                          format: date-time
+        default:
+          $ref: "#/components/responses/Error"
+  /api/offers:
+    get:
+      operationId: getOffers
+      responses:
+        "200":
+          description: offers on sale now
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [offers]
+                properties:
+                  offers:
+                    type: array
+                    items:
+                      $ref: "#/components/schemas/Offer"
+        default:
+          $ref: "#/components/responses/Error"
+  /api/user_id/{user_id}/purchases:
+    post:
+      operationId: purchaseOffer
+      parameters:
+        - $ref: "#/components/parameters/UserID"
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              type: object
+              required: [offer_id]
+              properties:
+                offer_id:
+                  type: string
+      responses:
+        "200":
+          description: the purchase and the granted items
+          content:
+            application/json:
+              schema:
+                $ref: "#/components/schemas/Purchase"
+        default:
+          $ref: "#/components/responses/Error"
+  /api/user_id/{user_id}/friends:
+    get:
+      operationId: getFriends
+      parameters:
+        - $ref: "#/components/parameters/UserID"
+        - name: status
+          in: query
+          schema:
+            type: string
+            enum: [friend, requested, pending, blocked]
+      responses:
+        "200":
+          description: friends, friend requests and blocked users
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [friends, limit]
+                properties:
+                  friends:
+                    type: array
+                    items:
+                      $ref: "#/components/schemas/Friendship"
+                  limit:
+                    type: integer
+        default:
+          $ref: "#/components/responses/Error"
+  /api/user_id/{user_id}/friends/{friend_id}/{action}:
+    post:
+      operationId: changeFriendship
+      parameters:
+        - $ref: "#/components/parameters/UserID"
+        - name: friend_id
+          in: path
+          required: true
+          schema:
+            type: string
+            pattern: "^[a-z0-9-.]+$"
+        - name: action
+          in: path
+          required: true
+          schema:
+            type: string
+            enum: [request, accept, decline, cancel, remove, block, unblock]
+      responses:
+        "200":
+          description: the friendship after the action
+          content:
+            application/json:
+              schema:
+                $ref: "#/components/schemas/Friendship"
+        default:
+          $ref: "#/components/responses/Error"
+  /api/user_id/{user_id}/guilds:
+    post:
+      operationId: createGuild
+      parameters:
+        - $ref: "#/components/parameters/UserID"
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              type: object
+              required: [name]
+              properties:
+                name:
+                  type: string
+                  minLength: 1
+                description:
+                  type: string
+      responses:
+        "200":
+          $ref: "#/components/responses/Guild"
+        default:
+          $ref: "#/components/responses/Error"
+  /api/guilds/{guild_id}:
+    get:
+      operationId: getGuild
+      parameters:
+        - $ref: "#/components/parameters/GuildID"
+      responses:
+        "200":
+          $ref: "#/components/responses/Guild"
+        default:
+          $ref: "#/components/responses/Error"
+  /api/user_id/{user_id}/guilds/{guild_id}/{action}:
+    post:
+      operationId: changeGuildMember
+      parameters:
+        - $ref: "#/components/parameters/UserID"
+        - $ref: "#/components/parameters/GuildID"
+        - name: action
+          in: path
+          required: true
+          schema:
+            type: string
+            enum: [join, leave, invite, kick, role]
+      requestBody:
+        content:
+          application/json:
+            schema:
+              type: object
+              properties:
+                member_id:
+                  type: string
+                role:
+                  type: string
+                  enum: [leader, officer, member]
+      responses:
+        "200":
+          description: the status of the member after the action
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [guild_id, user_id, status]
+                properties:
+                  guild_id:
+                    type: string
+                  user_id:
+                    type: string
+                  status:
+                    type: string
+                    enum: [request, invite, leader, officer, member, left, kicked]
+        default:
+          $ref: "#/components/responses/Error"
+  /api/user_id/{user_id}/guilds/{guild_id}/items/{action}:
+    post:
+      operationId: moveGuildItems
+      parameters:
+        - $ref: "#/components/parameters/UserID"
+        - $ref: "#/components/parameters/GuildID"
+        - name: action
+          in: path
+          required: true
+          schema:
+            type: string
+            enum: [deposit, withdraw]
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              type: object
+              required: [item_ids]
+              properties:
+                item_ids:
+                  type: array
+                  minItems: 1
+                  items:
+                    type: string
+      responses:
+        "200":
+          description: the items are moved
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [guild_id, item_ids]
+                properties:
+                  guild_id:
+                    type: string
+                  item_ids:
+                    type: array
+                    items:
+                      type: string
+        default:
+          $ref: "#/components/responses/Error"
+  /api/leaderboards/{board_id}:
+    get:
+      operationId: getLeaderboard
+      parameters:
+        - $ref: "#/components/parameters/BoardID"
+        - $ref: "#/components/parameters/Season"
+        - name: limit
+          in: query
+          schema:
+            type: integer
+            minimum: 1
+            maximum: 100
+      responses:
+        "200":
+          $ref: "#/components/responses/Leaderboard"
+        default:
+          $ref: "#/components/responses/Error"
+  /api/leaderboards/{board_id}/scores:
+    post:
+      operationId: submitScore
+      parameters:
+        - $ref: "#/components/parameters/BoardID"
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              type: object
+              required: [user_id, score]
+              properties:
+                user_id:
+                  type: string
+                score:
+                  type: integer
+                  minimum: 0
+      responses:
+        "200":
+          description: the best score of the user in the season and its rank
+          content:
+            application/json:
+              schema:
+                $ref: "#/components/schemas/LeaderboardEntry"
+        default:
+          $ref: "#/components/responses/Error"
+  /api/leaderboards/{board_id}/user_id/{user_id}:
+    get:
+      operationId: getLeaderboardAround
+      parameters:
+        - $ref: "#/components/parameters/BoardID"
+        - $ref: "#/components/parameters/UserID"
+        - $ref: "#/components/parameters/Season"
+        - name: around
+          in: query
+          schema:
+            type: integer
+            minimum: 0
+            maximum: 50
+      responses:
+        "200":
+          $ref: "#/components/responses/Leaderboard"
+        default:
+          $ref: "#/components/responses/Error"
+  /admin/leaderboards/{board_id}/rebuild:
+    post:
+      operationId: rebuildLeaderboard
+      parameters:
+        - $ref: "#/components/parameters/AdminToken"
+        - $ref: "#/components/parameters/BoardID"
+        - $ref: "#/components/parameters/Season"
+      responses:
+        "200":
+          description: the board was rebuilt from the scores in Spanner
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [board_id, entries]
+                properties:
+                  board_id:
+                    type: string
+                  entries:
+                    type: integer
+        default:
+          $ref: "#/components/responses/Error"
+  /admin/users/{user_id}/bans:
+    get:
+      operationId: getBans
+      parameters:
+        - $ref: "#/components/parameters/AdminToken"
+        - $ref: "#/components/parameters/UserID"
+      responses:
+        "200":
+          description: all bans of the user, including lifted and expired ones
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [bans]
+                properties:
+                  bans:
+                    type: array
+                    items:
+                      $ref: "#/components/schemas/Ban"
+        default:
+          $ref: "#/components/responses/Error"
+    post:
+      operationId: banUser
+      parameters:
+        - $ref: "#/components/parameters/AdminToken"
+        - $ref: "#/components/parameters/UserID"
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              type: object
+              required: [reason, issued_by]
+              properties:
+                reason:
+                  type: string
+                issued_by:
+                  type: string
+                expires_at:
+                  type: string
+                  format: date-time
+      responses:
+        "200":
+          description: the ban, which is a suspension if it has expires_at
+          content:
+            application/json:
+              schema:
+                $ref: "#/components/schemas/Ban"
+        default:
+          $ref: "#/components/responses/Error"
+  /admin/users/{user_id}/bans/lift:
+    post:
+      operationId: liftBans
+      parameters:
+        - $ref: "#/components/parameters/AdminToken"
+        - $ref: "#/components/parameters/UserID"
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              type: object
+              required: [lifted_by]
+              properties:
+                lifted_by:
+                  type: string
+      responses:
+        "200":
+          description: the number of bans lifted
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [user_id, lifted]
+                properties:
+                  user_id:
+                    type: string
+                  lifted:
+                    type: integer
+        default:
+          $ref: "#/components/responses/Error"
+  /admin/audit:
+    get:
+      operationId: getAuditLog
+      parameters:
+        - $ref: "#/components/parameters/AdminToken"
+        - name: user_id
+          in: query
+          schema:
+            type: string
+        - name: action
+          in: query
+          schema:
+            type: string
+        - name: since
+          in: query
+          description: the last 24 hours if it's omitted
+          schema:
+            type: string
+            format: date-time
+        - name: until
+          in: query
+          schema:
+            type: string
+            format: date-time
+        - name: limit
+          in: query
+          schema:
+            type: integer
+            minimum: 1
+            maximum: 1000
+      responses:
+        "200":
+          description: audit log entries, newest first
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [entries]
+                properties:
+                  entries:
+                    type: array
+                    items:
+                      $ref: "#/components/schemas/AuditEntry"
+        default:
+          $ref: "#/components/responses/Error"
+  /admin/users/{user_id}/restore:
+    post:
+      operationId: restoreUser
+      parameters:
+        - $ref: "#/components/parameters/AdminToken"
+        - $ref: "#/components/parameters/UserID"
+      responses:
+        "200":
+          description: the user is restored
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [user_id, restored]
+                properties:
+                  user_id:
+                    type: string
+                  restored:
+                    type: boolean
+        default:
+          $ref: "#/components/responses/Error"
+  /admin/users/{user_id}/items:
+    get:
+      operationId: getUserItemsForAdmin
+      parameters:
+        - $ref: "#/components/parameters/AdminToken"
+        - $ref: "#/components/parameters/UserID"
+        - name: limit
+          in: query
+          schema:
+            type: integer
+            minimum: 1
+            maximum: 1000
+        - name: cursor
+          in: query
+          schema:
+            type: string
+        - name: sort
+          in: query
+          schema:
+            type: string
+            enum: [item_id, acquired_at, item_name]
+        - name: order
+          in: query
+          schema:
+            type: string
+            enum: [asc, desc]
+      responses:
+        "200":
+          description: a page of items the user has including soft deleted and expired ones
+          content:
+            application/json:
+              schema:
+                $ref: "#/components/schemas/ItemPage"
+        default:
+          $ref: "#/components/responses/Error"
+  /admin/users/{user_id}/items/{item_id}:
+    delete:
+      operationId: deleteUserItem
+      parameters:
+        - $ref: "#/components/parameters/AdminToken"
+        - $ref: "#/components/parameters/UserID"
+        - $ref: "#/components/parameters/ItemID"
+      responses:
+        "200":
+          description: the item is soft deleted
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [user_id, item_id, deleted]
+                properties:
+                  user_id:
+                    type: string
+                  item_id:
+                    type: string
+                  deleted:
+                    type: boolean
+        default:
+          $ref: "#/components/responses/Error"
+  /admin/users/{user_id}/items/{item_id}/restore:
+    post:
+      operationId: restoreUserItem
+      parameters:
+        - $ref: "#/components/parameters/AdminToken"
+        - $ref: "#/components/parameters/UserID"
+        - $ref: "#/components/parameters/ItemID"
+      responses:
+        "200":
+          description: the item is restored
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [user_id, item_id, restored]
+                properties:
+                  user_id:
+                    type: string
+                  item_id:
+                    type: string
+                  restored:
+                    type: boolean
+        default:
+          $ref: "#/components/responses/Error"
+  /admin/users/{user_id}/export:
+    get:
+      operationId: exportUser
+      parameters:
+        - $ref: "#/components/parameters/AdminToken"
+        - $ref: "#/components/parameters/UserID"
+      responses:
+        "200":
+          description: every row about the user by table
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [user_id, exported_at, tables]
+                properties:
+                  user_id:
+                    type: string
+                  exported_at:
+                    type: string
+                    format: date-time
+                  tables:
+                    type: object
+                    additionalProperties:
+                      type: array
+                      items:
+                        type: object
+        default:
+          $ref: "#/components/responses/Error"
+  /admin/users/{user_id}/erase:
+    post:
+      operationId: eraseUser
+      parameters:
+        - $ref: "#/components/parameters/AdminToken"
+        - $ref: "#/components/parameters/UserID"
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              type: object
+              required: [requested_by]
+              properties:
+                requested_by:
+                  type: string
+      responses:
+        "200":
+          description: the receipt of the erasure
+          content:
+            application/json:
+              schema:
+                $ref: "#/components/schemas/ErasureReceipt"
+        default:
+          $ref: "#/components/responses/Error"
+  /admin/grants:
+    post:
+      operationId: grantItems
+      parameters:
+        - $ref: "#/components/parameters/AdminToken"
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              type: object
+              required: [grants]
+              properties:
+                grants:
+                  type: array
+                  minItems: 1
+                  maxItems: 5000
+                  items:
+                    type: object
+                    required: [user_id, item_id]
+                    properties:
+                      user_id:
+                        type: string
+                      item_id:
+                        type: string
+                      expires_at:
+                        type: string
+                        format: date-time
+      responses:
+        "200":
+          description: result of each grant in the same order as the request
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [results]
+                properties:
+                  results:
+                    type: array
+                    items:
+                      $ref: "#/components/schemas/GrantResult"
+        default:
+          $ref: "#/components/responses/Error"
+  /admin/users/{user_id}/balances/{currency}:
+    post:
+      operationId: creditBalance
+      parameters:
+        - $ref: "#/components/parameters/AdminToken"
+        - $ref: "#/components/parameters/UserID"
+        - name: currency
+          in: path
+          required: true
+          schema:
+            type: string
+            pattern: "^[a-z0-9_]+$"
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              type: object
+              required: [amount]
+              properties:
+                amount:
+                  type: integer
+                  minimum: 1
+                reason:
+                  type: string
+                  pattern: "^[a-z0-9_]{1,64}$"
+                correlation_id:
+                  type: string
+                  maxLength: 64
+      responses:
+        "200":
+          description: the balance after the credit
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [currency, balance]
+                properties:
+                  currency:
+                    type: string
+                  balance:
+                    type: integer
+        default:
+          $ref: "#/components/responses/Error"
+components:
+  parameters:
+    UserID:
+      name: user_id
+      in: path
+      required: true
+      schema:
+        type: string
+        pattern: "^[a-z0-9-.]+$"
+    UserName:
+      name: user_name
+      in: path
+      required: true
+      schema:
+        type: string
+        pattern: "^[a-z0-9-.]+$"
+    ItemID:
+      name: item_id
+      in: path
+      required: true
+      schema:
+        type: string
+        pattern: "^[a-z0-9-.]+$"
+    AdminToken:
+      name: X-Admin-Token
+      in: header
+      required: true
+      schema:
+        type: string
+    BoardID:
+      name: board_id
+      in: path
+      required: true
+      schema:
+        type: string
+        pattern: "^[a-z0-9_-]+$"
+    GuildID:
+      name: guild_id
+      in: path
+      required: true
+      schema:
+        type: string
+        pattern: "^[a-z0-9-.]+$"
+    Season:
+      name: season
+      in: query
+      description: like 2023-W05 for weekly boards, the current season if it's omitted
+      schema:
+        type: string
+  responses:
+    User:
+      description: the user
+      content:
+        application/json:
+          schema:
+            $ref: "#/components/schemas/User"
+    Trade:
+      description: the gift or the trade, the items are moved when it's completed
+      content:
+        application/json:
+          schema:
+            $ref: "#/components/schemas/Trade"
+    Draw:
+      description: the draw, it can be replayed with the seed and the drop table of the hash
+      content:
+        application/json:
+          schema:
+            $ref: "#/components/schemas/Draw"
+    MailClaims:
+      description: the items attached to the mails were granted, the ones owned already are kept in the mails
+      content:
+        application/json:
+          schema:
+            type: object
+            required: [claims]
+            properties:
+              claims:
+                type: array
+                items:
+                  type: object
+                  required: [mail_id, results, claimed, kept_item_ids]
+                  properties:
+                    mail_id:
+                      type: string
+                    results:
+                      type: array
+                      items:
+                        $ref: "#/components/schemas/GrantResult"
+                    claimed:
+                      type: boolean
+                      description: false if some items are kept in the mail
+                    kept_item_ids:
+                      type: array
+                      items:
+                        type: string
+    Leaderboard:
+      description: entries in rank order
+      content:
+        application/json:
+          schema:
+            type: object
+            required: [board_id, season, entries]
+            properties:
+              board_id:
+                type: string
+              season:
+                type: string
+              user:
+                $ref: "#/components/schemas/LeaderboardEntry"
+              entries:
+                type: array
+                items:
+                  $ref: "#/components/schemas/LeaderboardEntry"
+    Guild:
+      description: the guild with its members, requests and items
+      content:
+        application/json:
+          schema:
+            $ref: "#/components/schemas/Guild"
+    Empty:
+      description: done
+      content:
+        application/json:
+          schema:
+            type: object
+            additionalProperties: false
+    Error:
+      description: error
+      content:
+        application/json:
+          schema:
+            $ref: "#/components/schemas/Error"
+        text/plain:
+          schema:
+            type: string
+  schemas:
+    Error:
+      type: object
+      required: [ERROR]
+      properties:
+        ERROR:
+          type: string
+        FIELDS:
+          type: object
+          additionalProperties:
+            type: string
+    CreateUserRequest:
+      type: object
+      required: [name]
+      properties:
+        name:
+          type: string
+        locale:
+          type: string
+        country:
+          type: string
+        platform:
+          type: string
+        timezone:
+          type: string
+    User:
+      type: object
+      required: [id, name]
+      properties:
+        id:
+          type: string
+        name:
+          type: string
+        locale:
+          type: string
+        country:
+          type: string
+        platform:
+          type: string
+        timezone:
+          type: string
+    UserProfile:
+      type: object
+      required: [id, name, created_at, updated_at]
+      properties:
+        id:
+          type: string
+        name:
+          type: string
+        locale:
+          type: string
+        country:
+          type: string
+        platform:
+          type: string
+        timezone:
+          type: string
+        created_at:
+          type: string
+          format: date-time
+        updated_at:
+          type: string
+          format: date-time
+        friend_count:
+          type: integer
+    GrantResult:
+      type: object
+      required: [user_id, item_id, status]
+      properties:
+        user_id:
+          type: string
+        item_id:
+          type: string
+        status:
+          type: string
+          enum: [granted, already_owned, unknown_item, unknown_user, banned_user]
+    Item:
+      type: object
+      required: [user_name, item_name, item_id, created_at, updated_at]
+      properties:
+        user_name:
+          type: string
+        item_name:
+          type: string
+        item_id:
+          type: string
+        created_at:
+          type: string
+          format: date-time
+        updated_at:
+          type: string
+          format: date-time
+        expires_at:
+          type: string
+          format: date-time
+        expired:
+          type: boolean
+        deleted_at:
+          type: string
+          format: date-time
+    ItemPage:
+      type: object
+      required: [items]
+      properties:
+        items:
+          type: array
+          items:
+            $ref: "#/components/schemas/Item"
+        next_cursor:
+          type: string
+    DropTableOdds:
+      type: object
+      required: [drop_table_id, name, currency, cost, table_hash, entries, rarities]
+      properties:
+        drop_table_id:
+          type: string
+        name:
+          type: string
+        currency:
+          type: string
+        cost:
+          type: integer
+        pity_threshold:
+          type: integer
+        pity_rarity:
+          type: string
+        table_hash:
+          type: string
+        entries:
+          type: array
+          items:
+            type: object
+            required: [item_id, weight, rarity, probability]
+            properties:
+              item_id:
+                type: string
+              weight:
+                type: integer
+              rarity:
+                type: string
+              probability:
+                type: number
+        rarities:
+          type: object
+          additionalProperties:
+            type: number
+    Draw:
+      type: object
+      required: [draw_id, drop_table_id, table_hash, seed, pity_before, cost, results, created_at]
+      properties:
+        draw_id:
+          type: string
+        drop_table_id:
+          type: string
+        table_hash:
+          type: string
+        seed:
+          type: string
+        pity_before:
+          type: integer
+        cost:
+          type: integer
+        balance:
+          type: integer
+        results:
+          type: array
+          items:
+            type: object
+            required: [item_id, rarity, pity]
+            properties:
+              item_id:
+                type: string
+              rarity:
+                type: string
+              pity:
+                type: boolean
+              status:
+                type: string
+                enum: [granted, already_owned]
+        created_at:
+          type: string
+          format: date-time
+    Mail:
+      type: object
+      required: [mail_id, sender, subject, item_ids, expires_at, claimed, created_at]
+      properties:
+        mail_id:
+          type: string
+        sender:
+          type: string
+        subject:
+          type: string
+        body:
+          type: string
+        item_ids:
+          type: array
+          items:
+            type: string
+        expires_at:
+          type: string
+          format: date-time
+        claimed:
+          type: boolean
+        claimed_at:
+          type: string
+          format: date-time
+        created_at:
+          type: string
+          format: date-time
+    LeaderboardEntry:
+      type: object
+      required: [rank, user_id, score]
+      properties:
+        rank:
+          type: integer
+        user_id:
+          type: string
+        score:
+          type: integer
+    Offer:
+      type: object
+      required: [offer_id, name, item_ids, currency, price, sold]
+      properties:
+        offer_id:
+          type: string
+        name:
+          type: string
+        item_ids:
+          type: array
+          items:
+            type: string
+        currency:
+          type: string
+        price:
+          type: integer
+        starts_at:
+          type: string
+          format: date-time
+        ends_at:
+          type: string
+          format: date-time
+        per_user_limit:
+          type: integer
+        stock:
+          type: integer
+        sold:
+          type: integer
+    Purchase:
+      type: object
+      required: [purchase_id, offer_id, currency, price, balance, results, created_at]
+      properties:
+        purchase_id:
+          type: string
+        offer_id:
+          type: string
+        currency:
+          type: string
+        price:
+          type: integer
+        balance:
+          type: integer
+        results:
+          type: array
+          items:
+            $ref: "#/components/schemas/GrantResult"
+        created_at:
+          type: string
+          format: date-time
+    LedgerEntry:
+      type: object
+      required: [entry_id, currency, amount, balance, reason, correlation_id, created_at]
+      properties:
+        entry_id:
+          type: string
+        currency:
+          type: string
+        amount:
+          type: integer
+        balance:
+          type: integer
+        reason:
+          type: string
+        correlation_id:
+          type: string
+        created_at:
+          type: string
+          format: date-time
+    Trade:
+      type: object
+      required: [trade_id, kind, status, user_id, item_ids, partner_id, partner_item_ids, created_at]
+      properties:
+        trade_id:
+          type: string
+        kind:
+          type: string
+          enum: [gift, trade]
+        status:
+          type: string
+          enum: [proposed, completed, declined, cancelled]
+        user_id:
+          type: string
+        item_ids:
+          type: array
+          items:
+            type: string
+        partner_id:
+          type: string
+        partner_item_ids:
+          type: array
+          items:
+            type: string
+        created_at:
+          type: string
+          format: date-time
+    Friendship:
+      type: object
+      required: [friend_id, status, created_at, updated_at]
+      properties:
+        friend_id:
+          type: string
+        status:
+          type: string
+          enum: [friend, requested, pending, blocked, none]
+        created_at:
+          type: string
+          format: date-time
+        updated_at:
+          type: string
+          format: date-time
+    Guild:
+      type: object
+      required: [guild_id, name, max_members, members, requests, items, created_at]
+      properties:
+        guild_id:
+          type: string
+        name:
+          type: string
+        description:
+          type: string
+        max_members:
+          type: integer
+        members:
+          type: array
+          items:
+            type: object
+            required: [user_id, role, joined_at]
+            properties:
+              user_id:
+                type: string
+              role:
+                type: string
+                enum: [leader, officer, member]
+              joined_at:
+                type: string
+                format: date-time
+        requests:
+          type: array
+          items:
+            type: object
+            required: [user_id, kind, created_at]
+            properties:
+              user_id:
+                type: string
+              kind:
+                type: string
+                enum: [request, invite]
+              invited_by:
+                type: string
+              created_at:
+                type: string
+                format: date-time
+        items:
+          type: array
+          items:
+            type: object
+            required: [item_id, quantity]
+            properties:
+              item_id:
+                type: string
+              quantity:
+                type: integer
+        created_at:
+          type: string
+          format: date-time
+    Ban:
+      type: object
+      required: [ban_id, user_id, reason, issued_by, created_at]
+      properties:
+        ban_id:
+          type: string
+        user_id:
+          type: string
+        reason:
+          type: string
+        issued_by:
+          type: string
+        expires_at:
+          type: string
+          format: date-time
+        lifted_at:
+          type: string
+          format: date-time
+        lifted_by:
+          type: string
+        created_at:
+          type: string
+          format: date-time
+    AuditEntry:
+      type: object
+      required: [audit_id, actor, action, created_at]
+      properties:
+        audit_id:
+          type: string
+        actor:
+          type: string
+        action:
+          type: string
+        target_user_id:
+          type: string
+        target:
+          type: string
+        before:
+          type: object
+        after:
+          type: object
+        request_id:
+          type: string
+        trace_id:
+          type: string
+        created_at:
+          type: string
+          format: date-time
+    ErasureReceipt:
+      type: object
+      required: [receipt_id, subject_hash, requested_by, deleted_rows, anonymised_rows, redis_entries, created_at]
+      properties:
+        receipt_id:
+          type: string
+        subject_hash:
+          type: string
+        requested_by:
+          type: string
+        deleted_rows:
+          type: object
+          additionalProperties:
+            type: integer
+        anonymised_rows:
+          type: object
+          additionalProperties:
+            type: integer
+        redis_entries:
+          type: integer
+        created_at:
+          type: string
+          format: date-time
+        completed_at:
+          type: string
+          format: date-time
+`
+
+func loadOpenapiSpec() (*openapi3.T, error) {
+	// keep error messages short, they are returned to clients
+	openapi3.SchemaErrorDetailsDisabled = true
+
+	doc, err := openapi3.NewLoader().LoadFromData([]byte(openapiSpec))
+	if err != nil {
+		return nil, err
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func serveOpenapiSpec(doc *openapi3.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		render.JSON(w, r, doc)
+	}
+}
+
+// responseRecorder holds the response until it is validated
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.body.Write(b)
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+// openapiValidator rejects requests that don't match the spec with 400.
+// With checkResponses, responses are validated too and a mismatch is turned into 500,
+// it is supposed to be used in test, because every response is buffered.
+func openapiValidator(doc *openapi3.T, checkResponses bool) (func(http.Handler) http.Handler, error) {
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		return nil, err
+	}
+	options := &openapi3filter.Options{
+		AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route, pathParams, err := router.FindRoute(r)
+			if err != nil {
+				if checkResponses {
+					errorRender(w, r, http.StatusInternalServerError, fmt.Errorf("%s %s is not in the spec: %w", r.Method, r.URL.Path, err))
+					return
+				}
+				// let the router answer 404 or 405
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			requestInput := &openapi3filter.RequestValidationInput{
+				Request:    r,
+				PathParams: pathParams,
+				Route:      route,
+				Options:    options,
+			}
+			if err := openapi3filter.ValidateRequest(r.Context(), requestInput); err != nil {
+				errorRender(w, r, http.StatusBadRequest, err)
+				return
+			}
+
+			if !checkResponses {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			rec := &responseRecorder{header: w.Header()}
+			next.ServeHTTP(rec, r)
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+
+			if err := validateResponse(r.Context(), requestInput, route, rec); err != nil {
+				log.Println(err)
+				errorRender(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			w.WriteHeader(rec.status)
+			io.Copy(w, &rec.body)
+		})
+	}, nil
+}
+
+func validateResponse(ctx context.Context, requestInput *openapi3filter.RequestValidationInput, route *routers.Route, rec *responseRecorder) error {
+	responseInput := &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: requestInput,
+		Status:                 rec.status,
+		Header:                 rec.header,
+		Options: &openapi3filter.Options{
+			IncludeResponseStatus: true,
+		},
+	}
+	responseInput.SetBodyBytes(rec.body.Bytes())
+	if err := openapi3filter.ValidateResponse(ctx, responseInput); err != nil {
+		return fmt.Errorf("response of %s does not match the spec: %w", route.Operation.OperationID, err)
+	}
+	return nil
+}
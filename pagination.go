@@ -0,0 +1,159 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultPageLimit = 100
+	// the maximum of limit in the OpenAPI spec is the same
+	maxPageLimit = 1000
+)
+
+// columns the inventory can be sorted by, keyed by the value of "sort" query param
+var itemSortColumns = map[string]string{
+	"item_id":     "user_items.item_id",
+	"acquired_at": "user_items.created_at",
+	"item_name":   "items.item_name",
+}
+
+type pageParams struct {
+	limit  int
+	sort   string
+	desc   bool
+	cursor *pageCursor
+	// expired items that have not been deleted yet are included with "expired" flag
+	includeExpired bool
+	// soft deleted items are included with "deleted_at", only for admins
+	includeDeleted bool
+}
+
+// pageCursor points at the last row of the previous page.
+// It is handed to clients as an opaque string, see encode/decodeCursor.
+type pageCursor struct {
+	Sort   string `json:"s"`
+	Desc   bool   `json:"d,omitempty"`
+	Key    string `json:"k,omitempty"`
+	ItemID string `json:"i"`
+}
+
+type itemPage struct {
+	Items      []map[string]interface{} `json:"items"`
+	NextCursor string                   `json:"next_cursor,omitempty"`
+}
+
+func encodeCursor(c pageCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (*pageCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	var c pageCursor
+	if err := json.Unmarshal(b, &c); err != nil || c.ItemID == "" {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &c, nil
+}
+
+// cacheKey identifies the page, the cursor string is used as is since it is opaque
+func (p pageParams) cacheKey(userID string) string {
+	order := "asc"
+	if p.desc {
+		order = "desc"
+	}
+	cursor := ""
+	if p.cursor != nil {
+		cursor = encodeCursor(*p.cursor)
+	}
+	return fmt.Sprintf("userItems_%s_%s_%s_%d_%t_%t_%s", userID, p.sort, order, p.limit, p.includeExpired, p.includeDeleted, cursor)
+}
+
+// read limit, cursor, sort and order from query string
+func parsePageParams(r *http.Request) (pageParams, error) {
+	q := r.URL.Query()
+
+	limit := 0
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return pageParams{}, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+		limit = n
+	}
+	p, err := newPageParams(limit, q.Get("sort"), q.Get("order"), q.Get("cursor"))
+	if err != nil {
+		return p, err
+	}
+	if v := q.Get("include_expired"); v != "" {
+		if p.includeExpired, err = strconv.ParseBool(v); err != nil {
+			return p, fmt.Errorf("include_expired must be true or false")
+		}
+	}
+	return p, nil
+}
+
+// newPageParams validates the params, zero limit and empty strings mean defaults
+func newPageParams(limit int, sort, order, cursor string) (pageParams, error) {
+	p := pageParams{
+		limit: defaultPageLimit,
+		sort:  "item_id",
+	}
+
+	if limit != 0 {
+		if limit < 1 || limit > maxPageLimit {
+			return p, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+		p.limit = limit
+	}
+
+	if sort != "" {
+		if _, ok := itemSortColumns[sort]; !ok {
+			return p, fmt.Errorf("sort must be one of item_id, acquired_at or item_name")
+		}
+		p.sort = sort
+	}
+
+	switch order {
+	case "", "asc":
+	case "desc":
+		p.desc = true
+	default:
+		return p, fmt.Errorf("order must be asc or desc")
+	}
+
+	if cursor != "" {
+		c, err := decodeCursor(cursor)
+		if err != nil {
+			return p, err
+		}
+		if c.Sort != p.sort || c.Desc != p.desc {
+			return p, fmt.Errorf("cursor does not match sort and order")
+		}
+		p.cursor = c
+	}
+
+	return p, nil
+}
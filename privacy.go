@@ -0,0 +1,409 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"cloud.google.com/go/spanner"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/api/iterator"
+	sppb "google.golang.org/genproto/googleapis/spanner/v1"
+	"google.golang.org/grpc/codes"
+)
+
+type privacyOperation interface {
+	exportUser(context.Context, io.Writer, string) (userArchive, error)
+	eraseUser(context.Context, io.Writer, string, string) (erasureReceipt, error)
+}
+
+// tables interleaved in users, they are deleted with the user
+var userChildTables = []string{
+	"user_items", "user_balances", "currency_ledger", "user_gacha_pity", "gacha_draws", "login_claims", "mails",
+	"leaderboard_scores", "user_stats", "user_achievements", "purchases", "friendships", "user_bans",
+}
+
+// other rows about the user, keyed by the name in the archive
+var userRelatedQueries = map[string]string{
+	"friendships_of_others": "SELECT * FROM friendships@{FORCE_INDEX=friendships_by_friend_id} WHERE friend_id = @userID",
+	"guild_members":         "SELECT * FROM guild_members@{FORCE_INDEX=guild_members_by_user_id} WHERE user_id = @userID",
+	"guild_requests":        "SELECT * FROM guild_requests@{FORCE_INDEX=guild_requests_by_user_id} WHERE user_id = @userID",
+	"trades":                "SELECT * FROM trades@{FORCE_INDEX=trades_by_user_id} WHERE user_id = @userID",
+	"trades_as_partner":     "SELECT * FROM trades@{FORCE_INDEX=trades_by_partner_id} WHERE partner_id = @userID",
+	"audit_log":             "SELECT * FROM audit_log@{FORCE_INDEX=audit_log_by_target_user_id} WHERE target_user_id = @userID",
+	// items.moved is for the sender, and the recipient is in target and after
+	"audit_log_as_target": "SELECT * FROM audit_log WHERE target = @userID OR JSON_VALUE(after, '$.to') = @userID",
+}
+
+// rows kept for others after the erasure, the user id in them is replaced with a random one
+var userAnonymiseStatements = map[string]string{
+	"trades":            "UPDATE trades SET user_id = @pseudonym WHERE user_id = @userID",
+	"trades_as_partner": "UPDATE trades SET partner_id = @pseudonym WHERE partner_id = @userID",
+	"guild_requests":    "UPDATE guild_requests SET invited_by = NULL WHERE invited_by = @userID",
+	"audit_log":         "UPDATE audit_log SET target_user_id = @pseudonym, before = NULL, after = NULL WHERE target_user_id = @userID",
+	"audit_log_actor":   "UPDATE audit_log SET actor = CONCAT('user:', @pseudonym) WHERE actor = CONCAT('user:', @userID)",
+	"audit_log_as_target": `UPDATE audit_log SET target = @pseudonym, before = NULL, after = NULL
+	  WHERE target = @userID OR JSON_VALUE(after, '$.to') = @userID`,
+}
+
+// userArchive is everything stored about the user, rows of each table as they are
+type userArchive struct {
+	UserID     string                              `json:"user_id"`
+	ExportedAt time.Time                           `json:"exported_at"`
+	Tables     map[string][]map[string]interface{} `json:"tables"`
+}
+
+type erasureReceipt struct {
+	ReceiptID string `json:"receipt_id"`
+	// sha256 of the user id, the erased user can be told without keeping the id
+	SubjectHash    string           `json:"subject_hash"`
+	RequestedBy    string           `json:"requested_by"`
+	DeletedRows    map[string]int64 `json:"deleted_rows"`
+	AnonymisedRows map[string]int64 `json:"anonymised_rows"`
+	RedisEntries   int64            `json:"redis_entries"`
+	CreatedAt      time.Time        `json:"created_at"`
+	CompletedAt    *time.Time       `json:"completed_at,omitempty"`
+}
+
+// erasureCache is the Redis entries of others to clean up after the user is deleted.
+// It's kept in the receipt until it's completed, so that the erasure can be resumed.
+// The keys of the user are not in it, they are made from the user id when it's resumed.
+type erasureCache struct {
+	Leaderboards []string `json:"leaderboards"`
+	FriendCounts []string `json:"friend_counts"`
+}
+
+func subjectHash(userID string) string {
+	sum := sha256.Sum256([]byte(userID))
+	return hex.EncodeToString(sum[:])
+}
+
+// rowToMap converts the row for JSON, INT64 is decoded as a number and JSON as an object
+func rowToMap(row *spanner.Row) (map[string]interface{}, error) {
+	m := map[string]interface{}{}
+	for i, name := range row.ColumnNames() {
+		var v spanner.GenericColumnValue
+		if err := row.Column(i, &v); err != nil {
+			return nil, err
+		}
+		switch v.Type.Code {
+		case sppb.TypeCode_INT64:
+			var n spanner.NullInt64
+			if err := v.Decode(&n); err != nil {
+				return nil, err
+			}
+			m[name] = nil
+			if n.Valid {
+				m[name] = n.Int64
+			}
+		case sppb.TypeCode_JSON:
+			var j spanner.NullJSON
+			if err := v.Decode(&j); err != nil {
+				return nil, err
+			}
+			m[name] = nil
+			if j.Valid {
+				m[name] = j.Value
+			}
+		default:
+			m[name] = v.Value.AsInterface()
+		}
+	}
+	return m, nil
+}
+
+func queryRows(ctx context.Context, txn *spanner.ReadOnlyTransaction, sql, userID string) ([]map[string]interface{}, error) {
+	rows := []map[string]interface{}{}
+	err := txn.Query(ctx, spanner.Statement{SQL: sql, Params: map[string]interface{}{"userID": userID}}).Do(func(row *spanner.Row) error {
+		m, err := rowToMap(row)
+		rows = append(rows, m)
+		return err
+	})
+	return rows, err
+}
+
+// export all rows about the user, soft deleted users are also exported.
+// Published events are not stored by the app, so they are not included.
+func (d dbClient) exportUser(ctx context.Context, w io.Writer, userID string) (userArchive, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "exportUser")
+	defer span.End()
+
+	txn := d.sc.ReadOnlyTransaction()
+	defer txn.Close()
+
+	archive := userArchive{UserID: userID, ExportedAt: time.Now(), Tables: map[string][]map[string]interface{}{}}
+	users, err := queryRows(ctx, txn, "SELECT * FROM users WHERE user_id = @userID", userID)
+	if err != nil {
+		return userArchive{}, err
+	}
+	if len(users) == 0 {
+		return userArchive{}, errUserNotFound
+	}
+	archive.Tables["users"] = users
+
+	for _, table := range userChildTables {
+		if archive.Tables[table], err = queryRows(ctx, txn, fmt.Sprintf("SELECT * FROM %s WHERE user_id = @userID", table), userID); err != nil {
+			return userArchive{}, err
+		}
+	}
+	for name, sql := range userRelatedQueries {
+		if archive.Tables[name], err = queryRows(ctx, txn, sql, userID); err != nil {
+			return userArchive{}, err
+		}
+	}
+	return archive, nil
+}
+
+// erase the user, the rows of the user are deleted and the ones kept for others are anonymised.
+// The anonymisation runs after the user is deleted, so the audit log written by the deletion is also anonymised.
+// When the user is deleted but the erasure is not completed, running it again resumes from the receipt.
+func (d dbClient) eraseUser(ctx context.Context, w io.Writer, userID, requestedBy string) (erasureReceipt, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "eraseUser")
+	defer span.End()
+
+	receipt := erasureReceipt{
+		ReceiptID:      uuid.NewString(),
+		SubjectHash:    subjectHash(userID),
+		RequestedBy:    requestedBy,
+		DeletedRows:    map[string]int64{},
+		AnonymisedRows: map[string]int64{},
+		CreatedAt:      time.Now(),
+	}
+
+	if _, err := d.sc.Single().ReadRow(ctx, "users", spanner.Key{userID}, []string{"user_id"}); err != nil {
+		if spanner.ErrCode(err) != codes.NotFound {
+			return erasureReceipt{}, err
+		}
+		// the user was deleted, but the rest may not be done yet
+		receipt, cache, err := d.incompleteReceipt(ctx, receipt.SubjectHash)
+		if err != nil {
+			return erasureReceipt{}, err
+		}
+		err = d.completeErasure(ctx, userID, &receipt, cache)
+		return receipt, err
+	}
+
+	var cache erasureCache
+	_, err := d.sc.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		cache = erasureCache{Leaderboards: []string{}, FriendCounts: []string{}}
+		if _, err := txn.ReadRow(ctx, "users", spanner.Key{userID}, []string{"user_id"}); err != nil {
+			if spanner.ErrCode(err) == codes.NotFound {
+				return errUserNotFound
+			}
+			return err
+		}
+		for _, table := range userChildTables {
+			var n int64
+			err := txn.Query(ctx, spanner.Statement{
+				SQL:    fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE user_id = @userID", table),
+				Params: map[string]interface{}{"userID": userID},
+			}).Do(func(row *spanner.Row) error {
+				return row.Columns(&n)
+			})
+			if err != nil {
+				return err
+			}
+			receipt.DeletedRows[table] = n
+		}
+		receipt.DeletedRows["users"] = 1
+
+		// the ranks in Redis are removed after the commit
+		err := txn.Read(ctx, "leaderboard_scores", spanner.Key{userID}.AsPrefix(), []string{"board_id", "season"}).Do(func(row *spanner.Row) error {
+			var boardID, season string
+			if err := row.Columns(&boardID, &season); err != nil {
+				return err
+			}
+			cache.Leaderboards = append(cache.Leaderboards, leaderboardKey(boardID, season))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		friendIDs, err := deleteFriendshipsInTxn(ctx, txn, userID)
+		if err != nil {
+			return err
+		}
+		for _, friendID := range friendIDs {
+			cache.FriendCounts = append(cache.FriendCounts, friendCountKey(friendID))
+		}
+		if err := leaveGuildsInTxn(ctx, txn, userID, true); err != nil {
+			return err
+		}
+		return txn.BufferWrite([]*spanner.Mutation{
+			spanner.Delete("users", spanner.Key{userID}),
+			spanner.Insert("erasure_receipts",
+				[]string{"receipt_id", "subject_hash", "requested_by", "deleted_rows", "anonymised_rows", "pending_cache", "created_at"},
+				[]interface{}{receipt.ReceiptID, receipt.SubjectHash, requestedBy,
+					spanner.NullJSON{Value: receipt.DeletedRows, Valid: true}, spanner.NullJSON{Value: receipt.AnonymisedRows, Valid: true},
+					spanner.NullJSON{Value: cache, Valid: true}, receipt.CreatedAt},
+			),
+			auditMutation(ctx, "user.erased", "", receipt.ReceiptID, nil, map[string]interface{}{"requested_by": requestedBy}),
+		})
+	})
+	if err != nil {
+		return erasureReceipt{}, err
+	}
+
+	err = d.completeErasure(ctx, userID, &receipt, cache)
+	return receipt, err
+}
+
+// incompleteReceipt finds the receipt of the erasure that is not completed
+func (d dbClient) incompleteReceipt(ctx context.Context, hash string) (erasureReceipt, erasureCache, error) {
+	stmt := spanner.Statement{
+		SQL: `SELECT receipt_id, requested_by, deleted_rows, anonymised_rows, pending_cache, created_at FROM erasure_receipts
+		  WHERE subject_hash = @hash AND completed_at IS NULL LIMIT 1`,
+		Params: map[string]interface{}{"hash": hash},
+	}
+	iter := d.sc.Single().Query(ctx, stmt)
+	defer iter.Stop()
+
+	row, err := iter.Next()
+	if err == iterator.Done {
+		return erasureReceipt{}, erasureCache{}, errUserNotFound
+	}
+	if err != nil {
+		return erasureReceipt{}, erasureCache{}, err
+	}
+	receipt := erasureReceipt{SubjectHash: hash, DeletedRows: map[string]int64{}, AnonymisedRows: map[string]int64{}}
+	var deletedRows, anonymisedRows, pending spanner.NullJSON
+	if err := row.Columns(&receipt.ReceiptID, &receipt.RequestedBy, &deletedRows, &anonymisedRows, &pending, &receipt.CreatedAt); err != nil {
+		return erasureReceipt{}, erasureCache{}, err
+	}
+	// JSON columns are decoded as generic values, they are converted through JSON again
+	var cache erasureCache
+	for _, c := range []struct {
+		from spanner.NullJSON
+		to   interface{}
+	}{{deletedRows, &receipt.DeletedRows}, {anonymisedRows, &receipt.AnonymisedRows}, {pending, &cache}} {
+		if !c.from.Valid {
+			continue
+		}
+		jsoned, err := json.Marshal(c.from.Value)
+		if err != nil {
+			return erasureReceipt{}, erasureCache{}, err
+		}
+		if err := json.Unmarshal(jsoned, c.to); err != nil {
+			return erasureReceipt{}, erasureCache{}, err
+		}
+	}
+	return receipt, cache, nil
+}
+
+// completeErasure anonymises the rows kept for others, removes the Redis entries of the deleted user and completes the receipt.
+// Each step can be run again, so it's run again from the start when it's resumed.
+func (d dbClient) completeErasure(ctx context.Context, userID string, receipt *erasureReceipt, cache erasureCache) error {
+	// a new pseudonym for each run, the rows anonymised by a failed run don't have the user id any more
+	pseudonym := uuid.NewString()
+	for name, sql := range userAnonymiseStatements {
+		n, err := d.sc.PartitionedUpdate(ctx, spanner.Statement{SQL: sql, Params: map[string]interface{}{"userID": userID, "pseudonym": pseudonym}})
+		if err != nil {
+			return err
+		}
+		receipt.AnonymisedRows[name] = n
+	}
+
+	// every key of the user, and the user in the leaderboards and the friend counts of others
+	keys := []string{fmt.Sprintf("user_%s", userID), friendCountKey(userID), banKey(userID)}
+	indexKey := fmt.Sprintf("userItemsKeys_%s", userID)
+	pages, err := d.cache.SMembers(indexKey).Result()
+	if err != nil {
+		return err
+	}
+	keys = append(append(append(keys, pages...), indexKey), cache.FriendCounts...)
+	if receipt.RedisEntries, err = d.cache.Del(keys...).Result(); err != nil {
+		return err
+	}
+	for _, key := range cache.Leaderboards {
+		n, err := d.cache.ZRem(key, userID).Result()
+		if err != nil {
+			return err
+		}
+		receipt.RedisEntries += n
+	}
+
+	completedAt := time.Now()
+	receipt.CompletedAt = &completedAt
+	_, err = d.sc.Apply(ctx, []*spanner.Mutation{
+		spanner.Update("erasure_receipts", []string{"receipt_id", "anonymised_rows", "redis_entries", "pending_cache", "completed_at"},
+			[]interface{}{receipt.ReceiptID, spanner.NullJSON{Value: receipt.AnonymisedRows, Valid: true}, receipt.RedisEntries, spanner.NullJSON{}, completedAt}),
+	})
+	if err != nil {
+		log.Println("failed to complete the erasure receipt:", receipt.ReceiptID, err)
+	}
+	return err
+}
+
+func (s Serving) exportUser(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "exportUser.root")
+	span.SetAttributes(attribute.String("server", "exportUser"))
+	defer span.End()
+
+	archive, err := s.Client.exportUser(ctx, w, userID)
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="user-%s.json"`, userID))
+	render.JSON(w, r, archive)
+}
+
+func (s Serving) eraseUser(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "eraseUser.root")
+	span.SetAttributes(attribute.String("server", "eraseUser"))
+	defer span.End()
+
+	var body struct {
+		RequestedBy string `json:"requested_by"`
+	}
+	if err := render.DecodeJSON(r.Body, &body); err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if n := utf8.RuneCountInString(body.RequestedBy); n == 0 || n > 64 {
+		errorRender(w, r, http.StatusBadRequest, validationError{"requested_by": "must be 1 to 64 characters"})
+		return
+	}
+
+	receipt, err := s.Client.eraseUser(ctx, w, userID, body.RequestedBy)
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+	render.JSON(w, r, receipt)
+}
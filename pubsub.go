@@ -19,6 +19,9 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"os"
+	"strconv"
+	"sync"
 
 	"encoding/json"
 
@@ -50,3 +53,75 @@ func publishLog(client *pubsub.Client, topicName string, data map[string]interfa
 
 	return nil
 }
+
+// handlers of domain events in this process, they are registered at start up
+var eventHandlers = map[string][]func(map[string]interface{}){}
+
+var (
+	// the handlers are called by the workers, and the events are dropped when the queue is full
+	eventWorkers = func() int {
+		n, err := strconv.Atoi(os.Getenv("EVENT_WORKERS"))
+		if err != nil || n <= 0 {
+			return 8
+		}
+		return n
+	}()
+	eventQueueSize = func() int {
+		n, err := strconv.Atoi(os.Getenv("EVENT_QUEUE_SIZE"))
+		if err != nil || n <= 0 {
+			return 1000
+		}
+		return n
+	}()
+	eventQueue        chan eventCall
+	startEventWorkers sync.Once
+)
+
+type eventCall struct {
+	event string
+	fn    func(map[string]interface{})
+	data  map[string]interface{}
+}
+
+func runEventWorkers() {
+	eventQueue = make(chan eventCall, eventQueueSize)
+	for i := 0; i < eventWorkers; i++ {
+		go func() {
+			for c := range eventQueue {
+				c.fn(c.data)
+			}
+		}()
+	}
+}
+
+// handleEvent calls fn with the data of the event in a worker whenever it's published
+func handleEvent(event string, fn func(map[string]interface{})) {
+	eventHandlers[event] = append(eventHandlers[event], fn)
+}
+
+// publish a domain event such as "user.renamed", it goes to Pub/Sub only if TOPIC_NAME is set
+func publishEvent(event string, data map[string]interface{}) {
+
+	startEventWorkers.Do(runEventWorkers)
+	for _, fn := range eventHandlers[event] {
+		copied := make(map[string]interface{}, len(data))
+		for k, v := range data {
+			copied[k] = v
+		}
+		select {
+		case eventQueue <- eventCall{event: event, fn: fn, data: copied}:
+		default:
+			log.Printf("event %s is dropped, %d events are queued for the handlers\n", event, eventQueueSize)
+		}
+	}
+
+	if topicName == "" || pubsubClient == nil {
+		return
+	}
+
+	data["event"] = event
+	data["rev"] = rev
+	if err := publishLog(pubsubClient, topicName, data); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,217 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// rateLimit is a token bucket, rate tokens are added per second up to burst
+type rateLimit struct {
+	rate  float64
+	burst int
+}
+
+// limits per route group, can be overridden by RATE_LIMIT_<GROUP> like RATE_LIMIT_API=20:40
+var defaultRateLimits = map[string]rateLimit{
+	"api":         {rate: 20, burst: 40},
+	"create_user": {rate: 1, burst: 5},
+}
+
+func loadRateLimit(group string) (rateLimit, error) {
+	limit := defaultRateLimits[group]
+	v := os.Getenv("RATE_LIMIT_" + strings.ToUpper(group))
+	if v == "" {
+		return limit, nil
+	}
+	rate, burst, found := strings.Cut(v, ":")
+	r, err := strconv.ParseFloat(rate, 64)
+	if err != nil || r <= 0 {
+		return limit, fmt.Errorf("RATE_LIMIT_%s: invalid rate %q", strings.ToUpper(group), rate)
+	}
+	b := int(math.Ceil(r))
+	if found {
+		if b, err = strconv.Atoi(burst); err != nil || b < 1 {
+			return limit, fmt.Errorf("RATE_LIMIT_%s: invalid burst %q", strings.ToUpper(group), burst)
+		}
+	}
+	return rateLimit{rate: r, burst: b}, nil
+}
+
+// takes a token from the bucket in Redis, the clock of Redis is used so that all instances agree
+var tokenBucketScript = redis.NewScript(`
+redis.replicate_commands()
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + (now - ts) / 1000 * rate)
+local allowed = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+end
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, tostring(tokens)}
+`)
+
+type localBucket struct {
+	tokens float64
+	ts     time.Time
+}
+
+// localBuckets is used while Redis is unavailable, limits are per instance then
+type localBuckets struct {
+	mu      sync.Mutex
+	buckets map[string]*localBucket
+}
+
+func (l *localBuckets) take(key string, limit rateLimit, now time.Time) (bool, float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.buckets) > 10000 {
+		// forget buckets that have been refilled already
+		for k, b := range l.buckets {
+			if now.Sub(b.ts).Seconds()*limit.rate >= float64(limit.burst) {
+				delete(l.buckets, k)
+			}
+		}
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &localBucket{tokens: float64(limit.burst), ts: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(limit.burst), b.tokens+now.Sub(b.ts).Seconds()*limit.rate)
+	b.ts = now
+	if b.tokens < 1 {
+		return false, b.tokens
+	}
+	b.tokens--
+	return true, b.tokens
+}
+
+type rateLimiter struct {
+	cache *redis.Client
+	local *localBuckets
+}
+
+// newRateLimiter works only in memory when cache is nil
+func newRateLimiter(cache *redis.Client) *rateLimiter {
+	return &rateLimiter{
+		cache: cache,
+		local: &localBuckets{buckets: map[string]*localBucket{}},
+	}
+}
+
+func (l *rateLimiter) take(key string, limit rateLimit) (bool, float64) {
+	if l.cache != nil {
+		res, err := tokenBucketScript.Run(l.cache, []string{key}, limit.rate, limit.burst).Result()
+		if err == nil {
+			values := res.([]interface{})
+			tokens, _ := strconv.ParseFloat(values[1].(string), 64)
+			return values[0].(int64) == 1, tokens
+		}
+		log.Println("rate limit falls back to memory:", err)
+	}
+	return l.local.take(key, limit, time.Now())
+}
+
+// how many proxies in front of the app append the address they received from to X-Forwarded-For.
+// It's 1 on Cloud Run, and 2 behind a Google Cloud load balancer. X-Forwarded-For is ignored with 0.
+var trustedProxyHops = func() int {
+	n, err := strconv.Atoi(os.Getenv("TRUSTED_PROXY_HOPS"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}()
+
+// clientKey identifies who sends the request, by the authenticated user, API key or IP address in this order.
+// header returns the first value of the header, of HTTP or gRPC metadata.
+func clientKey(header func(string) string, remoteAddr string) string {
+	if authHeaderName != "" {
+		if v := header(authHeaderName); v != "" {
+			sum := sha256.Sum256([]byte(v))
+			return "user:" + hex.EncodeToString(sum[:8])
+		}
+	}
+	if v := header("X-API-Key"); v != "" {
+		sum := sha256.Sum256([]byte(v))
+		return "key:" + hex.EncodeToString(sum[:8])
+	}
+	return "ip:" + clientIP(header("X-Forwarded-For"), remoteAddr)
+}
+
+// clientIP is the address the outermost trusted proxy received the request from, trustedProxyHops from the last
+// in X-Forwarded-For. The addresses before it are sent by the client, so they are not used.
+func clientIP(forwardedFor, remoteAddr string) string {
+	if trustedProxyHops > 0 {
+		hops := strings.Split(forwardedFor, ",")
+		if len(hops) >= trustedProxyHops {
+			if ip := strings.TrimSpace(hops[len(hops)-trustedProxyHops]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return host
+}
+
+// limit returns a middleware that allows limit per client for the route group
+func (l *rateLimiter) limit(group string, limit rateLimit) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := fmt.Sprintf("rateLimit_%s_%s", group, clientKey(r.Header.Get, r.RemoteAddr))
+			allowed, tokens := l.take(key, limit)
+
+			reset := math.Ceil((float64(limit.burst) - tokens) / limit.rate)
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.burst))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(int(math.Max(0, math.Floor(tokens)))))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(int(reset)))
+
+			if !allowed {
+				retryAfter := math.Ceil((1 - tokens) / limit.rate)
+				w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter)))
+				errorRender(w, r, http.StatusTooManyRequests, fmt.Errorf("too many requests, retry after %d seconds", int(retryAfter)))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
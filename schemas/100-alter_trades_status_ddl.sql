@@ -0,0 +1 @@
+ALTER TABLE trades ADD COLUMN status STRING(16)
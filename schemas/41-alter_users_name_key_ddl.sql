@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN name_key STRING(MAX) AS (LOWER(name)) STORED
@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN country STRING(2)
@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN platform STRING(16)
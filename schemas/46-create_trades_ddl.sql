@@ -0,0 +1,9 @@
+CREATE TABLE trades (
+  trade_id STRING(36) NOT NULL,
+  kind STRING(16) NOT NULL,
+  user_id STRING(36) NOT NULL,
+  item_ids ARRAY<STRING(36)> NOT NULL,
+  partner_id STRING(36) NOT NULL,
+  partner_item_ids ARRAY<STRING(36)> NOT NULL,
+  created_at TIMESTAMP NOT NULL,
+) PRIMARY KEY(trade_id)
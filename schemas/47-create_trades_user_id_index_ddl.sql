@@ -0,0 +1 @@
+CREATE INDEX trades_by_user_id ON trades (user_id, created_at DESC)
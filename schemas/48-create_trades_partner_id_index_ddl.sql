@@ -0,0 +1 @@
+CREATE INDEX trades_by_partner_id ON trades (partner_id, created_at DESC)
@@ -0,0 +1,7 @@
+CREATE TABLE user_balances (
+  user_id STRING(36) NOT NULL,
+  currency STRING(32) NOT NULL,
+  balance INT64 NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+) PRIMARY KEY(user_id, currency),
+  INTERLEAVE IN PARENT users ON DELETE CASCADE
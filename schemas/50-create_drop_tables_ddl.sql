@@ -0,0 +1,10 @@
+CREATE TABLE drop_tables (
+  drop_table_id STRING(36) NOT NULL,
+  name STRING(64) NOT NULL,
+  currency STRING(32) NOT NULL,
+  cost INT64 NOT NULL,
+  pity_threshold INT64,
+  pity_rarity STRING(16),
+  created_at TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+) PRIMARY KEY(drop_table_id)
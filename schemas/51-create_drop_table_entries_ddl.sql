@@ -0,0 +1,8 @@
+CREATE TABLE drop_table_entries (
+  drop_table_id STRING(36) NOT NULL,
+  item_id STRING(36) NOT NULL,
+  weight INT64 NOT NULL,
+  rarity STRING(16) NOT NULL,
+  CONSTRAINT FK_DropTableEntriesItemID FOREIGN KEY (item_id) REFERENCES items (item_id)
+) PRIMARY KEY(drop_table_id, item_id),
+  INTERLEAVE IN PARENT drop_tables ON DELETE CASCADE
@@ -0,0 +1,7 @@
+CREATE TABLE user_gacha_pity (
+  user_id STRING(36) NOT NULL,
+  drop_table_id STRING(36) NOT NULL,
+  counter INT64 NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+) PRIMARY KEY(user_id, drop_table_id),
+  INTERLEAVE IN PARENT users ON DELETE CASCADE
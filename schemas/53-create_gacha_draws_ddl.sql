@@ -0,0 +1,12 @@
+CREATE TABLE gacha_draws (
+  user_id STRING(36) NOT NULL,
+  draw_id STRING(36) NOT NULL,
+  drop_table_id STRING(36) NOT NULL,
+  table_hash STRING(64) NOT NULL,
+  seed INT64 NOT NULL,
+  pity_before INT64 NOT NULL,
+  cost INT64 NOT NULL,
+  results JSON NOT NULL,
+  created_at TIMESTAMP NOT NULL,
+) PRIMARY KEY(user_id, draw_id),
+  INTERLEAVE IN PARENT users ON DELETE CASCADE
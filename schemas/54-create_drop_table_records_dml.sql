@@ -0,0 +1,3 @@
+INSERT INTO drop_tables (drop_table_id, name, currency, cost, pity_threshold, pity_rarity, created_at, updated_at)
+  VALUES
+  ('0a4e9f7e-51b4-4f0a-9a43-4b8f2f1c5d01', 'standard', 'gem', 100, 10, 'SSR', '2022-10-10 00:00:00', '2022-10-10 00:00:00')
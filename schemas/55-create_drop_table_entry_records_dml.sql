@@ -0,0 +1,9 @@
+INSERT INTO drop_table_entries (drop_table_id, item_id, weight, rarity)
+  VALUES
+  ('0a4e9f7e-51b4-4f0a-9a43-4b8f2f1c5d01', '46f026ae-c6e9-4e41-82e5-240c7645a553', 300, 'R'),
+  ('0a4e9f7e-51b4-4f0a-9a43-4b8f2f1c5d01', '7470b7c2-c4ef-449e-bd6a-0471a7d258e8', 300, 'R'),
+  ('0a4e9f7e-51b4-4f0a-9a43-4b8f2f1c5d01', '6d027790-3e97-4e84-9131-98295b1ce2b3', 250, 'R'),
+  ('0a4e9f7e-51b4-4f0a-9a43-4b8f2f1c5d01', 'c70672a7-e7ff-486c-af9a-27725aa0618f', 60, 'SR'),
+  ('0a4e9f7e-51b4-4f0a-9a43-4b8f2f1c5d01', '423c4830-c39e-479f-87f5-cf44a34d2013', 60, 'SR'),
+  ('0a4e9f7e-51b4-4f0a-9a43-4b8f2f1c5d01', '702f2d95-2776-4519-8928-419e465854d6', 20, 'SSR'),
+  ('0a4e9f7e-51b4-4f0a-9a43-4b8f2f1c5d01', 'e1ddf0a3-9b1b-404f-b6b9-36b28b2fd817', 10, 'SSR')
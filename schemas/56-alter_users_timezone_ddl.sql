@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN timezone STRING(64)
@@ -0,0 +1,8 @@
+CREATE TABLE login_calendars (
+  season_id STRING(36) NOT NULL,
+  name STRING(64) NOT NULL,
+  starts_on DATE NOT NULL,
+  ends_on DATE NOT NULL,
+  created_at TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+) PRIMARY KEY(season_id)
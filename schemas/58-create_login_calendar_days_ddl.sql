@@ -0,0 +1,6 @@
+CREATE TABLE login_calendar_days (
+  season_id STRING(36) NOT NULL,
+  day INT64 NOT NULL,
+  item_ids ARRAY<STRING(36)> NOT NULL,
+) PRIMARY KEY(season_id, day),
+  INTERLEAVE IN PARENT login_calendars ON DELETE CASCADE
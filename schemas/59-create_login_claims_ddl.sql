@@ -0,0 +1,9 @@
+CREATE TABLE login_claims (
+  user_id STRING(36) NOT NULL,
+  season_id STRING(36) NOT NULL,
+  last_claim_date DATE NOT NULL,
+  streak INT64 NOT NULL,
+  total_days INT64 NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+) PRIMARY KEY(user_id, season_id),
+  INTERLEAVE IN PARENT users ON DELETE CASCADE
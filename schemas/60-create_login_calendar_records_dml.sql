@@ -0,0 +1,3 @@
+INSERT INTO login_calendars (season_id, name, starts_on, ends_on, created_at, updated_at)
+  VALUES
+  ('5d3c2b1a-8e7f-4a6b-9c0d-1e2f3a4b5c6d', 'default', '2022-10-01', '2099-12-31', '2022-10-10 00:00:00', '2022-10-10 00:00:00')
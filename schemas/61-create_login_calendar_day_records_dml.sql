@@ -0,0 +1,9 @@
+INSERT INTO login_calendar_days (season_id, day, item_ids)
+  VALUES
+  ('5d3c2b1a-8e7f-4a6b-9c0d-1e2f3a4b5c6d', 1, ['091665ba-7814-4bf9-89f1-ceb4c95bab39']),
+  ('5d3c2b1a-8e7f-4a6b-9c0d-1e2f3a4b5c6d', 2, ['bc0cf739-73d4-494b-8c25-ab478439d3cb']),
+  ('5d3c2b1a-8e7f-4a6b-9c0d-1e2f3a4b5c6d', 3, ['7bfb287f-32d5-4d7b-9d81-67093bf66203']),
+  ('5d3c2b1a-8e7f-4a6b-9c0d-1e2f3a4b5c6d', 4, ['df27cc71-4047-4497-bef6-cc6c282144c2']),
+  ('5d3c2b1a-8e7f-4a6b-9c0d-1e2f3a4b5c6d', 5, ['4dde5bac-4e82-40f9-9960-770e9581e83e']),
+  ('5d3c2b1a-8e7f-4a6b-9c0d-1e2f3a4b5c6d', 6, ['674da7fd-cf9e-4fd0-91af-8327c44e377a']),
+  ('5d3c2b1a-8e7f-4a6b-9c0d-1e2f3a4b5c6d', 7, ['8bea68e2-0077-4466-8197-35496a820900', '119e26d1-1070-4462-afbb-706f647fe288'])
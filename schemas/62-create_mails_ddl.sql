@@ -0,0 +1,12 @@
+CREATE TABLE mails (
+  user_id STRING(36) NOT NULL,
+  mail_id STRING(36) NOT NULL,
+  sender STRING(64) NOT NULL,
+  subject STRING(256) NOT NULL,
+  body STRING(MAX),
+  item_ids ARRAY<STRING(36)> NOT NULL,
+  expires_at TIMESTAMP NOT NULL,
+  claimed_at TIMESTAMP,
+  created_at TIMESTAMP NOT NULL,
+) PRIMARY KEY(user_id, mail_id),
+  INTERLEAVE IN PARENT users ON DELETE CASCADE
@@ -0,0 +1,7 @@
+CREATE TABLE leaderboards (
+  board_id STRING(64) NOT NULL,
+  name STRING(64) NOT NULL,
+  period STRING(16) NOT NULL,
+  created_at TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+) PRIMARY KEY(board_id)
@@ -0,0 +1,9 @@
+CREATE TABLE leaderboard_scores (
+  user_id STRING(36) NOT NULL,
+  board_id STRING(64) NOT NULL,
+  season STRING(16) NOT NULL,
+  score INT64 NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+  CONSTRAINT FK_LeaderboardScoresBoardID FOREIGN KEY (board_id) REFERENCES leaderboards (board_id)
+) PRIMARY KEY(user_id, board_id, season),
+  INTERLEAVE IN PARENT users ON DELETE CASCADE
@@ -0,0 +1 @@
+CREATE INDEX leaderboard_scores_by_board ON leaderboard_scores (board_id, season) STORING (score)
@@ -0,0 +1,4 @@
+INSERT INTO leaderboards (board_id, name, period, created_at, updated_at)
+  VALUES
+  ('high_score', 'High score', 'none', '2022-10-10 00:00:00', '2022-10-10 00:00:00'),
+  ('weekly_score', 'Weekly score', 'weekly', '2022-10-10 00:00:00', '2022-10-10 00:00:00')
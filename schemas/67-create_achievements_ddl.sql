@@ -0,0 +1,10 @@
+CREATE TABLE achievements (
+  achievement_id STRING(64) NOT NULL,
+  name STRING(64) NOT NULL,
+  criteria STRING(32) NOT NULL,
+  currency STRING(32),
+  target INT64 NOT NULL,
+  reward_item_ids ARRAY<STRING(36)> NOT NULL,
+  created_at TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+) PRIMARY KEY(achievement_id)
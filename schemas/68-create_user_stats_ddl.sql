@@ -0,0 +1,7 @@
+CREATE TABLE user_stats (
+  user_id STRING(36) NOT NULL,
+  stat STRING(64) NOT NULL,
+  value INT64 NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+) PRIMARY KEY(user_id, stat),
+  INTERLEAVE IN PARENT users ON DELETE CASCADE
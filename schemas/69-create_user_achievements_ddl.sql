@@ -0,0 +1,8 @@
+CREATE TABLE user_achievements (
+  user_id STRING(36) NOT NULL,
+  achievement_id STRING(64) NOT NULL,
+  progress INT64 NOT NULL,
+  completed_at TIMESTAMP,
+  updated_at TIMESTAMP NOT NULL,
+) PRIMARY KEY(user_id, achievement_id),
+  INTERLEAVE IN PARENT users ON DELETE CASCADE
@@ -0,0 +1,5 @@
+INSERT INTO achievements (achievement_id, name, criteria, currency, target, reward_item_ids, created_at, updated_at)
+  VALUES
+  ('own_10_items', 'Collector', 'items_owned', NULL, 10, ['9278d5b3-96ae-4b14-b262-2cfd5018c64c'], '2022-10-10 00:00:00', '2022-10-10 00:00:00'),
+  ('spend_1000_gems', 'Big spender', 'currency_spent', 'gem', 1000, ['2308bab0-2f20-45f9-874b-8ffec65a09ba'], '2022-10-10 00:00:00', '2022-10-10 00:00:00'),
+  ('login_7_days', 'Regular', 'login_days', NULL, 7, ['b3d5e4d8-48d9-42c0-99d7-c9c31e438319'], '2022-10-10 00:00:00', '2022-10-10 00:00:00')
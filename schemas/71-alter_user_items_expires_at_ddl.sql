@@ -0,0 +1 @@
+ALTER TABLE user_items ADD COLUMN expires_at TIMESTAMP
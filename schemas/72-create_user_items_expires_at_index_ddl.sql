@@ -0,0 +1 @@
+CREATE NULL_FILTERED INDEX user_items_by_expires_at ON user_items (expires_at)
@@ -0,0 +1,14 @@
+CREATE TABLE offers (
+  offer_id STRING(36) NOT NULL,
+  name STRING(64) NOT NULL,
+  item_ids ARRAY<STRING(36)> NOT NULL,
+  currency STRING(32) NOT NULL,
+  price INT64 NOT NULL,
+  starts_at TIMESTAMP,
+  ends_at TIMESTAMP,
+  per_user_limit INT64,
+  stock INT64,
+  sold INT64 NOT NULL,
+  created_at TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+) PRIMARY KEY(offer_id)
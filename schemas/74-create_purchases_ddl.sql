@@ -0,0 +1,9 @@
+CREATE TABLE purchases (
+  user_id STRING(36) NOT NULL,
+  purchase_id STRING(36) NOT NULL,
+  offer_id STRING(36) NOT NULL,
+  currency STRING(32) NOT NULL,
+  price INT64 NOT NULL,
+  created_at TIMESTAMP NOT NULL,
+) PRIMARY KEY(user_id, purchase_id),
+  INTERLEAVE IN PARENT users ON DELETE CASCADE
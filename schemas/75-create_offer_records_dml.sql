@@ -0,0 +1,4 @@
+INSERT INTO offers (offer_id, name, item_ids, currency, price, starts_at, ends_at, per_user_limit, stock, sold, created_at, updated_at)
+  VALUES
+  ('3f9a7c2e-6b1d-4e8f-a0c5-9d2b4e6f8a10', 'Starter bundle', ['a8570a87-0633-4fd8-85c7-92a58903c3bb', '0241e827-cc8d-4d62-b999-650e03e2ef72'], 'gem', 300, NULL, NULL, 1, NULL, 0, '2022-10-10 00:00:00', '2022-10-10 00:00:00'),
+  ('7c1e5a9b-2d4f-4b6a-8e0c-3f5a7b9d1c2e', 'Limited bundle', ['de96c577-4b43-4e0c-b032-859d2a72c85b'], 'gem', 500, '2022-10-10 00:00:00', '2099-12-31 00:00:00', NULL, 100, 0, '2022-10-10 00:00:00', '2022-10-10 00:00:00')
@@ -0,0 +1,6 @@
+CREATE TABLE currencies (
+  currency STRING(32) NOT NULL,
+  name STRING(64) NOT NULL,
+  kind STRING(16) NOT NULL,
+  created_at TIMESTAMP NOT NULL,
+) PRIMARY KEY(currency)
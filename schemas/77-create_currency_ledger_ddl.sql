@@ -0,0 +1,11 @@
+CREATE TABLE currency_ledger (
+  user_id STRING(36) NOT NULL,
+  entry_id STRING(36) NOT NULL,
+  currency STRING(32) NOT NULL,
+  amount INT64 NOT NULL,
+  balance INT64 NOT NULL,
+  reason STRING(64) NOT NULL,
+  correlation_id STRING(64) NOT NULL,
+  created_at TIMESTAMP NOT NULL,
+) PRIMARY KEY(user_id, entry_id),
+  INTERLEAVE IN PARENT users ON DELETE CASCADE
@@ -0,0 +1,5 @@
+INSERT INTO currencies (currency, name, kind, created_at)
+  VALUES
+  ('coin', 'Coin', 'soft', '2022-10-10 00:00:00'),
+  ('gem', 'Gem', 'premium', '2022-10-10 00:00:00'),
+  ('event_token', 'Event token', 'event', '2022-10-10 00:00:00')
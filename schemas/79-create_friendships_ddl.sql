@@ -0,0 +1,8 @@
+CREATE TABLE friendships (
+  user_id STRING(36) NOT NULL,
+  friend_id STRING(36) NOT NULL,
+  status STRING(16) NOT NULL,
+  created_at TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+) PRIMARY KEY(user_id, friend_id),
+  INTERLEAVE IN PARENT users ON DELETE CASCADE
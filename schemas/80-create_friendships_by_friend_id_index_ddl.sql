@@ -0,0 +1 @@
+CREATE INDEX friendships_by_friend_id ON friendships (friend_id)
@@ -0,0 +1,8 @@
+CREATE TABLE guilds (
+  guild_id STRING(36) NOT NULL,
+  name STRING(64) NOT NULL,
+  description STRING(256),
+  max_members INT64 NOT NULL,
+  created_at TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+) PRIMARY KEY(guild_id)
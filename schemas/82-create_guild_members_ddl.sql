@@ -0,0 +1,7 @@
+CREATE TABLE guild_members (
+  guild_id STRING(36) NOT NULL,
+  user_id STRING(36) NOT NULL,
+  role STRING(16) NOT NULL,
+  joined_at TIMESTAMP NOT NULL,
+) PRIMARY KEY(guild_id, user_id),
+  INTERLEAVE IN PARENT guilds ON DELETE CASCADE
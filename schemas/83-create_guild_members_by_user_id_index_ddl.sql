@@ -0,0 +1 @@
+CREATE UNIQUE INDEX guild_members_by_user_id ON guild_members (user_id)
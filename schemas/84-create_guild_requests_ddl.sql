@@ -0,0 +1,8 @@
+CREATE TABLE guild_requests (
+  guild_id STRING(36) NOT NULL,
+  user_id STRING(36) NOT NULL,
+  kind STRING(16) NOT NULL,
+  invited_by STRING(36),
+  created_at TIMESTAMP NOT NULL,
+) PRIMARY KEY(guild_id, user_id),
+  INTERLEAVE IN PARENT guilds ON DELETE CASCADE
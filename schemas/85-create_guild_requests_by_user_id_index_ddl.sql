@@ -0,0 +1 @@
+CREATE INDEX guild_requests_by_user_id ON guild_requests (user_id)
@@ -0,0 +1,7 @@
+CREATE TABLE guild_items (
+  guild_id STRING(36) NOT NULL,
+  item_id STRING(36) NOT NULL,
+  quantity INT64 NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+) PRIMARY KEY(guild_id, item_id),
+  INTERLEAVE IN PARENT guilds ON DELETE CASCADE
@@ -0,0 +1,11 @@
+CREATE TABLE user_bans (
+  user_id STRING(36) NOT NULL,
+  ban_id STRING(36) NOT NULL,
+  reason STRING(256) NOT NULL,
+  issued_by STRING(64) NOT NULL,
+  expires_at TIMESTAMP,
+  lifted_at TIMESTAMP,
+  lifted_by STRING(64),
+  created_at TIMESTAMP NOT NULL,
+) PRIMARY KEY(user_id, ban_id),
+  INTERLEAVE IN PARENT users ON DELETE CASCADE
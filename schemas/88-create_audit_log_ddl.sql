@@ -0,0 +1,12 @@
+CREATE TABLE audit_log (
+  audit_id STRING(36) NOT NULL,
+  actor STRING(128) NOT NULL,
+  action STRING(64) NOT NULL,
+  target_user_id STRING(36),
+  target STRING(256),
+  before JSON,
+  after JSON,
+  request_id STRING(128),
+  trace_id STRING(32),
+  created_at TIMESTAMP NOT NULL,
+) PRIMARY KEY(audit_id)
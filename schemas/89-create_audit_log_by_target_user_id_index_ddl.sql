@@ -0,0 +1 @@
+CREATE INDEX audit_log_by_target_user_id ON audit_log (target_user_id, created_at DESC)
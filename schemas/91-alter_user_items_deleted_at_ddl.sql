@@ -0,0 +1 @@
+ALTER TABLE user_items ADD COLUMN deleted_at TIMESTAMP
@@ -0,0 +1 @@
+CREATE NULL_FILTERED INDEX users_by_deleted_at ON users (deleted_at)
@@ -0,0 +1 @@
+CREATE NULL_FILTERED INDEX user_items_by_deleted_at ON user_items (deleted_at)
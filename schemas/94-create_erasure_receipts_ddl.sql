@@ -0,0 +1,10 @@
+CREATE TABLE erasure_receipts (
+  receipt_id STRING(36) NOT NULL,
+  subject_hash STRING(64) NOT NULL,
+  requested_by STRING(64) NOT NULL,
+  deleted_rows JSON NOT NULL,
+  anonymised_rows JSON NOT NULL,
+  redis_entries INT64,
+  created_at TIMESTAMP NOT NULL,
+  completed_at TIMESTAMP,
+) PRIMARY KEY(receipt_id)
@@ -0,0 +1 @@
+ALTER TABLE users ALTER COLUMN created_at SET OPTIONS (allow_commit_timestamp = true)
@@ -0,0 +1 @@
+ALTER TABLE user_items ALTER COLUMN created_at SET OPTIONS (allow_commit_timestamp = true)
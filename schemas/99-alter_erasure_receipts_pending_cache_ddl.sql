@@ -0,0 +1 @@
+ALTER TABLE erasure_receipts ADD COLUMN pending_cache JSON
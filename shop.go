@@ -0,0 +1,264 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+)
+
+type shopOperation interface {
+	offers(context.Context, io.Writer) ([]offer, error)
+	purchaseOffer(context.Context, io.Writer, string, string) (purchase, error)
+}
+
+var (
+	errOfferNotFound     = errors.New("offer not found")
+	errOfferNotAvailable = errors.New("offer is not on sale now")
+	errSoldOut           = errors.New("offer is sold out")
+	errPurchaseLimit     = errors.New("purchase limit of the offer is reached")
+)
+
+var offerColumns = []string{"offer_id", "name", "item_ids", "currency", "price", "starts_at", "ends_at", "per_user_limit", "stock", "sold"}
+
+type offer struct {
+	OfferID      string     `json:"offer_id"`
+	Name         string     `json:"name"`
+	ItemIDs      []string   `json:"item_ids"`
+	Currency     string     `json:"currency"`
+	Price        int64      `json:"price"`
+	StartsAt     *time.Time `json:"starts_at,omitempty"`
+	EndsAt       *time.Time `json:"ends_at,omitempty"`
+	PerUserLimit *int64     `json:"per_user_limit,omitempty"`
+	// remaining stock, no limit if it's nil
+	Stock *int64 `json:"stock,omitempty"`
+	Sold  int64  `json:"sold"`
+}
+
+func offerFromRow(row *spanner.Row) (offer, error) {
+	var o offer
+	var startsAt, endsAt spanner.NullTime
+	var perUserLimit, stock spanner.NullInt64
+	if err := row.Columns(&o.OfferID, &o.Name, &o.ItemIDs, &o.Currency, &o.Price, &startsAt, &endsAt, &perUserLimit, &stock, &o.Sold); err != nil {
+		return offer{}, err
+	}
+	if startsAt.Valid {
+		o.StartsAt = &startsAt.Time
+	}
+	if endsAt.Valid {
+		o.EndsAt = &endsAt.Time
+	}
+	if perUserLimit.Valid {
+		o.PerUserLimit = &perUserLimit.Int64
+	}
+	if stock.Valid {
+		o.Stock = &stock.Int64
+	}
+	return o, nil
+}
+
+// onSale is true while now is in the window, ends_at is exclusive
+func (o offer) onSale(now time.Time) bool {
+	if o.StartsAt != nil && now.Before(*o.StartsAt) {
+		return false
+	}
+	if o.EndsAt != nil && !now.Before(*o.EndsAt) {
+		return false
+	}
+	return true
+}
+
+type purchase struct {
+	PurchaseID string        `json:"purchase_id"`
+	OfferID    string        `json:"offer_id"`
+	Currency   string        `json:"currency"`
+	Price      int64         `json:"price"`
+	Balance    int64         `json:"balance"`
+	Results    []grantResult `json:"results"`
+	CreatedAt  time.Time     `json:"created_at"`
+}
+
+// list the offers on sale now
+func (d dbClient) offers(ctx context.Context, w io.Writer) ([]offer, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "offers")
+	defer span.End()
+
+	now := time.Now()
+	results := []offer{}
+	err := d.sc.Single().Read(ctx, "offers", spanner.AllKeys(), offerColumns).Do(func(row *spanner.Row) error {
+		o, err := offerFromRow(row)
+		if err != nil {
+			return err
+		}
+		if o.onSale(now) {
+			results = append(results, o)
+		}
+		return nil
+	})
+	return results, err
+}
+
+// buy the offer, the price is paid, the stock is decreased and the items are granted in a transaction
+func (d dbClient) purchaseOffer(ctx context.Context, w io.Writer, userID, offerID string) (purchase, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "purchaseOffer")
+	defer span.End()
+
+	p := purchase{PurchaseID: uuid.NewString(), OfferID: offerID}
+	_, err := d.sc.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		now := time.Now()
+
+		if err := userExistsInTxn(ctx, txn, userID); err != nil {
+			return err
+		}
+
+		row, err := txn.ReadRow(ctx, "offers", spanner.Key{offerID}, offerColumns)
+		if spanner.ErrCode(err) == codes.NotFound {
+			return errOfferNotFound
+		}
+		if err != nil {
+			return err
+		}
+		o, err := offerFromRow(row)
+		if err != nil {
+			return err
+		}
+
+		if !o.onSale(now) {
+			return errOfferNotAvailable
+		}
+		if o.Stock != nil && *o.Stock <= 0 {
+			return errSoldOut
+		}
+		if o.PerUserLimit != nil {
+			var bought int64
+			stmt := spanner.Statement{
+				SQL:    "SELECT COUNT(*) FROM purchases WHERE user_id = @userID AND offer_id = @offerID",
+				Params: map[string]interface{}{"userID": userID, "offerID": offerID},
+			}
+			err := txn.Query(ctx, stmt).Do(func(row *spanner.Row) error {
+				return row.Columns(&bought)
+			})
+			if err != nil {
+				return err
+			}
+			if bought >= *o.PerUserLimit {
+				return errPurchaseLimit
+			}
+		}
+
+		p.Currency, p.Price, p.CreatedAt = o.Currency, o.Price, now
+		if p.Balance, err = changeBalanceInTxn(ctx, txn, userID, o.Currency, -o.Price, reasonPurchase, p.PurchaseID); err != nil {
+			return err
+		}
+
+		grants := make([]grantParams, 0, len(o.ItemIDs))
+		for _, itemID := range o.ItemIDs {
+			grants = append(grants, grantParams{userID: userID, itemID: itemID})
+		}
+		if p.Results, err = grantItemsInTxn(ctx, txn, grants); err != nil {
+			return err
+		}
+		// the bundle is not sold partially
+		for _, r := range p.Results {
+			if r.Status != grantGranted {
+				return fmt.Errorf("%w: %s", errAlreadyOwned, r.ItemID)
+			}
+		}
+
+		var stock spanner.NullInt64
+		if o.Stock != nil {
+			stock = spanner.NullInt64{Int64: *o.Stock - 1, Valid: true}
+		}
+		return txn.BufferWrite([]*spanner.Mutation{
+			spanner.Update("offers",
+				[]string{"offer_id", "stock", "sold", "updated_at"},
+				[]interface{}{offerID, stock, o.Sold + 1, now},
+			),
+			spanner.Insert("purchases",
+				[]string{"user_id", "purchase_id", "offer_id", "currency", "price", "created_at"},
+				[]interface{}{userID, p.PurchaseID, offerID, o.Currency, o.Price, now},
+			),
+		})
+	})
+	if err != nil {
+		return purchase{}, err
+	}
+
+	d.invalidateUserItems(userID)
+	return p, nil
+}
+
+func (s Serving) getOffers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "getOffers.root")
+	span.SetAttributes(attribute.String("server", "getOffers"))
+	defer span.End()
+
+	results, err := s.Client.offers(ctx, w)
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+	render.JSON(w, r, map[string]interface{}{"offers": results})
+}
+
+func (s Serving) purchaseOffer(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "purchaseOffer.root")
+	span.SetAttributes(attribute.String("server", "purchaseOffer"))
+	defer span.End()
+
+	var body struct {
+		OfferID string `json:"offer_id"`
+	}
+	if err := render.DecodeJSON(r.Body, &body); err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	p, err := s.Client.purchaseOffer(ctx, w, userID, body.OfferID)
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+
+	publishEvent("offer.purchased", map[string]interface{}{
+		"id":          userID,
+		"purchase_id": p.PurchaseID,
+		"offer_id":    p.OfferID,
+		"currency":    p.Currency,
+		"price":       p.Price,
+	})
+
+	render.JSON(w, r, p)
+}
@@ -0,0 +1,374 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+)
+
+type softDeleteOperation interface {
+	restoreUser(context.Context, io.Writer, string) error
+	deleteUserItem(context.Context, io.Writer, string, string) error
+	restoreUserItem(context.Context, io.Writer, string, string) error
+}
+
+var (
+	errNotDeleted       = errors.New("it is not deleted")
+	errRetentionExpired = errors.New("the retention period of the deleted data has passed")
+)
+
+var (
+	// soft deleted users and items can be restored for this long, then they are purged
+	softDeleteRetention = func() time.Duration {
+		d, err := time.ParseDuration(os.Getenv("SOFT_DELETE_RETENTION"))
+		if err != nil || d <= 0 {
+			return 30 * 24 * time.Hour
+		}
+		return d
+	}()
+	// how often the purge runs, 0 disables it
+	purgeInterval = func() time.Duration {
+		d, err := time.ParseDuration(os.Getenv("PURGE_INTERVAL"))
+		if err != nil {
+			return time.Hour
+		}
+		return d
+	}()
+)
+
+// restorableInTxn checks deleted_at of a row to be restored
+func restorableInTxn(deletedAt spanner.NullTime, now time.Time) error {
+	if !deletedAt.Valid {
+		return errNotDeleted
+	}
+	if deletedAt.Time.Add(softDeleteRetention).Before(now) {
+		return errRetentionExpired
+	}
+	return nil
+}
+
+// restore the soft deleted user, friendships and guild memberships removed by the deletion are not restored
+func (d dbClient) restoreUser(ctx context.Context, w io.Writer, userID string) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "restoreUser")
+	defer span.End()
+
+	_, err := d.sc.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		row, err := txn.ReadRow(ctx, "users", spanner.Key{userID}, []string{"deleted_at"})
+		if spanner.ErrCode(err) == codes.NotFound {
+			return errUserNotFound
+		}
+		if err != nil {
+			return err
+		}
+		var deletedAt spanner.NullTime
+		if err := row.Columns(&deletedAt); err != nil {
+			return err
+		}
+		if err := restorableInTxn(deletedAt, time.Now()); err != nil {
+			return err
+		}
+		return txn.BufferWrite([]*spanner.Mutation{
+			spanner.Update("users", []string{"user_id", "deleted_at", "updated_at"}, []interface{}{userID, spanner.NullTime{}, spanner.CommitTimestamp}),
+			auditMutation(ctx, "user.restored", userID, "", map[string]interface{}{"deleted_at": deletedAt.Time}, nil),
+		})
+	})
+	if err == nil {
+		d.invalidateUser(userID)
+	}
+	return err
+}
+
+// soft delete an item of the user
+func (d dbClient) deleteUserItem(ctx context.Context, w io.Writer, userID, itemID string) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "deleteUserItem")
+	defer span.End()
+
+	_, err := d.sc.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		if err := userExistsInTxn(ctx, txn, userID); err != nil {
+			return err
+		}
+		row, err := txn.ReadRow(ctx, "user_items", spanner.Key{userID, itemID}, []string{"deleted_at"})
+		if spanner.ErrCode(err) == codes.NotFound {
+			return fmt.Errorf("%w: %s", errNotOwned, itemID)
+		}
+		if err != nil {
+			return err
+		}
+		var deletedAt spanner.NullTime
+		if err := row.Columns(&deletedAt); err != nil {
+			return err
+		}
+		if deletedAt.Valid {
+			return fmt.Errorf("%w: %s", errNotOwned, itemID)
+		}
+		return txn.BufferWrite([]*spanner.Mutation{
+			spanner.Update("user_items", []string{"user_id", "item_id", "deleted_at", "updated_at"}, []interface{}{userID, itemID, time.Now(), spanner.CommitTimestamp}),
+			auditMutation(ctx, "item.deleted", userID, itemID, nil, nil),
+		})
+	})
+	if err == nil {
+		d.invalidateUserItems(userID)
+	}
+	return err
+}
+
+// restore the soft deleted item of the user
+func (d dbClient) restoreUserItem(ctx context.Context, w io.Writer, userID, itemID string) error {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "restoreUserItem")
+	defer span.End()
+
+	_, err := d.sc.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		if err := userExistsInTxn(ctx, txn, userID); err != nil {
+			return err
+		}
+		row, err := txn.ReadRow(ctx, "user_items", spanner.Key{userID, itemID}, []string{"deleted_at"})
+		if spanner.ErrCode(err) == codes.NotFound {
+			return fmt.Errorf("%w: %s", errItemNotFound, itemID)
+		}
+		if err != nil {
+			return err
+		}
+		var deletedAt spanner.NullTime
+		if err := row.Columns(&deletedAt); err != nil {
+			return err
+		}
+		if err := restorableInTxn(deletedAt, time.Now()); err != nil {
+			return err
+		}
+		return txn.BufferWrite([]*spanner.Mutation{
+			spanner.Update("user_items", []string{"user_id", "item_id", "deleted_at", "updated_at"}, []interface{}{userID, itemID, spanner.NullTime{}, spanner.CommitTimestamp}),
+			auditMutation(ctx, "item.restored", userID, itemID, map[string]interface{}{"deleted_at": deletedAt.Time}, nil),
+		})
+	})
+	if err == nil {
+		d.invalidateUserItems(userID)
+	}
+	return err
+}
+
+type purgeResult struct {
+	Users int `json:"users"`
+	Items int `json:"items"`
+}
+
+// purgeDeleted hard deletes the users and the items soft deleted before the retention period.
+// The items of the purged users are deleted by INTERLEAVE ... ON DELETE CASCADE.
+// The cache is not touched, soft deleted rows are not cached except for admins' pages which expire soon.
+func (d dbClient) purgeDeleted(ctx context.Context, w io.Writer, now time.Time) (purgeResult, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "purgeDeleted")
+	defer span.End()
+
+	cutoff := now.Add(-softDeleteRetention)
+	var result purgeResult
+	var err error
+	result.Users, err = d.purgeRows(ctx, cutoff, "users", []string{"user_id"}, "user.purged")
+	if err != nil {
+		return result, err
+	}
+	result.Items, err = d.purgeRows(ctx, cutoff, "user_items", []string{"user_id", "item_id"}, "item.purged")
+	if err == nil {
+		fmt.Fprintf(w, "purged %d users and %d items deleted before %s\n", result.Users, result.Items, cutoff.Format(time.RFC3339))
+	}
+	return result, err
+}
+
+// purgeRows deletes the rows of the table soft deleted before cutoff in batches.
+// The first key column is the user_id, and the second one if any is the target of the audit log.
+func (d dbClient) purgeRows(ctx context.Context, cutoff time.Time, table string, keyColumns []string, action string) (int, error) {
+	// the key columns are all strings and come first in the row
+	keyOf := func(row *spanner.Row) (spanner.Key, error) {
+		key := make(spanner.Key, len(keyColumns))
+		for i := range keyColumns {
+			var v string
+			if err := row.Column(i, &v); err != nil {
+				return nil, err
+			}
+			key[i] = v
+		}
+		return key, nil
+	}
+
+	total := 0
+	for {
+		stmt := spanner.Statement{
+			SQL: fmt.Sprintf(`SELECT %s FROM %s@{FORCE_INDEX=%s_by_deleted_at} WHERE deleted_at <= @cutoff LIMIT @limit`,
+				strings.Join(keyColumns, ", "), table, table),
+			Params: map[string]interface{}{"cutoff": cutoff, "limit": int64(reapBatchSize)},
+		}
+		keys := []spanner.KeySet{}
+		err := d.sc.Single().Query(ctx, stmt).Do(func(row *spanner.Row) error {
+			key, err := keyOf(row)
+			keys = append(keys, key)
+			return err
+		})
+		if err != nil || len(keys) == 0 {
+			return total, err
+		}
+
+		var purged int
+		_, err = d.sc.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+			purged = 0
+			mutations := []*spanner.Mutation{}
+			// read again, the rows may have been restored
+			columns := append(append([]string{}, keyColumns...), "deleted_at")
+			err := txn.Read(ctx, table, spanner.KeySets(keys...), columns).Do(func(row *spanner.Row) error {
+				key, err := keyOf(row)
+				if err != nil {
+					return err
+				}
+				var deletedAt spanner.NullTime
+				if err := row.Column(len(keyColumns), &deletedAt); err != nil {
+					return err
+				}
+				if !deletedAt.Valid || deletedAt.Time.After(cutoff) {
+					return nil
+				}
+				target := ""
+				if len(key) > 1 {
+					target = key[1].(string)
+				}
+				purged++
+				mutations = append(mutations,
+					spanner.Delete(table, key),
+					auditMutation(ctx, action, key[0].(string), target, map[string]interface{}{"deleted_at": deletedAt.Time}, nil),
+				)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			return txn.BufferWrite(mutations)
+		})
+		if err != nil {
+			return total, err
+		}
+		total += purged
+		if len(keys) < reapBatchSize {
+			return total, nil
+		}
+	}
+}
+
+// startPurger purges expired soft deleted rows periodically until ctx is done
+func startPurger(ctx context.Context, d dbClient) {
+	if purgeInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(purgeInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := d.purgeDeleted(ctx, log.Writer(), time.Now()); err != nil {
+					log.Println("failed to purge deleted rows:", err)
+				}
+			}
+		}
+	}()
+}
+
+func (s Serving) restoreUser(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "restoreUser.root")
+	span.SetAttributes(attribute.String("server", "restoreUser"))
+	defer span.End()
+
+	if err := s.Client.restoreUser(ctx, w, userID); err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+	render.JSON(w, r, map[string]interface{}{"user_id": userID, "restored": true})
+}
+
+func (s Serving) deleteUserItem(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	itemID := chi.URLParam(r, "item_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "deleteUserItem.root")
+	span.SetAttributes(attribute.String("server", "deleteUserItem"))
+	defer span.End()
+
+	if err := s.Client.deleteUserItem(ctx, w, userID, itemID); err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+	render.JSON(w, r, map[string]interface{}{"user_id": userID, "item_id": itemID, "deleted": true})
+}
+
+func (s Serving) restoreUserItem(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	itemID := chi.URLParam(r, "item_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "restoreUserItem.root")
+	span.SetAttributes(attribute.String("server", "restoreUserItem"))
+	defer span.End()
+
+	if err := s.Client.restoreUserItem(ctx, w, userID, itemID); err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+	render.JSON(w, r, map[string]interface{}{"user_id": userID, "item_id": itemID, "restored": true})
+}
+
+// the user's items including soft deleted and expired ones, for admins
+func (s Serving) getUserItemsForAdmin(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "getUserItemsForAdmin.root")
+	span.SetAttributes(attribute.String("server", "getUserItemsForAdmin"))
+	defer span.End()
+
+	page, err := parsePageParams(r)
+	if err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	page.includeDeleted, page.includeExpired = true, true
+
+	results, err := s.Client.userItems(ctx, w, userID, page)
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+	render.JSON(w, r, results)
+}
@@ -0,0 +1,583 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+)
+
+// status of the trade, gifts are completed when they are sent.
+// The trades recorded before the status was added have no status, they are completed.
+const (
+	tradeStatusProposed  = "proposed"
+	tradeStatusCompleted = "completed"
+	tradeStatusDeclined  = "declined"
+	tradeStatusCancelled = "cancelled"
+)
+
+const (
+	tradeActionAccept  = "accept"
+	tradeActionDecline = "decline"
+	tradeActionCancel  = "cancel"
+)
+
+var (
+	errSelfTrade              = errors.New("can't trade with yourself")
+	errNotOwned               = errors.New("the user doesn't have the item")
+	errConcurrentModification = errors.New("the items were modified by another request, try again")
+	errTradeNotFound          = errors.New("trade not found")
+	errTradeNotProposed       = errors.New("the trade is not waiting for the partner")
+)
+
+// up to the number of the latest trades are listed
+var maxTrades = 100
+
+// tradeParams moves itemIDs from userID to partnerID, and partnerItemIDs the other way.
+// A gift is a trade without partnerItemIDs.
+type tradeParams struct {
+	userID         string
+	itemIDs        []string
+	partnerID      string
+	partnerItemIDs []string
+}
+
+func (t tradeParams) kind() string {
+	if len(t.partnerItemIDs) == 0 {
+		return "gift"
+	}
+	return "trade"
+}
+
+func (t tradeParams) validate() error {
+	invalid := validationError{}
+	if t.userID == t.partnerID {
+		return errSelfTrade
+	}
+	if len(t.itemIDs) == 0 {
+		invalid["item_ids"] = "at least one item is required"
+	}
+	for field, ids := range map[string][]string{"item_ids": t.itemIDs, "partner_item_ids": t.partnerItemIDs} {
+		seen := map[string]bool{}
+		for _, id := range ids {
+			if seen[id] {
+				invalid[field] = fmt.Sprintf("%s is duplicated", id)
+			}
+			seen[id] = true
+		}
+	}
+	if len(invalid) > 0 {
+		return invalid
+	}
+	return nil
+}
+
+// keys of user_items on both sides
+func (t tradeParams) keys() []spanner.KeySet {
+	keys := make([]spanner.KeySet, 0, len(t.itemIDs)+len(t.partnerItemIDs))
+	for _, id := range t.itemIDs {
+		keys = append(keys, spanner.Key{t.userID, id})
+	}
+	for _, id := range t.partnerItemIDs {
+		keys = append(keys, spanner.Key{t.partnerID, id})
+	}
+	return keys
+}
+
+type trade struct {
+	TradeID        string    `json:"trade_id"`
+	Kind           string    `json:"kind"`
+	Status         string    `json:"status"`
+	UserID         string    `json:"user_id"`
+	ItemIDs        []string  `json:"item_ids"`
+	PartnerID      string    `json:"partner_id"`
+	PartnerItemIDs []string  `json:"partner_item_ids"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+func (t trade) params() tradeParams {
+	return tradeParams{userID: t.UserID, itemIDs: t.ItemIDs, partnerID: t.PartnerID, partnerItemIDs: t.PartnerItemIDs}
+}
+
+type tradeChange struct {
+	// who does the action
+	userID  string
+	tradeID string
+	action  string
+}
+
+var tradeColumns = []string{"trade_id", "kind", "status", "user_id", "item_ids", "partner_id", "partner_item_ids", "created_at"}
+
+func tradeFromRow(row *spanner.Row) (trade, error) {
+	var t trade
+	var status spanner.NullString
+	if err := row.Columns(&t.TradeID, &t.Kind, &status, &t.UserID, &t.ItemIDs, &t.PartnerID, &t.PartnerItemIDs, &t.CreatedAt); err != nil {
+		return trade{}, err
+	}
+	t.Status = tradeStatusCompleted
+	if status.Valid {
+		t.Status = status.StringVal
+	}
+	return t, nil
+}
+
+// ownedItemsInTxn returns expires_at of the items by id, or errNotOwned if the user doesn't have any of them.
+// Expired or soft deleted items are not owned.
+func ownedItemsInTxn(ctx context.Context, txn spannerReader, userID string, itemIDs []string, now time.Time) (map[string]spanner.NullTime, error) {
+	keys := make([]spanner.KeySet, 0, len(itemIDs))
+	for _, id := range itemIDs {
+		keys = append(keys, spanner.Key{userID, id})
+	}
+	expiry := map[string]spanner.NullTime{}
+	err := txn.Read(ctx, "user_items", spanner.KeySets(keys...), []string{"item_id", "expires_at", "deleted_at"}).Do(func(row *spanner.Row) error {
+		var id string
+		var expiresAt, deletedAt spanner.NullTime
+		if err := row.Columns(&id, &expiresAt, &deletedAt); err != nil {
+			return err
+		}
+		if !deletedAt.Valid && (!expiresAt.Valid || expiresAt.Time.After(now)) {
+			expiry[id] = expiresAt
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(expiry) != len(itemIDs) {
+		return nil, errNotOwned
+	}
+	return expiry, nil
+}
+
+// moveItemsInTxn deletes the rows of from, and inserts them for to
+func moveItemsInTxn(ctx context.Context, txn *spanner.ReadWriteTransaction, from, to string, itemIDs []string, now time.Time) error {
+	if len(itemIDs) == 0 {
+		return nil
+	}
+
+	// expiry moves with the item
+	expiry, err := ownedItemsInTxn(ctx, txn, from, itemIDs, now)
+	if err != nil {
+		return err
+	}
+
+	toKeys := make([]spanner.KeySet, 0, len(itemIDs))
+	for _, id := range itemIDs {
+		toKeys = append(toKeys, spanner.Key{to, id})
+	}
+	err = txn.Read(ctx, "user_items", spanner.KeySets(toKeys...), []string{"expires_at", "deleted_at"}).Do(func(row *spanner.Row) error {
+		var expiresAt, deletedAt spanner.NullTime
+		if err := row.Columns(&expiresAt, &deletedAt); err != nil {
+			return err
+		}
+		// an expired or soft deleted one is replaced
+		if expiresAt.Valid && !expiresAt.Time.After(now) || deletedAt.Valid {
+			return nil
+		}
+		return errAlreadyOwned
+	})
+	if err != nil {
+		return err
+	}
+
+	mutations := make([]*spanner.Mutation, 0, len(itemIDs)*2)
+	for _, id := range itemIDs {
+		mutations = append(mutations,
+			spanner.Delete("user_items", spanner.Key{from, id}),
+			spanner.InsertOrUpdate("user_items",
+				[]string{"user_id", "item_id", "expires_at", "deleted_at", "created_at", "updated_at"},
+				[]interface{}{to, id, expiry[id], spanner.NullTime{}, spanner.CommitTimestamp, spanner.CommitTimestamp},
+			),
+		)
+	}
+	mutations = append(mutations, auditMutation(ctx, "items.moved", from, to, nil, map[string]interface{}{"to": to, "item_ids": itemIDs}))
+	return txn.BufferWrite(mutations)
+}
+
+// itemVersions reads updated_at of the rows as their versions
+func itemVersions(ctx context.Context, txn spannerReader, keys []spanner.KeySet) (map[userItemKey]spanner.NullTime, error) {
+	versions := map[userItemKey]spanner.NullTime{}
+	err := txn.Read(ctx, "user_items", spanner.KeySets(keys...), []string{"user_id", "item_id", "updated_at"}).Do(func(row *spanner.Row) error {
+		var k userItemKey
+		var updatedAt spanner.NullTime
+		if err := row.Columns(&k.userID, &k.itemID, &updatedAt); err != nil {
+			return err
+		}
+		versions[k] = updatedAt
+		return nil
+	})
+	return versions, err
+}
+
+// unchangedInTxn returns errConcurrentModification if a row read before the transaction was changed or deleted since.
+// Spanner retries the transaction aborted by a conflict, and the retry finds the change with this.
+func unchangedInTxn(ctx context.Context, txn *spanner.ReadWriteTransaction, keys []spanner.KeySet, before map[userItemKey]spanner.NullTime) error {
+	current, err := itemVersions(ctx, txn, keys)
+	if err != nil {
+		return err
+	}
+	for k, v := range before {
+		if c, ok := current[k]; !ok || c.Valid != v.Valid || !c.Time.Equal(v.Time) {
+			return errConcurrentModification
+		}
+	}
+	return nil
+}
+
+// partiesInTxn checks that both users of the trade exist and they are not banned
+func partiesInTxn(ctx context.Context, txn *spanner.ReadWriteTransaction, t tradeParams) error {
+	users := map[string]bool{t.userID: false, t.partnerID: false}
+	if err := markExisting(ctx, txn, "SELECT user_id FROM users WHERE user_id IN UNNEST(@ids) AND deleted_at IS NULL", users); err != nil {
+		return err
+	}
+	for _, exists := range users {
+		if !exists {
+			return errUserNotFound
+		}
+	}
+	// banned users can't pass items to other accounts or receive them
+	return notBannedInTxn(ctx, txn, t.userID, t.partnerID)
+}
+
+// exchangeItems moves the items of the trade in a transaction, record checks and writes the trade in it
+func (d dbClient) exchangeItems(ctx context.Context, t tradeParams, record func(context.Context, *spanner.ReadWriteTransaction) error) error {
+	keys := t.keys()
+	// the items as the request found them, the transaction fails if they are changed by another one
+	before, err := itemVersions(ctx, d.sc.Single(), keys)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.sc.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		if err := record(ctx, txn); err != nil {
+			return err
+		}
+		if err := unchangedInTxn(ctx, txn, keys, before); err != nil {
+			return err
+		}
+		if err := partiesInTxn(ctx, txn, t); err != nil {
+			return err
+		}
+		now := time.Now()
+		if err := moveItemsInTxn(ctx, txn, t.userID, t.partnerID, t.itemIDs, now); err != nil {
+			return err
+		}
+		return moveItemsInTxn(ctx, txn, t.partnerID, t.userID, t.partnerItemIDs, now)
+	})
+	if err != nil {
+		return err
+	}
+
+	d.invalidateUserItems(t.userID)
+	d.invalidateUserItems(t.partnerID)
+	return nil
+}
+
+// send a gift, or propose a trade to the partner.
+// A gift is moved at once, and the items of a trade are moved when the partner accepts it.
+func (d dbClient) tradeItems(ctx context.Context, w io.Writer, p tradeParams) (trade, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "tradeItems")
+	defer span.End()
+
+	t := trade{
+		TradeID:        uuid.NewString(),
+		Kind:           p.kind(),
+		Status:         tradeStatusProposed,
+		UserID:         p.userID,
+		ItemIDs:        p.itemIDs,
+		PartnerID:      p.partnerID,
+		PartnerItemIDs: p.partnerItemIDs,
+		CreatedAt:      time.Now(),
+	}
+	if t.PartnerItemIDs == nil {
+		t.PartnerItemIDs = []string{}
+	}
+	insert := func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		return txn.BufferWrite([]*spanner.Mutation{
+			spanner.Insert("trades", tradeColumns,
+				[]interface{}{t.TradeID, t.Kind, t.Status, t.UserID, t.ItemIDs, t.PartnerID, t.PartnerItemIDs, t.CreatedAt},
+			),
+		})
+	}
+
+	if t.Kind == "gift" {
+		t.Status = tradeStatusCompleted
+		if err := d.exchangeItems(ctx, p, insert); err != nil {
+			return trade{}, err
+		}
+		return t, nil
+	}
+
+	// the items are checked, but they stay until the partner accepts
+	_, err := d.sc.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		if err := partiesInTxn(ctx, txn, p); err != nil {
+			return err
+		}
+		if _, err := ownedItemsInTxn(ctx, txn, p.userID, p.itemIDs, t.CreatedAt); err != nil {
+			return err
+		}
+		if _, err := ownedItemsInTxn(ctx, txn, p.partnerID, p.partnerItemIDs, t.CreatedAt); err != nil {
+			return err
+		}
+		return insert(ctx, txn)
+	})
+	if err != nil {
+		return trade{}, err
+	}
+	return t, nil
+}
+
+// accept, decline or cancel the proposed trade. The partner accepts or declines it, and the user who proposed it cancels it.
+// The items are moved when it's accepted, if both users still have them.
+func (d dbClient) changeTrade(ctx context.Context, w io.Writer, c tradeChange) (trade, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "changeTrade")
+	defer span.End()
+
+	statuses := map[string]string{tradeActionAccept: tradeStatusCompleted, tradeActionDecline: tradeStatusDeclined, tradeActionCancel: tradeStatusCancelled}
+	status, ok := statuses[c.action]
+	if !ok {
+		return trade{}, validationError{"action": "unknown action " + c.action}
+	}
+
+	row, err := d.sc.Single().ReadRow(ctx, "trades", spanner.Key{c.tradeID}, tradeColumns)
+	if spanner.ErrCode(err) == codes.NotFound {
+		return trade{}, errTradeNotFound
+	}
+	if err != nil {
+		return trade{}, err
+	}
+	t, err := tradeFromRow(row)
+	if err != nil {
+		return trade{}, err
+	}
+	actor := t.PartnerID
+	if c.action == tradeActionCancel {
+		actor = t.UserID
+	}
+	if c.userID != actor {
+		return trade{}, errTradeNotFound
+	}
+	if t.Status != tradeStatusProposed {
+		return trade{}, errTradeNotProposed
+	}
+
+	update := func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		row, err := txn.ReadRow(ctx, "trades", spanner.Key{t.TradeID}, []string{"status"})
+		if err != nil {
+			return err
+		}
+		var current spanner.NullString
+		if err := row.Columns(&current); err != nil {
+			return err
+		}
+		if current.StringVal != tradeStatusProposed {
+			return errTradeNotProposed
+		}
+		return txn.BufferWrite([]*spanner.Mutation{
+			spanner.Update("trades", []string{"trade_id", "status"}, []interface{}{t.TradeID, status}),
+		})
+	}
+	if c.action == tradeActionAccept {
+		err = d.exchangeItems(ctx, t.params(), update)
+	} else {
+		_, err = d.sc.ReadWriteTransaction(ctx, update)
+	}
+	if err != nil {
+		return trade{}, err
+	}
+	t.Status = status
+	return t, nil
+}
+
+// list the latest trades the user proposed or was proposed, all statuses if status is empty
+func (d dbClient) trades(ctx context.Context, w io.Writer, userID, status string) ([]trade, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "trades")
+	defer span.End()
+
+	txn := d.sc.ReadOnlyTransaction()
+	defer txn.Close()
+
+	if err := userExistsInTxn(ctx, txn, userID); err != nil {
+		return nil, err
+	}
+
+	columns := strings.Join(tradeColumns, ", ")
+	stmt := spanner.Statement{
+		SQL: fmt.Sprintf(`SELECT %[1]s FROM (
+		    SELECT %[1]s FROM trades@{FORCE_INDEX=trades_by_user_id} WHERE user_id = @userID
+		    UNION ALL
+		    SELECT %[1]s FROM trades@{FORCE_INDEX=trades_by_partner_id} WHERE partner_id = @userID
+		  ) WHERE @status = '' OR IFNULL(status, @completed) = @status
+		  ORDER BY created_at DESC LIMIT @limit`, columns),
+		Params: map[string]interface{}{"userID": userID, "status": status, "completed": tradeStatusCompleted, "limit": int64(maxTrades)},
+	}
+	results := []trade{}
+	err := txn.Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		t, err := tradeFromRow(row)
+		if err != nil {
+			return err
+		}
+		results = append(results, t)
+		return nil
+	})
+	return results, err
+}
+
+func (s Serving) sendGift(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "sendGift.root")
+	span.SetAttributes(attribute.String("server", "sendGift"))
+	defer span.End()
+
+	var body struct {
+		ToUserID string `json:"to_user_id"`
+		ItemID   string `json:"item_id"`
+	}
+	if err := render.DecodeJSON(r.Body, &body); err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	s.trade(ctx, w, r, tradeParams{
+		userID:    userID,
+		itemIDs:   []string{body.ItemID},
+		partnerID: body.ToUserID,
+	})
+}
+
+func (s Serving) tradeItems(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "tradeItems.root")
+	span.SetAttributes(attribute.String("server", "tradeItems"))
+	defer span.End()
+
+	var body struct {
+		UserID         string   `json:"user_id"`
+		ItemIDs        []string `json:"item_ids"`
+		PartnerID      string   `json:"partner_id"`
+		PartnerItemIDs []string `json:"partner_item_ids"`
+	}
+	if err := render.DecodeJSON(r.Body, &body); err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if len(body.PartnerItemIDs) == 0 {
+		errorRender(w, r, http.StatusBadRequest, validationError{"partner_item_ids": "at least one item is required, send a gift instead"})
+		return
+	}
+
+	s.trade(ctx, w, r, tradeParams{
+		userID:         body.UserID,
+		itemIDs:        body.ItemIDs,
+		partnerID:      body.PartnerID,
+		partnerItemIDs: body.PartnerItemIDs,
+	})
+}
+
+func (s Serving) trade(ctx context.Context, w http.ResponseWriter, r *http.Request, p tradeParams) {
+	if err := p.validate(); err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+
+	t, err := s.Client.tradeItems(ctx, w, p)
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+
+	publishTrade(t)
+	render.JSON(w, r, t)
+}
+
+// items.traded is published when the items are moved, trade.<status> otherwise
+func publishTrade(t trade) {
+	topic := "items.traded"
+	if t.Status != tradeStatusCompleted {
+		topic = "trade." + t.Status
+	}
+	publishEvent(topic, map[string]interface{}{
+		"trade_id":         t.TradeID,
+		"kind":             t.Kind,
+		"id":               t.UserID,
+		"items":            t.ItemIDs,
+		"partner_id":       t.PartnerID,
+		"partner_item_ids": t.PartnerItemIDs,
+	})
+}
+
+func (s Serving) getTrades(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "getTrades.root")
+	span.SetAttributes(attribute.String("server", "getTrades"))
+	defer span.End()
+
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", tradeStatusProposed, tradeStatusCompleted, tradeStatusDeclined, tradeStatusCancelled:
+	default:
+		errorRender(w, r, http.StatusBadRequest, fmt.Errorf("unknown status %q", status))
+		return
+	}
+
+	results, err := s.Client.trades(ctx, w, userID, status)
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+	render.JSON(w, r, map[string]interface{}{"trades": results})
+}
+
+func (s Serving) changeTrade(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	tradeID := chi.URLParam(r, "trade_id")
+	action := chi.URLParam(r, "action")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "changeTrade.root")
+	span.SetAttributes(attribute.String("server", "changeTrade"))
+	defer span.End()
+
+	t, err := s.Client.changeTrade(ctx, w, tradeChange{userID: userID, tradeID: tradeID, action: action})
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+
+	publishTrade(t)
+	render.JSON(w, r, t)
+}
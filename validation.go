@@ -0,0 +1,105 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/text/language"
+)
+
+// validationError holds a message per invalid field of a request body
+type validationError map[string]string
+
+func (v validationError) Error() string {
+	fields := make([]string, 0, len(v))
+	for field := range v {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	messages := make([]string, 0, len(v))
+	for _, field := range fields {
+		messages = append(messages, fmt.Sprintf("%s: %s", field, v[field]))
+	}
+	return "invalid request: " + strings.Join(messages, ", ")
+}
+
+var platforms = map[string]bool{
+	"ios":     true,
+	"android": true,
+	"pc":      true,
+	"console": true,
+	"web":     true,
+}
+
+type createUserRequest struct {
+	Name     string `json:"name"`
+	Locale   string `json:"locale"`
+	Country  string `json:"country"`
+	Platform string `json:"platform"`
+	Timezone string `json:"timezone"`
+}
+
+// validate checks every field and normalizes locale, country and platform
+func (c *createUserRequest) validate() error {
+	invalid := validationError{}
+
+	if c.Name == "" {
+		invalid["name"] = "is required"
+	} else if err := userNamePolicy.validate(c.Name); err != nil {
+		invalid["name"] = err.Error()
+	}
+
+	if c.Locale != "" {
+		tag, err := language.Parse(c.Locale)
+		if err != nil {
+			invalid["locale"] = "must be a BCP 47 language tag, like en-US"
+		} else {
+			c.Locale = tag.String()
+		}
+	}
+
+	if c.Country != "" {
+		region, err := language.ParseRegion(c.Country)
+		if err != nil || len(c.Country) != 2 || !region.IsCountry() {
+			invalid["country"] = "must be an ISO 3166-1 alpha-2 country code, like JP"
+		} else {
+			c.Country = region.String()
+		}
+	}
+
+	if c.Platform != "" {
+		c.Platform = strings.ToLower(c.Platform)
+		if !platforms[c.Platform] {
+			invalid["platform"] = "must be one of android, console, ios, pc or web"
+		}
+	}
+
+	if c.Timezone != "" {
+		if _, err := time.LoadLocation(c.Timezone); err != nil || c.Timezone == "Local" {
+			invalid["timezone"] = "must be an IANA time zone, like Asia/Tokyo"
+		}
+	}
+
+	if len(invalid) > 0 {
+		return invalid
+	}
+	return nil
+}
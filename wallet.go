@@ -0,0 +1,435 @@
+/*
+Copyright 2023 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+)
+
+type walletOperation interface {
+	currencies(context.Context, io.Writer) ([]currency, error)
+	balances(context.Context, io.Writer, string) (map[string]int64, error)
+	creditBalance(context.Context, io.Writer, string, string, int64, string, string) (int64, error)
+	ledger(context.Context, io.Writer, string, string, int) ([]ledgerEntry, error)
+	reconcileBalances(context.Context, io.Writer) ([]balanceMismatch, error)
+}
+
+var (
+	errInsufficientBalance = errors.New("insufficient balance")
+	errCurrencyNotFound    = errors.New("currency not found")
+)
+
+// reason codes recorded in the ledger
+const (
+	reasonCredit    = "credit"
+	reasonGachaDraw = "gacha_draw"
+	reasonPurchase  = "purchase"
+)
+
+const (
+	defaultLedgerLimit = 50
+	maxLedgerLimit     = 500
+)
+
+var reasonPattern = regexp.MustCompile(`^[a-z0-9_]{1,64}$`)
+
+type currency struct {
+	Currency string `json:"currency"`
+	Name     string `json:"name"`
+	// soft, premium or event
+	Kind string `json:"kind"`
+}
+
+type ledgerEntry struct {
+	EntryID       string    `json:"entry_id"`
+	Currency      string    `json:"currency"`
+	Amount        int64     `json:"amount"`
+	Balance       int64     `json:"balance"`
+	Reason        string    `json:"reason"`
+	CorrelationID string    `json:"correlation_id"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type balanceMismatch struct {
+	UserID   string `json:"user_id"`
+	Currency string `json:"currency"`
+	Balance  int64  `json:"balance"`
+	Ledger   int64  `json:"ledger"`
+}
+
+// balanceInTxn returns 0 when the user has never had the currency
+func balanceInTxn(ctx context.Context, txn *spanner.ReadWriteTransaction, userID, currency string) (int64, error) {
+	row, err := txn.ReadRow(ctx, "user_balances", spanner.Key{userID, currency}, []string{"balance"})
+	if spanner.ErrCode(err) == codes.NotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var balance int64
+	err = row.Columns(&balance)
+	return balance, err
+}
+
+// changeBalanceInTxn adds amount to the balance, negative amount is a debit.
+// Every change is recorded in the ledger with the reason and the id of what caused it, like a draw or a purchase.
+// It returns the new balance, or errInsufficientBalance without any change.
+func changeBalanceInTxn(ctx context.Context, txn *spanner.ReadWriteTransaction, userID, currency string, amount int64, reason, correlationID string) (int64, error) {
+	if _, err := txn.ReadRow(ctx, "currencies", spanner.Key{currency}, []string{"currency"}); err != nil {
+		if spanner.ErrCode(err) == codes.NotFound {
+			return 0, fmt.Errorf("%w: %s", errCurrencyNotFound, currency)
+		}
+		return 0, err
+	}
+	balance, err := balanceInTxn(ctx, txn, userID, currency)
+	if err != nil {
+		return 0, err
+	}
+	if balance+amount < 0 {
+		return balance, errInsufficientBalance
+	}
+	before := balance
+	balance += amount
+	now := time.Now()
+	// the ledger is only inserted, entries are never updated
+	err = txn.BufferWrite([]*spanner.Mutation{
+		spanner.InsertOrUpdate("user_balances",
+			[]string{"user_id", "currency", "balance", "updated_at"},
+			[]interface{}{userID, currency, balance, now},
+		),
+		spanner.Insert("currency_ledger",
+			[]string{"user_id", "entry_id", "currency", "amount", "balance", "reason", "correlation_id", "created_at"},
+			[]interface{}{userID, uuid.NewString(), currency, amount, balance, reason, correlationID, now},
+		),
+		auditMutation(ctx, "balance.changed", userID, currency,
+			map[string]interface{}{"balance": before},
+			map[string]interface{}{"balance": balance, "reason": reason, "correlation_id": correlationID},
+		),
+	})
+	if err != nil || amount >= 0 {
+		return balance, err
+	}
+	return balance, addStatInTxn(ctx, txn, userID, spentStat(currency), -amount)
+}
+
+func spentStat(currency string) string {
+	return "currency_spent:" + currency
+}
+
+// statInTxn returns 0 when the stat has never been counted
+func statInTxn(ctx context.Context, txn *spanner.ReadWriteTransaction, userID, stat string) (int64, error) {
+	row, err := txn.ReadRow(ctx, "user_stats", spanner.Key{userID, stat}, []string{"value"})
+	if spanner.ErrCode(err) == codes.NotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var value int64
+	err = row.Columns(&value)
+	return value, err
+}
+
+// addStatInTxn counts up a stat of the user such as currency spent, which can't be derived from other tables
+func addStatInTxn(ctx context.Context, txn *spanner.ReadWriteTransaction, userID, stat string, delta int64) error {
+	value, err := statInTxn(ctx, txn, userID, stat)
+	if err != nil {
+		return err
+	}
+	return txn.BufferWrite([]*spanner.Mutation{
+		spanner.InsertOrUpdate("user_stats",
+			[]string{"user_id", "stat", "value", "updated_at"},
+			[]interface{}{userID, stat, value + delta, time.Now()},
+		),
+	})
+}
+
+// get the definitions of all currencies
+func (d dbClient) currencies(ctx context.Context, w io.Writer) ([]currency, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "currencies")
+	defer span.End()
+
+	results := []currency{}
+	stmt := spanner.Statement{SQL: "SELECT currency, name, kind FROM currencies ORDER BY currency"}
+	err := d.sc.Single().Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		var c currency
+		if err := row.Columns(&c.Currency, &c.Name, &c.Kind); err != nil {
+			return err
+		}
+		results = append(results, c)
+		return nil
+	})
+	return results, err
+}
+
+// get all balances of the user
+func (d dbClient) balances(ctx context.Context, w io.Writer, userID string) (map[string]int64, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "balances")
+	defer span.End()
+
+	results := map[string]int64{}
+	iter := d.sc.Single().Read(ctx, "user_balances", spanner.Key{userID}.AsPrefix(), []string{"currency", "balance"})
+	err := iter.Do(func(row *spanner.Row) error {
+		var currency string
+		var balance int64
+		if err := row.Columns(&currency, &balance); err != nil {
+			return err
+		}
+		results[currency] = balance
+		return nil
+	})
+	return results, err
+}
+
+// add amount of currency to the user
+func (d dbClient) creditBalance(ctx context.Context, w io.Writer, userID, currency string, amount int64, reason, correlationID string) (int64, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "creditBalance")
+	defer span.End()
+
+	var balance int64
+	_, err := d.sc.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		if err := userExistsInTxn(ctx, txn, userID); err != nil {
+			return err
+		}
+		var err error
+		balance, err = changeBalanceInTxn(ctx, txn, userID, currency, amount, reason, correlationID)
+		return err
+	})
+	return balance, err
+}
+
+// get the latest ledger entries of the user, all currencies if currency is empty
+func (d dbClient) ledger(ctx context.Context, w io.Writer, userID, currency string, limit int) ([]ledgerEntry, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "ledger")
+	defer span.End()
+
+	sql := `SELECT entry_id, currency, amount, balance, reason, correlation_id, created_at FROM currency_ledger
+	  WHERE user_id = @userID`
+	if currency != "" {
+		sql += " AND currency = @currency"
+	}
+	sql += " ORDER BY created_at DESC, entry_id LIMIT @limit"
+	stmt := spanner.Statement{
+		SQL:    sql,
+		Params: map[string]interface{}{"userID": userID, "currency": currency, "limit": int64(limit)},
+	}
+
+	results := []ledgerEntry{}
+	err := d.sc.Single().Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		var e ledgerEntry
+		if err := row.Columns(&e.EntryID, &e.Currency, &e.Amount, &e.Balance, &e.Reason, &e.CorrelationID, &e.CreatedAt); err != nil {
+			return err
+		}
+		results = append(results, e)
+		return nil
+	})
+	return results, err
+}
+
+// reconcileBalances recomputes every balance from the ledger, and writes the ones that don't match to w.
+// Both are read in a read-only transaction, so that they are compared at the same timestamp.
+func (d dbClient) reconcileBalances(ctx context.Context, w io.Writer) ([]balanceMismatch, error) {
+
+	ctx, span := otel.Tracer("main").Start(ctx, "reconcileBalances")
+	defer span.End()
+
+	txn := d.sc.ReadOnlyTransaction()
+	defer txn.Close()
+
+	type balanceKey struct{ userID, currency string }
+	balances := map[balanceKey]int64{}
+	err := txn.Read(ctx, "user_balances", spanner.AllKeys(), []string{"user_id", "currency", "balance"}).Do(func(row *spanner.Row) error {
+		var k balanceKey
+		var balance int64
+		if err := row.Columns(&k.userID, &k.currency, &balance); err != nil {
+			return err
+		}
+		balances[k] = balance
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ledger := map[balanceKey]int64{}
+	stmt := spanner.Statement{SQL: "SELECT user_id, currency, SUM(amount) FROM currency_ledger GROUP BY user_id, currency"}
+	err = txn.Query(ctx, stmt).Do(func(row *spanner.Row) error {
+		var k balanceKey
+		var sum int64
+		if err := row.Columns(&k.userID, &k.currency, &sum); err != nil {
+			return err
+		}
+		ledger[k] = sum
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	results := []balanceMismatch{}
+	check := func(k balanceKey) {
+		if balances[k] != ledger[k] {
+			results = append(results, balanceMismatch{UserID: k.userID, Currency: k.currency, Balance: balances[k], Ledger: ledger[k]})
+		}
+	}
+	for k := range balances {
+		check(k)
+	}
+	for k := range ledger {
+		if _, ok := balances[k]; !ok {
+			check(k)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].UserID != results[j].UserID {
+			return results[i].UserID < results[j].UserID
+		}
+		return results[i].Currency < results[j].Currency
+	})
+
+	for _, m := range results {
+		fmt.Fprintf(w, "%s\t%s\tbalance=%d\tledger=%d\n", m.UserID, m.Currency, m.Balance, m.Ledger)
+	}
+	fmt.Fprintf(w, "checked %d balances, %d mismatches\n", len(balances), len(results))
+	return results, nil
+}
+
+func (s Serving) getCurrencies(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "getCurrencies.root")
+	span.SetAttributes(attribute.String("server", "getCurrencies"))
+	defer span.End()
+
+	results, err := s.Client.currencies(ctx, w)
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+	render.JSON(w, r, map[string]interface{}{"currencies": results})
+}
+
+func (s Serving) getBalances(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "getBalances.root")
+	span.SetAttributes(attribute.String("server", "getBalances"))
+	defer span.End()
+
+	results, err := s.Client.balances(ctx, w, userID)
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+	render.JSON(w, r, map[string]interface{}{"balances": results})
+}
+
+func (s Serving) creditBalance(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	currency := chi.URLParam(r, "currency")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "creditBalance.root")
+	span.SetAttributes(attribute.String("server", "creditBalance"))
+	defer span.End()
+
+	var body struct {
+		Amount        int64  `json:"amount"`
+		Reason        string `json:"reason"`
+		CorrelationID string `json:"correlation_id"`
+	}
+	if err := render.DecodeJSON(r.Body, &body); err != nil {
+		errorRender(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if body.Amount <= 0 {
+		errorRender(w, r, http.StatusBadRequest, fmt.Errorf("amount must be positive"))
+		return
+	}
+	if body.Reason == "" {
+		body.Reason = reasonCredit
+	}
+	if !reasonPattern.MatchString(body.Reason) {
+		errorRender(w, r, http.StatusBadRequest, fmt.Errorf("reason must match %s", reasonPattern))
+		return
+	}
+	if body.CorrelationID == "" {
+		body.CorrelationID = uuid.NewString()
+	}
+
+	balance, err := s.Client.creditBalance(ctx, w, userID, currency, body.Amount, body.Reason, body.CorrelationID)
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+
+	publishEvent("currency.credited", map[string]interface{}{
+		"id":             userID,
+		"currency":       currency,
+		"amount":         body.Amount,
+		"reason":         body.Reason,
+		"correlation_id": body.CorrelationID,
+	})
+
+	render.JSON(w, r, map[string]interface{}{"currency": currency, "balance": balance})
+}
+
+func (s Serving) getLedger(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+
+	ctx, span := otel.Tracer("main").Start(ctx, "getLedger.root")
+	span.SetAttributes(attribute.String("server", "getLedger"))
+	defer span.End()
+
+	limit := defaultLedgerLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxLedgerLimit {
+			errorRender(w, r, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", maxLedgerLimit))
+			return
+		}
+		limit = n
+	}
+
+	results, err := s.Client.ledger(ctx, w, userID, r.URL.Query().Get("currency"), limit)
+	if err != nil {
+		errorRender(w, r, errorStatus(err), err)
+		return
+	}
+	render.JSON(w, r, map[string]interface{}{"entries": results})
+}